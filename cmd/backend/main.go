@@ -75,16 +75,31 @@ func main() {
 	adService := service.NewAdService(
 		app.Dispatcher,
 		app.Conn,
-		app.Cache,
+		app.ReplicatedLog,
+		app.Snapshotter,
+		app.Env.Snapshot.Interval,
+		bootstrap.NewRanking(app.Env),
+		app.FrequencyCapper,
+		app.BudgetPacer,
 		app.RedisLock,
 		app.AsynqClient,
+		app.AsynqInspector,
 	)
 
 	taskService := service.NewTaskService(adService)
 
+	healthService := service.NewHealthService(app.Conn, app.Cache, adService, app.Env.Server.ReadyMaxLag)
+
+	campaignService := service.NewCampaignService(app.Conn, adService)
+
+	trackingService := service.NewTrackingService(adService, app.Conn, app.EventWriter)
+
 	services := &bootstrap.Services{
-		AdService:   adService,
-		TaskService: taskService,
+		AdService:       adService,
+		TaskService:     taskService,
+		HealthService:   healthService,
+		CampaignService: campaignService,
+		TrackingService: trackingService,
 	}
 
 	// Init routes
@@ -4,15 +4,36 @@ import (
 	"dcard-backend-2024/pkg/bootstrap"
 	"dcard-backend-2024/pkg/model"
 	"log"
+
+	"gorm.io/gorm"
 )
 
 func main() {
 	env := bootstrap.NewEnv()
 	db := bootstrap.NewDB(env)
 	err := db.AutoMigrate(
+		&model.Advertiser{},
+		&model.Campaign{},
 		&model.Ad{},
+		&model.AdStatsHourly{},
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// rank the ads created before the ranking, their bids are 0 so they are ranked by recency
+	ranking := bootstrap.NewRanking(env)
+	var ads []*model.Ad
+	err = db.Where("is_active = ? AND rank = ?", true, 0).FindInBatches(&ads, 1000, func(tx *gorm.DB, batch int) error {
+		for _, ad := range ads {
+			rank := ranking.Rank(ad, 0)
+			if err := tx.Model(ad).UpdateColumn("rank", rank).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		log.Fatal(err)
+	}
 }
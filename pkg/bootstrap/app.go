@@ -3,7 +3,8 @@ package bootstrap
 import (
 	"context"
 	"dcard-backend-2024/pkg/dispatcher"
-	"dcard-backend-2024/pkg/inmem"
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/replog"
 	"fmt"
 	"log"
 	"net/http"
@@ -25,26 +26,39 @@ import (
 type AppOpts func(app *Application)
 
 type Application struct {
-	Env            *Env
-	Conn           *gorm.DB
-	Cache          *redis.Client
-	AsynqClient    *asynq.Client
-	AsynqServer    *asynq.Server
-	Engine         *gin.Engine
-	RedisLock      *redislock.Client
-	Dispatcher     *dispatcher.Dispatcher
-	AsyncServerMux *asynq.ServeMux
+	Env             *Env
+	Conn            *gorm.DB
+	Cache           *redis.Client
+	ReplicatedLog   model.ReplicatedLog
+	Snapshotter     model.Snapshotter
+	EventWriter     model.EventWriter
+	FrequencyCapper model.FrequencyCapper
+	BudgetPacer     model.BudgetPacer
+	AsynqClient     *asynq.Client
+	AsynqInspector  *asynq.Inspector
+	AsynqServer     *asynq.Server
+	Engine          *gin.Engine
+	RedisLock       *redislock.Client
+	Dispatcher      *dispatcher.Dispatcher
+	AsyncServerMux  *asynq.ServeMux
 }
 
 func App(opts ...AppOpts) *Application {
 	env := NewEnv()
 	db := NewDB(env)
 	cache := NewCache(env)
+	replicatedLog := NewReplicatedLog(env, cache)
+	snapshotter := NewSnapshotter(env)
+	eventWriter := NewEventWriter(env, db)
+	frequencyCapper := NewFrequencyCapper(env, cache)
+	budgetPacer := NewBudgetPacer(env, cache)
 	asynqClient := NewAsynqClient(env)
+	asynqInspector := NewAsynqInspector(env)
 	asynqServer := NewAsynqServer(env)
 	redisLock := NewRdLock(cache)
 	engine := gin.New()
-	adInMemStore := inmem.NewInMemoryStore()
+	RegisterValidations()
+	adInMemStore := NewInMemoryStore(env)
 	dispatcher := dispatcher.NewDispatcher(adInMemStore)
 	asynqServerMux := asynq.NewServeMux()
 
@@ -56,15 +70,21 @@ func App(opts ...AppOpts) *Application {
 	time.Local = tz
 
 	app := &Application{
-		Env:            env,
-		Conn:           db,
-		Cache:          cache,
-		Engine:         engine,
-		RedisLock:      redisLock,
-		Dispatcher:     dispatcher,
-		AsynqClient:    asynqClient,
-		AsynqServer:    asynqServer,
-		AsyncServerMux: asynqServerMux,
+		Env:             env,
+		Conn:            db,
+		Cache:           cache,
+		ReplicatedLog:   replicatedLog,
+		Snapshotter:     snapshotter,
+		EventWriter:     eventWriter,
+		FrequencyCapper: frequencyCapper,
+		BudgetPacer:     budgetPacer,
+		Engine:          engine,
+		RedisLock:       redisLock,
+		Dispatcher:      dispatcher,
+		AsynqClient:     asynqClient,
+		AsynqInspector:  asynqInspector,
+		AsynqServer:     asynqServer,
+		AsyncServerMux:  asynqServerMux,
 	}
 
 	for _, opt := range opts {
@@ -83,12 +103,18 @@ func NewTestApp(opts ...AppOpts) (*Application, *Mocks) {
 	env := NewEnv()
 	db, dbMock := NewMockDB()
 	cache, cacheMock := NewMockCache()
+	replicatedLog := replog.NewRedisStreamLog(cache, env.Log.Stream)
+	eventWriter := NewEventWriter(env, db)
+	frequencyCapper := NewFrequencyCapper(env, cache)
+	budgetPacer := NewBudgetPacer(env, cache)
 	redisLock := NewRdLock(cache)
 	asynqClient := NewAsynqClient(env)
+	asynqInspector := NewAsynqInspector(env)
 	asynqServer := NewAsynqServer(env)
 	engine := gin.Default()
+	RegisterValidations()
 	gin.SetMode(gin.TestMode)
-	adInMemStore := inmem.NewInMemoryStore()
+	adInMemStore := NewInMemoryStore(env)
 	dispatcher := dispatcher.NewDispatcher(adInMemStore)
 	asynqServerMux := asynq.NewServeMux()
 
@@ -100,15 +126,20 @@ func NewTestApp(opts ...AppOpts) (*Application, *Mocks) {
 	time.Local = tz
 
 	app := &Application{
-		Env:            env,
-		Conn:           db,
-		Cache:          cache,
-		Engine:         engine,
-		RedisLock:      redisLock,
-		Dispatcher:     dispatcher,
-		AsynqClient:    asynqClient,
-		AsynqServer:    asynqServer,
-		AsyncServerMux: asynqServerMux,
+		Env:             env,
+		Conn:            db,
+		Cache:           cache,
+		ReplicatedLog:   replicatedLog,
+		EventWriter:     eventWriter,
+		FrequencyCapper: frequencyCapper,
+		BudgetPacer:     budgetPacer,
+		Engine:          engine,
+		RedisLock:       redisLock,
+		Dispatcher:      dispatcher,
+		AsynqClient:     asynqClient,
+		AsynqInspector:  asynqInspector,
+		AsynqServer:     asynqServer,
+		AsyncServerMux:  asynqServerMux,
 	}
 
 	mocks := &Mocks{
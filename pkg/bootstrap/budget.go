@@ -0,0 +1,22 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/budget"
+	"dcard-backend-2024/pkg/model"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type BudgetEnv struct {
+	// KeyPrefix is the prefix of the redis counters of the impressions per ad
+	KeyPrefix string `env:"KEY_PREFIX" envDefault:"budget"`
+	// SyncInterval is how stale the impressions served by the other replicas can be
+	SyncInterval time.Duration `env:"SYNC_INTERVAL" envDefault:"1s"`
+	// PacingSlack is how far ahead of the even delivery an ad can be, as a fraction of its daily budget
+	PacingSlack float64 `env:"PACING_SLACK" envDefault:"0.05"`
+}
+
+func NewBudgetPacer(env *Env, cache *redis.Client) model.BudgetPacer {
+	return budget.NewPacer(cache, env.Budget.KeyPrefix, env.Budget.SyncInterval, env.Budget.PacingSlack)
+}
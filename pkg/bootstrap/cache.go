@@ -50,6 +50,16 @@ func NewAsynqClient(env *Env) *asynq.Client {
 	)
 }
 
+func NewAsynqInspector(env *Env) *asynq.Inspector {
+	return asynq.NewInspector(
+		asynq.RedisClientOpt{
+			Addr:     fmt.Sprintf("%s:%d", env.Redis.Host, env.Redis.Port),
+			Password: env.Redis.Password,
+			DB:       0,
+		},
+	)
+}
+
 func NewAsynqServer(env *Env) *asynq.Server {
 	return asynq.NewServer(
 		asynq.RedisClientOpt{
@@ -7,11 +7,21 @@ import (
 )
 
 type Env struct {
-	DB     DBEnv    `envPrefix:"DB_"`
-	Redis  RedisEnv `envPrefix:"REDIS_"`
-	Server Server   `envPrefix:"SERVER_"`
-	JWT    JWTEnv   `envPrefix:"JWT_"`
-	Domain string   `env:"DOMAIN" envDefault:"localhost"`
+	DB        DBEnv        `envPrefix:"DB_"`
+	Redis     RedisEnv     `envPrefix:"REDIS_"`
+	Server    Server       `envPrefix:"SERVER_"`
+	JWT       JWTEnv       `envPrefix:"JWT_"`
+	Log       LogEnv       `envPrefix:"LOG_"`
+	Snapshot  SnapshotEnv  `envPrefix:"SNAPSHOT_"`
+	Tracking  TrackingEnv  `envPrefix:"TRACKING_"`
+	Ranking   RankingEnv   `envPrefix:"RANKING_"`
+	Frequency FrequencyEnv `envPrefix:"FREQUENCY_"`
+	Budget    BudgetEnv    `envPrefix:"BUDGET_"`
+	Domain    string       `env:"DOMAIN" envDefault:"localhost"`
+	// IndexLayout is the ordered index fields of the in-memory store, see model.ParseIndexLayout
+	IndexLayout string `env:"INDEX_LAYOUT" envDefault:"Country:multi,Platform:multi,Gender:multi,Language:prefix,Region:prefix,Tags:tags,Age:interval"`
+	// InMemoryStore is the implementation of the in-memory store, tree or bitmap
+	InMemoryStore string `env:"INMEM_STORE" envDefault:"tree"`
 }
 
 func NewEnv() *Env {
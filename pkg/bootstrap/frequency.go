@@ -0,0 +1,20 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/frequency"
+	"dcard-backend-2024/pkg/model"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type FrequencyEnv struct {
+	// KeyPrefix is the prefix of the redis hashes of the impressions per user per day
+	KeyPrefix string `env:"KEY_PREFIX" envDefault:"freq"`
+	// SyncInterval is how stale the impressions served by the other replicas can be
+	SyncInterval time.Duration `env:"SYNC_INTERVAL" envDefault:"1s"`
+}
+
+func NewFrequencyCapper(env *Env, cache *redis.Client) model.FrequencyCapper {
+	return frequency.NewCapper(cache, env.Frequency.KeyPrefix, env.Frequency.SyncInterval)
+}
@@ -0,0 +1,31 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/inmem"
+	"dcard-backend-2024/pkg/model"
+	"log"
+)
+
+func NewIndexLayout(env *Env) model.IndexLayout {
+	layout, err := model.ParseIndexLayout(env.IndexLayout)
+	if err != nil {
+		log.Fatalf("Failed to parse index layout: %v", err)
+	}
+	log.Printf("Index layout: %s", layout)
+	return layout
+}
+
+// NewInMemoryStore creates the in-memory store of env.InMemoryStore:
+// tree is the index tree of the layout, bitmap is the inverted index of the bitmaps of the fields of the layout
+func NewInMemoryStore(env *Env) model.InMemoryStore {
+	layout := NewIndexLayout(env)
+	switch env.InMemoryStore {
+	case "tree":
+		return inmem.NewInMemoryStoreWithLayout(layout)
+	case "bitmap":
+		return inmem.NewBitmapStoreWithLayout(layout)
+	default:
+		log.Fatalf("Unknown in-memory store: %s", env.InMemoryStore)
+		return nil
+	}
+}
@@ -0,0 +1,30 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"log"
+)
+
+type RankingEnv struct {
+	BidWeight float64 `env:"BID_WEIGHT" envDefault:"1"`
+	// RecencyWeight is the value of an ad created an hour later, in the unit of the bid
+	RecencyWeight float64 `env:"RECENCY_WEIGHT" envDefault:"0.01"`
+	// CTRWeight is the value of a click-through rate of 1, the CTR is not counted if it is 0
+	CTRWeight float64 `env:"CTR_WEIGHT" envDefault:"0"`
+	// CTRMinImpressions is the number of the impressions below which the CTR of the ad is counted as 0
+	CTRMinImpressions int64 `env:"CTR_MIN_IMPRESSIONS" envDefault:"1000"`
+	// TagWeight is the value of every tag of an ad matching an interest of the viewer, in the unit of the bid
+	TagWeight float64 `env:"TAG_WEIGHT" envDefault:"0.5"`
+}
+
+func NewRanking(env *Env) *model.Ranking {
+	ranking := &model.Ranking{
+		BidWeight:         env.Ranking.BidWeight,
+		RecencyWeight:     env.Ranking.RecencyWeight,
+		CTRWeight:         env.Ranking.CTRWeight,
+		CTRMinImpressions: env.Ranking.CTRMinImpressions,
+		TagWeight:         env.Ranking.TagWeight,
+	}
+	log.Printf("Ranking: %+v", *ranking)
+	return ranking
+}
@@ -0,0 +1,33 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/replog"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type LogEnv struct {
+	// Kind is the backend of the replicated log, redis or file
+	Kind string `env:"KIND" envDefault:"redis"`
+	// Stream is the redis stream name
+	Stream string `env:"STREAM" envDefault:"ad"`
+	// Path is the file of the file log, the log is kept in memory only if it is empty
+	Path string `env:"PATH" envDefault:""`
+}
+
+func NewReplicatedLog(env *Env, cache *redis.Client) model.ReplicatedLog {
+	switch env.Log.Kind {
+	case "redis":
+		return replog.NewRedisStreamLog(cache, env.Log.Stream)
+	case "file":
+		fileLog, err := replog.NewFileLog(env.Log.Path)
+		if err != nil {
+			log.Fatalf("Failed to open file log: %v", err)
+		}
+		return fileLog
+	default:
+		panic("Unsupported replicated log kind")
+	}
+}
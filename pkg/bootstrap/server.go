@@ -3,4 +3,6 @@ package bootstrap
 type Server struct {
 	Port     uint   `env:"PORT" envDefault:"8000"`
 	TimeZone string `env:"TIMEZONE" envDefault:"Asia/Taipei"`
+	// ReadyMaxLag is the max number of versions the subscriber can fall behind the replicated log while /readyz is ok
+	ReadyMaxLag int64 `env:"READY_MAX_LAG" envDefault:"100"`
 }
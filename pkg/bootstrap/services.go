@@ -6,12 +6,18 @@ import (
 )
 
 type Services struct {
-	AdService   model.AdService
-	TaskService model.TaskService
+	AdService       model.AdService
+	TaskService     model.TaskService
+	HealthService   model.HealthService
+	CampaignService model.CampaignService
+	TrackingService model.TrackingService
 }
 
 func (s *Services) Run() chan error {
 	errCh := make(chan error)
+	if s.TrackingService != nil {
+		go s.TrackingService.Run()
+	}
 	go func() {
 		if err := s.AdService.Run(); err != nil {
 			errCh <- err
@@ -24,5 +30,11 @@ func (s *Services) Shutdown(ctx context.Context) error {
 	if err := s.AdService.Shutdown(ctx); err != nil {
 		return err
 	}
+	if s.TrackingService != nil {
+		// flush the buffered events
+		if err := s.TrackingService.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
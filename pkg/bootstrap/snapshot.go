@@ -0,0 +1,28 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/snapshot"
+	"log"
+	"time"
+)
+
+type SnapshotEnv struct {
+	// Dir is the directory of the snapshots, the snapshot is disabled if it is empty
+	Dir string `env:"DIR" envDefault:""`
+	// Interval is the period of taking the snapshot
+	Interval time.Duration `env:"INTERVAL" envDefault:"1m"`
+	// Keep is the number of the newest snapshots kept on disk
+	Keep int `env:"KEEP" envDefault:"2"`
+}
+
+func NewSnapshotter(env *Env) model.Snapshotter {
+	if env.Snapshot.Dir == "" {
+		return nil
+	}
+	snapshotter, err := snapshot.NewFileSnapshotter(env.Snapshot.Dir, env.Snapshot.Keep)
+	if err != nil {
+		log.Fatalf("Failed to open snapshot dir: %v", err)
+	}
+	return snapshotter
+}
@@ -0,0 +1,22 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/tracking"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type TrackingEnv struct {
+	// BufferSize is the number of the events waiting to be aggregated, the events are dropped if the buffer is full
+	BufferSize int `env:"BUFFER_SIZE" envDefault:"10000"`
+	// BatchSize is the number of the pending (ad, hour) rows which triggers a flush
+	BatchSize int `env:"BATCH_SIZE" envDefault:"1000"`
+	// FlushInterval is the period of flushing the aggregated events into the database
+	FlushInterval time.Duration `env:"FLUSH_INTERVAL" envDefault:"5s"`
+}
+
+func NewEventWriter(env *Env, db *gorm.DB) model.EventWriter {
+	return tracking.NewBatchWriter(db, env.Tracking.BufferSize, env.Tracking.BatchSize, env.Tracking.FlushInterval)
+}
@@ -0,0 +1,45 @@
+package bootstrap
+
+import (
+	"dcard-backend-2024/pkg/targeting"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// RegisterValidations registers the custom binding tags of the requests:
+// targeting validates the targeting expression of the ad,
+// uniquefold validates the strings of a slice are unique case-insensitively, e.g. the tags of the ad
+func RegisterValidations() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		log.Fatal("Failed to get the validator of the binding")
+	}
+	err := v.RegisterValidation("targeting", func(fl validator.FieldLevel) bool {
+		return targeting.Validate(fl.Field().String()) == nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to register the targeting validation: %v", err)
+	}
+	err = v.RegisterValidation("uniquefold", func(fl validator.FieldLevel) bool {
+		field := fl.Field()
+		if field.Kind() != reflect.Slice {
+			return false
+		}
+		seen := make(map[string]struct{}, field.Len())
+		for i := 0; i < field.Len(); i++ {
+			s := strings.ToLower(field.Index(i).String())
+			if _, ok := seen[s]; ok {
+				return false
+			}
+			seen[s] = struct{}{}
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatalf("Failed to register the uniquefold validation: %v", err)
+	}
+}
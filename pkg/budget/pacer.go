@@ -0,0 +1,354 @@
+package budget
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/metrics"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dayLayout = "20060102"
+	// idleTimeout is how long the counts of an ad not served are kept
+	idleTimeout = 10 * time.Minute
+)
+
+// adCounts is the impressions of an ad across the replicas as of the last sync, plus the pending ones
+type adCounts struct {
+	day      string
+	daily    int64
+	lifetime int64
+	// pending is the impressions served by this replica on day which are not synced to redis yet
+	pending int64
+	// carried is the pending impressions of the previous days by day, synced into the daily keys of their days
+	carried map[string]int64
+	// ad is the latest version of the ad seen, its EndAt is the expiry of the lifetime count
+	ad     *model.Ad
+	seenAt time.Time
+}
+
+// Pacer counts the daily and lifetime impressions of the budgeted ads in memory,
+// and shares the counts with the other replicas through redis every syncInterval.
+//
+// The daily budget is paced evenly over the part of the day the ad is served:
+// the ad is served while its impressions are behind the even delivery,
+// and the serve probability decreases linearly to 0 as the impressions get ahead by slack * DailyBudget.
+// The ad is removed from the results once the daily or lifetime budget is exhausted,
+// and the daily budget is re-enabled on the next day in the local timezone.
+// The budgets may be overrun by the impressions served by the other replicas within a sync interval.
+type Pacer struct {
+	cache        *redis.Client
+	keyPrefix    string
+	syncInterval time.Duration
+	slack        float64
+	mu           sync.Mutex
+	ads          map[string]*adCounts
+	// now and random are replaced in the tests
+	now     func() time.Time
+	random  func() float64
+	closed  atomic.Bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func NewPacer(cache *redis.Client, keyPrefix string, syncInterval time.Duration, slack float64) *Pacer {
+	return &Pacer{
+		cache:        cache,
+		keyPrefix:    keyPrefix,
+		syncInterval: syncInterval,
+		slack:        slack,
+		ads:          make(map[string]*adCounts),
+		now:          time.Now,
+		random:       rand.Float64,
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Filter implements model.BudgetPacer.
+// The counts of the ads seen for the first time are read from redis before filtering.
+func (p *Pacer) Filter(ctx context.Context, ads []*model.Ad) []*model.Ad {
+	if !anyBudgeted(ads) {
+		return ads
+	}
+	if unknown := p.unknownAds(ads); len(unknown) > 0 {
+		p.sync(ctx, unknown)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	ret := make([]*model.Ad, 0, len(ads))
+	for _, ad := range ads {
+		if !budgeted(ad) {
+			ret = append(ret, ad)
+			continue
+		}
+		c := p.counts(ad)
+		c.seenAt = now
+		switch {
+		case ad.LifetimeBudget > 0 && c.lifetime >= int64(ad.LifetimeBudget):
+			metrics.BudgetThrottledAds.WithLabelValues("lifetime").Inc()
+		case ad.DailyBudget > 0 && c.daily >= int64(ad.DailyBudget):
+			metrics.BudgetThrottledAds.WithLabelValues("daily").Inc()
+		case ad.DailyBudget > 0 && p.random() >= p.serveProbability(ad, c.daily, now):
+			metrics.BudgetThrottledAds.WithLabelValues("paced").Inc()
+		default:
+			ret = append(ret, ad)
+		}
+	}
+	return ret
+}
+
+// Record implements model.BudgetPacer.
+func (p *Pacer) Record(ctx context.Context, ads []*model.Ad) {
+	if !anyBudgeted(ads) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ad := range ads {
+		if !budgeted(ad) {
+			continue
+		}
+		c := p.counts(ad)
+		c.daily++
+		c.lifetime++
+		c.pending++
+	}
+}
+
+// Run implements model.BudgetPacer.
+// It syncs every ad served within idleTimeout, and evicts the others.
+func (p *Pacer) Run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.sync(context.Background(), p.activeAds())
+		case <-p.done:
+			p.sync(context.Background(), p.activeAds())
+			return
+		}
+	}
+}
+
+// Close implements model.BudgetPacer.
+func (p *Pacer) Close(ctx context.Context) error {
+	if p.closed.CompareAndSwap(false, true) {
+		close(p.done)
+	}
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serveProbability paces the daily budget evenly over the serving window of the ad on the current day
+func (p *Pacer) serveProbability(ad *model.Ad, daily int64, now time.Time) float64 {
+	y, m, d := now.Date()
+	dayStart := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	windowStart, windowEnd := dayStart, dayStart.AddDate(0, 0, 1)
+	if ad.StartAt.T().After(windowStart) {
+		windowStart = ad.StartAt.T()
+	}
+	if ad.EndAt.T().Before(windowEnd) {
+		windowEnd = ad.EndAt.T()
+	}
+	elapsed := 1.0
+	if windowEnd.After(windowStart) {
+		elapsed = min(1, max(0, float64(now.Sub(windowStart))/float64(windowEnd.Sub(windowStart))))
+	}
+	budget := float64(ad.DailyBudget)
+	target := budget * elapsed
+	slack := max(1, budget*p.slack)
+	return min(1, max(0, (target+slack-float64(daily))/slack))
+}
+
+// counts returns the counts of the ad on the current day, p.mu must be held
+func (p *Pacer) counts(ad *model.Ad) *adCounts {
+	adID := ad.ID.String()
+	day := p.now().Format(dayLayout)
+	c, ok := p.ads[adID]
+	if !ok {
+		c = &adCounts{day: day}
+		p.ads[adID] = c
+	} else if c.day != day {
+		// the unsynced impressions of the previous day are still synced into the previous day, not charged to the new one
+		c.carry(c.day, c.pending)
+		c.day, c.daily, c.pending = day, 0, 0
+	}
+	c.ad = ad
+	return c
+}
+
+// carry adds the pending impressions of the previous day to sync, c.day is not changed
+func (c *adCounts) carry(day string, pending int64) {
+	if pending == 0 {
+		return
+	}
+	if c.carried == nil {
+		c.carried = make(map[string]int64)
+	}
+	c.carried[day] += pending
+}
+
+func (p *Pacer) unknownAds(ads []*model.Ad) []*model.Ad {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	day := p.now().Format(dayLayout)
+	unknown := make([]*model.Ad, 0)
+	for _, ad := range ads {
+		if !budgeted(ad) {
+			continue
+		}
+		if c, ok := p.ads[ad.ID.String()]; !ok || c.day != day {
+			unknown = append(unknown, ad)
+		}
+	}
+	return unknown
+}
+
+// activeAds returns the ads served within idleTimeout and evicts the others
+func (p *Pacer) activeAds() []*model.Ad {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	ads := make([]*model.Ad, 0, len(p.ads))
+	for adID, c := range p.ads {
+		if c.pending == 0 && len(c.carried) == 0 && now.Sub(c.seenAt) >= idleTimeout {
+			delete(p.ads, adID)
+			continue
+		}
+		ads = append(ads, c.ad)
+	}
+	return ads
+}
+
+func (p *Pacer) dailyKey(day string, adID string) string {
+	return fmt.Sprintf("%s:%s:%s", p.keyPrefix, day, adID)
+}
+
+func (p *Pacer) lifetimeKey(adID string) string {
+	return fmt.Sprintf("%s:lifetime:%s", p.keyPrefix, adID)
+}
+
+// sync adds the pending impressions of the ads to redis and reads back the counts of all the replicas
+func (p *Pacer) sync(ctx context.Context, ads []*model.Ad) {
+	if len(ads) == 0 {
+		return
+	}
+	start := p.now()
+	day := start.Format(dayLayout)
+
+	p.mu.Lock()
+	pending := make(map[string]int64, len(ads))
+	carried := make(map[string]map[string]int64)
+	for _, ad := range ads {
+		c := p.counts(ad)
+		pending[ad.ID.String()] = c.pending
+		c.pending = 0
+		if len(c.carried) > 0 {
+			carried[ad.ID.String()] = c.carried
+			c.carried = nil
+		}
+	}
+	p.mu.Unlock()
+
+	pipe := p.cache.Pipeline()
+	reads := make(map[string]*redis.SliceCmd, len(ads))
+	for _, ad := range ads {
+		adID := ad.ID.String()
+		for d, n := range carried[adID] {
+			p.incr(ctx, pipe, ad, d, n, start.Location())
+		}
+		if n := pending[adID]; n > 0 {
+			p.incr(ctx, pipe, ad, day, n, start.Location())
+		}
+		reads[adID] = pipe.MGet(ctx, p.dailyKey(day, adID), p.lifetimeKey(adID))
+	}
+	_, err := pipe.Exec(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if err != nil {
+		metrics.BudgetSyncDuration.WithLabelValues("error").Observe(now.Sub(start).Seconds())
+		log.Printf("error syncing the budgets of %d ads: %v", len(ads), err)
+		for _, ad := range ads {
+			c := p.counts(ad)
+			// retry the pending impressions with the next sync, and serve by the local counts until then
+			if c.day != day {
+				c.carry(day, pending[ad.ID.String()])
+			} else {
+				c.pending += pending[ad.ID.String()]
+			}
+			for d, n := range carried[ad.ID.String()] {
+				c.carry(d, n)
+			}
+		}
+		return
+	}
+	metrics.BudgetSyncDuration.WithLabelValues("ok").Observe(now.Sub(start).Seconds())
+	for _, ad := range ads {
+		adID := ad.ID.String()
+		c := p.counts(ad)
+		if c.day != day {
+			continue
+		}
+		// the impressions recorded during the sync are not in redis yet
+		vals := reads[adID].Val()
+		c.daily = parseCount(vals[0]) + c.pending
+		c.lifetime = parseCount(vals[1]) + c.pending
+	}
+}
+
+// incr adds the impressions of the ad on the day to its daily and lifetime keys,
+// the daily keys expire an hour after the end of their day, and the lifetime keys a day after the ad ends
+func (p *Pacer) incr(ctx context.Context, pipe redis.Pipeliner, ad *model.Ad, day string, n int64, loc *time.Location) {
+	dayStart, err := time.ParseInLocation(dayLayout, day, loc)
+	if err != nil {
+		log.Printf("error parsing the budget day %s: %v", day, err)
+		return
+	}
+	y, m, d := dayStart.Date()
+	dailyKey, lifetimeKey := p.dailyKey(day, ad.ID.String()), p.lifetimeKey(ad.ID.String())
+	pipe.IncrBy(ctx, dailyKey, n)
+	pipe.ExpireAt(ctx, dailyKey, time.Date(y, m, d+1, 1, 0, 0, 0, loc))
+	pipe.IncrBy(ctx, lifetimeKey, n)
+	pipe.ExpireAt(ctx, lifetimeKey, ad.EndAt.T().Add(24*time.Hour))
+}
+
+// parseCount parses the value of MGET, the missing key is counted as 0
+func parseCount(v interface{}) int64 {
+	s, ok := v.(string)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+func budgeted(ad *model.Ad) bool {
+	return ad.DailyBudget > 0 || ad.LifetimeBudget > 0
+}
+
+func anyBudgeted(ads []*model.Ad) bool {
+	for _, ad := range ads {
+		if budgeted(ad) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package budget
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAd(daily, lifetime uint64, startAt, endAt time.Time) *model.Ad {
+	return &model.Ad{
+		ID:             uuid.New(),
+		StartAt:        model.CustomTime(startAt),
+		EndAt:          model.CustomTime(endAt),
+		DailyBudget:    daily,
+		LifetimeBudget: lifetime,
+	}
+}
+
+func TestPacer_serveProbability(t *testing.T) {
+	p := NewPacer(nil, "budget", time.Second, 0.05)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	allDay := newAd(1000, 0, day.AddDate(0, 0, -1), day.AddDate(0, 0, 7))
+	evening := newAd(1000, 0, day.Add(18*time.Hour), day.AddDate(0, 0, 7))
+	tests := []struct {
+		name  string
+		ad    *model.Ad
+		now   time.Time
+		daily int64
+		want  float64
+	}{
+		{name: "behind the even delivery", ad: allDay, now: day.Add(12 * time.Hour), daily: 400, want: 1},
+		{name: "on the even delivery", ad: allDay, now: day.Add(12 * time.Hour), daily: 500, want: 1},
+		{name: "ahead by half of the slack", ad: allDay, now: day.Add(12 * time.Hour), daily: 525, want: 0.5},
+		{name: "ahead by the slack", ad: allDay, now: day.Add(12 * time.Hour), daily: 550, want: 0},
+		{name: "start of the day", ad: allDay, now: day, daily: 50, want: 0},
+		{name: "paced from StartAt", ad: evening, now: day.Add(21 * time.Hour), daily: 500, want: 1},
+		{name: "ahead from StartAt", ad: evening, now: day.Add(21 * time.Hour), daily: 550, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, p.serveProbability(tt.ad, tt.daily, tt.now), 1e-9)
+		})
+	}
+}
+
+func TestPacer(t *testing.T) {
+	cache, mock := redismock.NewClientMock()
+	p := NewPacer(cache, "budget", time.Second, 0.05)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	p.random = func() float64 { return 0.99 }
+	startAt, endAt := now.AddDate(0, 0, -1), now.AddDate(0, 0, 7)
+	daily := newAd(100, 0, startAt, endAt)
+	lifetime := newAd(0, 100, startAt, endAt)
+	unlimited := newAd(0, 0, startAt, endAt)
+	ads := []*model.Ad{daily, lifetime, unlimited}
+
+	// the counts of all the replicas are read before the first serve
+	mock.ExpectMGet("budget:20240101:"+daily.ID.String(), "budget:lifetime:"+daily.ID.String()).SetVal([]interface{}{"45", "450"})
+	mock.ExpectMGet("budget:20240101:"+lifetime.ID.String(), "budget:lifetime:"+lifetime.ID.String()).SetVal([]interface{}{nil, "99"})
+	served := p.Filter(context.Background(), ads)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, ads, served)
+	p.Record(context.Background(), served)
+
+	// the lifetime budget is exhausted
+	assert.Equal(t, []*model.Ad{daily, unlimited}, p.Filter(context.Background(), ads))
+	for i := 0; i < 9; i++ {
+		p.Record(context.Background(), []*model.Ad{daily})
+	}
+	// 55 of 100 impressions at noon is ahead of the even delivery by the slack
+	assert.Equal(t, []*model.Ad{unlimited}, p.Filter(context.Background(), ads))
+
+	// the pending impressions are synced
+	mock.MatchExpectationsInOrder(false)
+	dayEnd := time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)
+	mock.ExpectIncrBy("budget:20240101:"+daily.ID.String(), 10).SetVal(55)
+	mock.ExpectExpireAt("budget:20240101:"+daily.ID.String(), dayEnd).SetVal(true)
+	mock.ExpectIncrBy("budget:lifetime:"+daily.ID.String(), 10).SetVal(460)
+	mock.ExpectExpireAt("budget:lifetime:"+daily.ID.String(), endAt.Add(24*time.Hour)).SetVal(true)
+	mock.ExpectMGet("budget:20240101:"+daily.ID.String(), "budget:lifetime:"+daily.ID.String()).SetVal([]interface{}{"55", "460"})
+	mock.ExpectIncrBy("budget:20240101:"+lifetime.ID.String(), 1).SetVal(1)
+	mock.ExpectExpireAt("budget:20240101:"+lifetime.ID.String(), dayEnd).SetVal(true)
+	mock.ExpectIncrBy("budget:lifetime:"+lifetime.ID.String(), 1).SetVal(100)
+	mock.ExpectExpireAt("budget:lifetime:"+lifetime.ID.String(), endAt.Add(24*time.Hour)).SetVal(true)
+	mock.ExpectMGet("budget:20240101:"+lifetime.ID.String(), "budget:lifetime:"+lifetime.ID.String()).SetVal([]interface{}{"1", "100"})
+	p.sync(context.Background(), p.activeAds())
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, int64(55), p.ads[daily.ID.String()].daily)
+	assert.Equal(t, int64(0), p.ads[daily.ID.String()].pending)
+
+	// the daily budget is re-enabled on the next day
+	now = now.Add(12 * time.Hour)
+	mock.ExpectMGet("budget:20240102:"+daily.ID.String(), "budget:lifetime:"+daily.ID.String()).SetVal([]interface{}{nil, "460"})
+	mock.ExpectMGet("budget:20240102:"+lifetime.ID.String(), "budget:lifetime:"+lifetime.ID.String()).SetVal([]interface{}{nil, "100"})
+	assert.Equal(t, []*model.Ad{daily, unlimited}, p.Filter(context.Background(), ads))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPacer_syncError(t *testing.T) {
+	cache, mock := redismock.NewClientMock()
+	p := NewPacer(cache, "budget", time.Second, 0.05)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	ad := newAd(0, 1, now.AddDate(0, 0, -1), now.AddDate(0, 0, 7))
+
+	mock.ExpectMGet("budget:20240101:"+ad.ID.String(), "budget:lifetime:"+ad.ID.String()).SetErr(fmt.Errorf("connection refused"))
+	assert.Equal(t, []*model.Ad{ad}, p.Filter(context.Background(), []*model.Ad{ad}))
+	p.Record(context.Background(), []*model.Ad{ad})
+	// the local counts are enforced without redis
+	assert.Empty(t, p.Filter(context.Background(), []*model.Ad{ad}))
+
+	// the failed impressions are retried by the next sync
+	mock.ExpectIncrBy("budget:20240101:"+ad.ID.String(), 1).SetErr(fmt.Errorf("connection refused"))
+	p.sync(context.Background(), p.activeAds())
+	assert.Equal(t, int64(1), p.ads[ad.ID.String()].pending)
+	assert.Equal(t, int64(1), p.ads[ad.ID.String()].lifetime)
+}
+
+func TestPacer_rollover(t *testing.T) {
+	cache, mock := redismock.NewClientMock()
+	p := NewPacer(cache, "budget", time.Second, 0.05)
+	now := time.Date(2024, 1, 1, 23, 59, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	p.random = func() float64 { return 0 }
+	endAt := now.AddDate(0, 0, 7)
+	ad := newAd(100, 0, now.AddDate(0, 0, -1), endAt)
+
+	mock.ExpectMGet("budget:20240101:"+ad.ID.String(), "budget:lifetime:"+ad.ID.String()).SetVal([]interface{}{"90", "90"})
+	assert.Equal(t, []*model.Ad{ad}, p.Filter(context.Background(), []*model.Ad{ad}))
+	for i := 0; i < 5; i++ {
+		p.Record(context.Background(), []*model.Ad{ad})
+	}
+
+	// the impressions unsynced before midnight are synced into the previous day, not charged to the new one
+	now = now.Add(2 * time.Minute)
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectIncrBy("budget:20240101:"+ad.ID.String(), 5).SetVal(95)
+	mock.ExpectExpireAt("budget:20240101:"+ad.ID.String(), time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)).SetVal(true)
+	mock.ExpectIncrBy("budget:lifetime:"+ad.ID.String(), 5).SetVal(95)
+	mock.ExpectExpireAt("budget:lifetime:"+ad.ID.String(), endAt.Add(24*time.Hour)).SetVal(true)
+	mock.ExpectMGet("budget:20240102:"+ad.ID.String(), "budget:lifetime:"+ad.ID.String()).SetVal([]interface{}{nil, "95"})
+	assert.Equal(t, []*model.Ad{ad}, p.Filter(context.Background(), []*model.Ad{ad}))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	c := p.ads[ad.ID.String()]
+	assert.Equal(t, "20240102", c.day)
+	assert.Equal(t, int64(0), c.daily)
+	assert.Equal(t, int64(0), c.pending)
+	assert.Empty(t, c.carried)
+	assert.Equal(t, int64(95), c.lifetime)
+}
@@ -3,10 +3,13 @@ package controller
 import (
 	"dcard-backend-2024/pkg/inmem"
 	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/service"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type AdController struct {
@@ -25,12 +28,21 @@ func NewAdController(adService model.AdService) *AdController {
 // @Tags Ad
 // @Accept json
 // @Produce json
-// @Param offset query int false "Offset for pagination"
+// @Param offset query int false "Offset for pagination, a request with tags reads the first offset+limit untagged ads, so deep pages with tags should use the cursor"
 // @Param limit query int false "Limit for pagination"
 // @Param age query int false "Age"
 // @Param gender query string false "Gender"
 // @Param country query string false "Country"
 // @Param platform query string false "Platform"
+// @Param language query string false "BCP 47 language tag of the UI"
+// @Param region query string false "ISO 3166-2 subdivision"
+// @Param app_version query string false "Semantic version of the client app"
+// @Param tz query string false "IANA time zone of the viewer for the ad schedules, APP_SERVER_TIMEZONE of the server if omitted"
+// @Param lat query number false "Latitude of the viewer, required with long"
+// @Param long query number false "Longitude of the viewer, required with lat"
+// @Param tags query []string false "Interests of the viewer, the ads with tags are only served if they share one" collectionFormat(multi)
+// @Param user_id query string false "User or device ID, the ads reaching their frequency caps for the user are skipped"
+// @Param cursor query string false "Cursor of the next page, the next_cursor of the previous page"
 // @Success 200 {object} model.GetAdsPageResponse
 // @Failure 404 {object} model.Response
 // @Failure 500 {object} model.Response
@@ -42,17 +54,48 @@ func (ac *AdController) GetAd(c *gin.Context) {
 		return
 	}
 
-	ads, total, err := ac.adService.GetAds(c, &req)
+	if req.Cursor != "" {
+		after, err := model.DecodeAdCursor(req.Cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+			return
+		}
+		req.After = after
+	}
+	if req.AppVersionQuery != "" {
+		version, err := model.ParseAppVersion(req.AppVersionQuery)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+			return
+		}
+		req.AppVersion = version
+	}
+	if req.TZ != "" {
+		loc, err := time.LoadLocation(req.TZ)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+			return
+		}
+		req.Location = loc
+	}
+	if req.Lat != nil && req.Long != nil {
+		req.Geo = &model.GeoPoint{Lat: *req.Lat, Long: *req.Long}
+	}
+
+	page, err := ac.adService.GetAds(c, &req)
 	switch {
 	case errors.Is(err, inmem.ErrNoAdsFound):
 		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
 		return
+	case errors.Is(err, service.ErrReplicaBehind):
+		c.JSON(http.StatusServiceUnavailable, model.Response{Msg: err.Error()})
+		return
 	case err != nil:
 		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, model.GetAdsPageResponse{Ads: ads, Total: total})
+	c.JSON(http.StatusOK, page)
 }
 
 // CreateAd godoc
@@ -64,7 +107,10 @@ func (ac *AdController) GetAd(c *gin.Context) {
 // @Param ad body model.CreateAdRequest true "Ad object"
 // @Success 201 {object} model.CreateAdResponse
 // @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
 // @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
 // @Router /api/v1/ad [post]
 func (ac *AdController) CreateAd(c *gin.Context) {
 	var ad model.CreateAdRequest
@@ -73,23 +119,197 @@ func (ac *AdController) CreateAd(c *gin.Context) {
 		return
 	}
 
-	adID, err := ac.adService.CreateAd(c,
+	adID, err := ac.adService.CreateAd(c.Request.Context(),
 		&model.Ad{
-			Title:    ad.Title,
-			Content:  ad.Content,
-			StartAt:  ad.StartAt,
-			EndAt:    ad.EndAt,
-			AgeStart: ad.AgeStart,
-			AgeEnd:   ad.AgeEnd,
-			Gender:   ad.Gender,
-			Country:  ad.Country,
-			Platform: ad.Platform,
+			Title:                       ad.Title,
+			Content:                     ad.Content,
+			LandingURL:                  ad.LandingURL,
+			StartAt:                     ad.StartAt,
+			EndAt:                       ad.EndAt,
+			AgeStart:                    ad.AgeStart,
+			AgeEnd:                      ad.AgeEnd,
+			Gender:                      ad.Gender,
+			Country:                     ad.Country,
+			Platform:                    ad.Platform,
+			ExcludeGender:               ad.ExcludeGender,
+			ExcludeCountry:              ad.ExcludeCountry,
+			ExcludePlatform:             ad.ExcludePlatform,
+			Language:                    ad.Language,
+			Region:                      ad.Region,
+			AppVersionStart:             ad.AppVersionMin,
+			AppVersionEnd:               ad.AppVersionMax,
+			Targeting:                   ad.Targeting,
+			Schedule:                    ad.Schedule,
+			Geo:                         ad.Geo,
+			Tags:                        ad.Tags,
+			Bid:                         ad.Bid,
+			MaxImpressionsPerUserPerDay: ad.MaxImpressionsPerUserPerDay,
+			DailyBudget:                 ad.DailyBudget,
+			LifetimeBudget:              ad.LifetimeBudget,
+			CampaignID:                  ad.CampaignID,
 		},
 	)
-	if err != nil {
+	switch {
+	case errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrInvalidAd):
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusCreated, model.Response{Msg: "Ad created", Data: adID})
 }
+
+// GetAdByID godoc
+// @Summary Get an ad by ID
+// @Description Retrieves an active ad by ID
+// @Tags Ad
+// @Accept json
+// @Produce json
+// @Param id path string true "Ad ID"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Router /api/v1/ad/{id} [get]
+func (ac *AdController) GetAdByID(c *gin.Context) {
+	adID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	ad, err := ac.adService.GetAd(c, adID.String())
+	switch {
+	case errors.Is(err, inmem.ErrNoAdsFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.Response{Msg: "OK", Data: ad})
+}
+
+// DeleteAd godoc
+// @Summary Delete an ad
+// @Description Take down an active ad before its end time
+// @Tags Ad
+// @Accept json
+// @Produce json
+// @Param id path string true "Ad ID"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/ad/{id} [delete]
+func (ac *AdController) DeleteAd(c *gin.Context) {
+	adID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	err = ac.adService.DeleteAd(c.Request.Context(), adID.String())
+	switch {
+	case errors.Is(err, service.ErrAdNotFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, model.Response{Msg: err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.Response{Msg: "Ad deleted", Data: adID.String()})
+}
+
+// ReplaceAd godoc
+// @Summary Replace an ad
+// @Description Replace every field of an active ad, the ad keeps its ID
+// @Tags Ad
+// @Accept json
+// @Produce json
+// @Param id path string true "Ad ID"
+// @Param ad body model.CreateAdRequest true "Ad object"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/ad/{id} [put]
+func (ac *AdController) ReplaceAd(c *gin.Context) {
+	var ad model.CreateAdRequest
+	if err := c.BindJSON(&ad); err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+	ac.updateAd(c, ad.ToUpdateAdRequest())
+}
+
+// UpdateAd godoc
+// @Summary Update an ad
+// @Description Update the given fields of an active ad, omitted fields are left unchanged
+// @Tags Ad
+// @Accept json
+// @Produce json
+// @Param id path string true "Ad ID"
+// @Param ad body model.UpdateAdRequest true "Ad fields"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/ad/{id} [patch]
+func (ac *AdController) UpdateAd(c *gin.Context) {
+	var req model.UpdateAdRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+	ac.updateAd(c, &req)
+}
+
+func (ac *AdController) updateAd(c *gin.Context, req *model.UpdateAdRequest) {
+	adID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	ad, err := ac.adService.UpdateAd(c.Request.Context(), adID.String(), req)
+	switch {
+	case errors.Is(err, service.ErrAdNotFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrInvalidAd):
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrDeleteTaskNotRescheduled):
+		// the update is applied, the ad is returned so the client does not retry it blindly
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error(), Data: ad})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.Response{Msg: "Ad updated", Data: ad})
+}
@@ -12,6 +12,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -62,14 +63,22 @@ func boot() (app *bootstrap.Application, services *bootstrap.Services, mocks *bo
 	adService := service.NewAdService(
 		app.Dispatcher,
 		app.Conn,
-		app.Cache,
+		app.ReplicatedLog,
+		app.Snapshotter,
+		app.Env.Snapshot.Interval,
+		bootstrap.NewRanking(app.Env),
+		app.FrequencyCapper,
+		app.BudgetPacer,
 		app.RedisLock,
 		app.AsynqClient,
+		app.AsynqInspector,
 	)
 	taskService := service.NewTaskService(adService)
+	healthService := service.NewHealthService(app.Conn, app.Cache, adService, app.Env.Server.ReadyMaxLag)
 	services = &bootstrap.Services{
-		AdService:   adService,
-		TaskService: taskService,
+		AdService:     adService,
+		TaskService:   taskService,
+		HealthService: healthService,
 	}
 	mocks.DBMock.ExpectBegin()
 	mocks.DBMock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM ads").
@@ -163,6 +172,69 @@ func TestAdController_GetAd(t *testing.T) {
 			},
 			expectStatus: http.StatusBadRequest,
 		},
+		{
+			name: "Test GetAd BadRequest: invalid cursor",
+			fields: fields{
+				adService: services.AdService,
+			},
+			args: args{
+				c: nil,
+				requestQuery: url.Values{
+					"country": {"TW"},
+					"age":     {"18"},
+					"cursor":  {"not-a-cursor"},
+					"limit":   {"10"},
+				},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Test GetAd with coordinates",
+			fields: fields{
+				adService: services.AdService,
+			},
+			args: args{
+				c: nil,
+				requestQuery: url.Values{
+					"country": {"TW"},
+					"lat":     {"25.033"},
+					"long":    {"121.5654"},
+					"limit":   {"10"},
+				},
+			},
+			expectStatus: http.StatusOK,
+		},
+		{
+			name: "Test GetAd BadRequest: latitude without longitude",
+			fields: fields{
+				adService: services.AdService,
+			},
+			args: args{
+				c: nil,
+				requestQuery: url.Values{
+					"country": {"TW"},
+					"lat":     {"25.033"},
+					"limit":   {"10"},
+				},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Test GetAd BadRequest: invalid latitude",
+			fields: fields{
+				adService: services.AdService,
+			},
+			args: args{
+				c: nil,
+				requestQuery: url.Values{
+					"country": {"TW"},
+					"lat":     {"91"},
+					"long":    {"121.5654"},
+					"limit":   {"10"},
+				},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -247,6 +319,49 @@ func TestAdController_CreateAd(t *testing.T) {
 			},
 			expectStatus: http.StatusBadRequest,
 		},
+		{
+			name: "Test CreateAd invalid targeting",
+			fields: fields{
+				adService: services.AdService,
+			},
+			args: args{
+				c: nil,
+				request: model.CreateAdRequest{
+					Title:     "test invalid targeting",
+					Content:   "test invalid targeting",
+					StartAt:   model.CustomTime(time.Now().Add(-1 * time.Hour * 24)),
+					EndAt:     model.CustomTime(time.Now().Add(1 * time.Hour * 24)),
+					AgeStart:  18,
+					AgeEnd:    65,
+					Targeting: "country IN (TW, JP) AND platform >= ios",
+				},
+				expectVersion: 2,
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Test CreateAd too many tags",
+			fields: fields{
+				adService: services.AdService,
+			},
+			args: args{
+				c: nil,
+				request: model.CreateAdRequest{
+					Title:    "test too many tags",
+					Content:  "test too many tags",
+					StartAt:  model.CustomTime(time.Now().Add(-1 * time.Hour * 24)),
+					EndAt:    model.CustomTime(time.Now().Add(1 * time.Hour * 24)),
+					AgeStart: 18,
+					AgeEnd:   65,
+					Gender:   []string{"F", "M"},
+					Country:  []string{"TW"},
+					Platform: []string{"ios"},
+					Tags:     strings.Split("a,b,c,d,e,f,g,h,i,j,k,l,m,n,o,p,q,r,s,t,u", ","),
+				},
+				expectVersion: 2,
+			},
+			expectStatus: http.StatusBadRequest,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -280,6 +395,17 @@ func TestAdController_CreateAd(t *testing.T) {
 					pq.StringArray(tt.args.request.Gender),
 					pq.StringArray(tt.args.request.Country),
 					pq.StringArray(tt.args.request.Platform),
+					pq.StringArray(tt.args.request.ExcludeGender),
+					pq.StringArray(tt.args.request.ExcludeCountry),
+					pq.StringArray(tt.args.request.ExcludePlatform),
+					pq.StringArray(tt.args.request.Language),
+					pq.StringArray(tt.args.request.Region),
+					tt.args.request.AppVersionMin,
+					tt.args.request.AppVersionMax,
+					tt.args.request.Targeting,
+					tt.args.request.Schedule,
+					tt.args.request.Geo,
+					pq.StringArray(tt.args.request.Tags),
 					1,
 					AnyTime{},
 				).WillReturnResult(sqlmock.NewResult(1, 1))
@@ -308,6 +434,121 @@ func TestAdController_CreateAd(t *testing.T) {
 	}
 }
 
+func TestAdController_UpdateAd(t *testing.T) {
+	title := "new title"
+	tests := []struct {
+		name         string
+		method       string
+		adID         string
+		body         interface{}
+		expectStatus int
+	}{
+		{
+			name:         "Test UpdateAd BadRequest: invalid id",
+			method:       http.MethodPatch,
+			adID:         "not-a-uuid",
+			body:         model.UpdateAdRequest{Title: &title},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "Test UpdateAd BadRequest: invalid enum",
+			method:       http.MethodPatch,
+			adID:         "00000000-0000-0000-0000-000000000001",
+			body:         model.UpdateAdRequest{Platform: []string{"meow"}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Test ReplaceAd BadRequest: missing fields",
+			method: http.MethodPut,
+			adID:   "00000000-0000-0000-0000-000000000001",
+			body: model.UpdateAdRequest{
+				Title: &title,
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestBytes, err := json.Marshal(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(tt.method, "/api/v1/ad/"+tt.adID, bytes.NewBuffer(requestBytes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+			c.Params = gin.Params{{Key: "id", Value: tt.adID}}
+
+			ac := &AdController{
+				adService: services.AdService,
+			}
+			if tt.method == http.MethodPut {
+				ac.ReplaceAd(c)
+			} else {
+				ac.UpdateAd(c)
+			}
+			assert.Equal(t, tt.expectStatus, w.Code)
+		})
+	}
+}
+
+func TestAdController_GetAdByID(t *testing.T) {
+	tests := []struct {
+		name         string
+		adID         string
+		expectStatus int
+	}{
+		{
+			name:         "Test GetAdByID BadRequest: invalid id",
+			adID:         "not-a-uuid",
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "Test GetAdByID NotFound",
+			adID:         "00000000-0000-0000-0000-000000000001",
+			expectStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/api/v1/ad/"+tt.adID, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+			c.Params = gin.Params{{Key: "id", Value: tt.adID}}
+
+			ac := &AdController{
+				adService: services.AdService,
+			}
+			ac.GetAdByID(c)
+			assert.Equal(t, tt.expectStatus, w.Code)
+		})
+	}
+}
+
+func TestAdController_DeleteAd(t *testing.T) {
+	req, err := http.NewRequest(http.MethodDelete, "/api/v1/ad/not-a-uuid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	c.Params = gin.Params{{Key: "id", Value: "not-a-uuid"}}
+
+	ac := &AdController{
+		adService: services.AdService,
+	}
+	ac.DeleteAd(c)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestNewAdController(t *testing.T) {
 	type args struct {
 		adService model.AdService
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/service"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type CampaignController struct {
+	campaignService model.CampaignService
+}
+
+func NewCampaignController(campaignService model.CampaignService) *CampaignController {
+	return &CampaignController{
+		campaignService: campaignService,
+	}
+}
+
+// CreateAdvertiser godoc
+// @Summary Create an advertiser
+// @Description Create an advertiser owned by the caller
+// @Tags Campaign
+// @Accept json
+// @Produce json
+// @Param advertiser body model.CreateAdvertiserRequest true "Advertiser object"
+// @Success 201 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/advertiser [post]
+func (cc *CampaignController) CreateAdvertiser(c *gin.Context) {
+	var req model.CreateAdvertiserRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	advertiser, err := cc.campaignService.CreateAdvertiser(c.Request.Context(), &req)
+	if err != nil {
+		cc.error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.Response{Msg: "Advertiser created", Data: advertiser})
+}
+
+// CreateCampaign godoc
+// @Summary Create a campaign
+// @Description Create an active campaign of an advertiser owned by the caller
+// @Tags Campaign
+// @Accept json
+// @Produce json
+// @Param campaign body model.CreateCampaignRequest true "Campaign object"
+// @Success 201 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/campaign [post]
+func (cc *CampaignController) CreateCampaign(c *gin.Context) {
+	var req model.CreateCampaignRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	campaign, err := cc.campaignService.CreateCampaign(c.Request.Context(), &req)
+	if err != nil {
+		cc.error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.Response{Msg: "Campaign created", Data: campaign})
+}
+
+// GetCampaign godoc
+// @Summary Get a campaign by ID
+// @Description Retrieves a campaign by ID
+// @Tags Campaign
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/campaign/{id} [get]
+func (cc *CampaignController) GetCampaign(c *gin.Context) {
+	campaignID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	campaign, err := cc.campaignService.GetCampaign(c.Request.Context(), campaignID.String())
+	if err != nil {
+		cc.error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, model.Response{Msg: "OK", Data: campaign})
+}
+
+// PauseCampaign godoc
+// @Summary Pause a campaign
+// @Description Stop serving all the ads of the campaign until it is resumed
+// @Tags Campaign
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/campaign/{id}/pause [post]
+func (cc *CampaignController) PauseCampaign(c *gin.Context) {
+	cc.setStatus(c, model.CampaignStatusPaused)
+}
+
+// ResumeCampaign godoc
+// @Summary Resume a campaign
+// @Description Serve the ads of the paused campaign again
+// @Tags Campaign
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/campaign/{id}/resume [post]
+func (cc *CampaignController) ResumeCampaign(c *gin.Context) {
+	cc.setStatus(c, model.CampaignStatusActive)
+}
+
+// EndCampaign godoc
+// @Summary End a campaign
+// @Description Take down all the ads of the campaign, an ended campaign can not be resumed
+// @Tags Campaign
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} model.Response
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/campaign/{id}/end [post]
+func (cc *CampaignController) EndCampaign(c *gin.Context) {
+	cc.setStatus(c, model.CampaignStatusEnded)
+}
+
+func (cc *CampaignController) setStatus(c *gin.Context, status model.CampaignStatus) {
+	campaignID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	campaign, err := cc.campaignService.SetCampaignStatus(c.Request.Context(), campaignID.String(), status)
+	if err != nil {
+		cc.error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, model.Response{Msg: "Campaign updated", Data: campaign})
+}
+
+// error writes the status code of the service error
+func (cc *CampaignController) error(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrCampaignNotFound), errors.Is(err, service.ErrAdvertiserNotFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+	case errors.Is(err, service.ErrInvalidCampaign):
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+	case errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, model.Response{Msg: err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+	}
+}
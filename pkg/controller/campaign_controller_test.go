@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCampaignService struct {
+	model.CampaignService
+	status model.CampaignStatus
+	err    error
+}
+
+func (f *fakeCampaignService) SetCampaignStatus(ctx context.Context, campaignID string, status model.CampaignStatus) (*model.Campaign, error) {
+	f.status = status
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &model.Campaign{ID: uuid.MustParse(campaignID), Status: status}, nil
+}
+
+func TestCampaignController_setStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		handler      func(cc *CampaignController) gin.HandlerFunc
+		campaignID   string
+		err          error
+		expectStatus int
+		wantStatus   model.CampaignStatus
+	}{
+		{
+			name:         "Test PauseCampaign",
+			handler:      func(cc *CampaignController) gin.HandlerFunc { return cc.PauseCampaign },
+			campaignID:   uuid.NewString(),
+			expectStatus: http.StatusOK,
+			wantStatus:   model.CampaignStatusPaused,
+		},
+		{
+			name:         "Test ResumeCampaign",
+			handler:      func(cc *CampaignController) gin.HandlerFunc { return cc.ResumeCampaign },
+			campaignID:   uuid.NewString(),
+			expectStatus: http.StatusOK,
+			wantStatus:   model.CampaignStatusActive,
+		},
+		{
+			name:         "Test EndCampaign ended",
+			handler:      func(cc *CampaignController) gin.HandlerFunc { return cc.EndCampaign },
+			campaignID:   uuid.NewString(),
+			err:          service.ErrInvalidCampaign,
+			expectStatus: http.StatusBadRequest,
+			wantStatus:   model.CampaignStatusEnded,
+		},
+		{
+			name:         "Test PauseCampaign NotFound",
+			handler:      func(cc *CampaignController) gin.HandlerFunc { return cc.PauseCampaign },
+			campaignID:   uuid.NewString(),
+			err:          service.ErrCampaignNotFound,
+			expectStatus: http.StatusNotFound,
+			wantStatus:   model.CampaignStatusPaused,
+		},
+		{
+			name:         "Test PauseCampaign Forbidden",
+			handler:      func(cc *CampaignController) gin.HandlerFunc { return cc.PauseCampaign },
+			campaignID:   uuid.NewString(),
+			err:          service.ErrForbidden,
+			expectStatus: http.StatusForbidden,
+			wantStatus:   model.CampaignStatusPaused,
+		},
+		{
+			name:         "Test PauseCampaign BadRequest: invalid id",
+			handler:      func(cc *CampaignController) gin.HandlerFunc { return cc.PauseCampaign },
+			campaignID:   "invalid",
+			expectStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			campaignService := &fakeCampaignService{err: tt.err}
+			cc := NewCampaignController(campaignService)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/campaign/"+tt.campaignID, nil)
+			c.Params = gin.Params{{Key: "id", Value: tt.campaignID}}
+			tt.handler(cc)(c)
+			assert.Equal(t, tt.expectStatus, w.Code)
+			assert.Equal(t, tt.wantStatus, campaignService.status)
+		})
+	}
+}
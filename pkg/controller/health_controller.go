@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthCheckTimeout bounds the pings of the dependencies, so a hanging dependency fails the probe instead of blocking it
+const healthCheckTimeout = 2 * time.Second
+
+type HealthController struct {
+	healthService model.HealthService
+}
+
+func NewHealthController(healthService model.HealthService) *HealthController {
+	return &HealthController{
+		healthService: healthService,
+	}
+}
+
+// Healthz godoc
+// @Summary Liveness probe
+// @Description Returns 200 as long as the process is able to serve
+// @Tags Health
+// @Produce json
+// @Success 200 {object} model.Response
+// @Failure 503 {object} model.Response
+// @Router /healthz [get]
+func (hc *HealthController) Healthz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c, healthCheckTimeout)
+	defer cancel()
+	if err := hc.healthService.Live(ctx); err != nil {
+		c.JSON(http.StatusServiceUnavailable, model.Response{Msg: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{Msg: "ok"})
+}
+
+// Readyz godoc
+// @Summary Readiness probe
+// @Description Returns 200 once the in-memory store is restored and caught up with the replicated log, and Redis and Postgres are reachable
+// @Tags Health
+// @Produce json
+// @Success 200 {object} model.Response
+// @Failure 503 {object} model.Response
+// @Router /readyz [get]
+func (hc *HealthController) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c, healthCheckTimeout)
+	defer cancel()
+	if err := hc.healthService.Ready(ctx); err != nil {
+		c.JSON(http.StatusServiceUnavailable, model.Response{Msg: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{Msg: "ok"})
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHealthService struct {
+	liveErr  error
+	readyErr error
+}
+
+func (f *fakeHealthService) Live(ctx context.Context) error {
+	return f.liveErr
+}
+
+func (f *fakeHealthService) Ready(ctx context.Context) error {
+	return f.readyErr
+}
+
+var _ model.HealthService = (*fakeHealthService)(nil)
+
+func TestHealthController_Healthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	hc := NewHealthController(&fakeHealthService{readyErr: service.ErrNotRestored})
+	hc.Healthz(c)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealthController_Readyz(t *testing.T) {
+	tests := []struct {
+		name         string
+		readyErr     error
+		expectStatus int
+	}{
+		{
+			name:         "Test Readyz",
+			readyErr:     nil,
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "Test Readyz not restored",
+			readyErr:     service.ErrNotRestored,
+			expectStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "Test Readyz lagging",
+			readyErr:     service.ErrReplicaLagging,
+			expectStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "Test Readyz redis unreachable",
+			readyErr:     service.ErrRedisUnreachable,
+			expectStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			hc := NewHealthController(&fakeHealthService{readyErr: tt.readyErr})
+			hc.Readyz(c)
+			assert.Equal(t, tt.expectStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"dcard-backend-2024/pkg/inmem"
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/service"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type TrackingController struct {
+	trackingService model.TrackingService
+}
+
+func NewTrackingController(trackingService model.TrackingService) *TrackingController {
+	return &TrackingController{
+		trackingService: trackingService,
+	}
+}
+
+// Impression godoc
+// @Summary Track an impression
+// @Description The impression beacon of a served ad
+// @Tags Tracking
+// @Param id path string true "Ad ID"
+// @Success 204
+// @Failure 400 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Router /api/v1/ad/{id}/impression [get]
+func (tc *TrackingController) Impression(c *gin.Context) {
+	adID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	err = tc.trackingService.TrackImpression(c, adID.String())
+	switch {
+	case errors.Is(err, inmem.ErrNoAdsFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusNoContent)
+}
+
+// Click godoc
+// @Summary Track a click
+// @Description Track the click of a served ad and redirect to its landing URL
+// @Tags Tracking
+// @Param id path string true "Ad ID"
+// @Success 302
+// @Success 204 "The ad has no landing URL"
+// @Failure 400 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Router /api/v1/ad/{id}/click [get]
+func (tc *TrackingController) Click(c *gin.Context) {
+	adID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	landingURL, err := tc.trackingService.TrackClick(c, adID.String())
+	switch {
+	case errors.Is(err, inmem.ErrNoAdsFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if landingURL == "" {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.Redirect(http.StatusFound, landingURL)
+}
+
+// GetAdStats godoc
+// @Summary Get the stats of an ad
+// @Description Impressions, clicks and CTR of an ad per hour over a time range, the events are aggregated with a delay of a few seconds
+// @Tags Tracking
+// @Produce json
+// @Param id path string true "Ad ID"
+// @Param from query string false "Start of the range in RFC 3339, truncated to the hour, defaults to 24 hours before to"
+// @Param to query string false "End of the range in RFC 3339, exclusive, defaults to now"
+// @Success 200 {object} model.AdStats
+// @Failure 400 {object} model.Response
+// @Failure 401 {object} model.Response
+// @Failure 403 {object} model.Response
+// @Failure 404 {object} model.Response
+// @Failure 500 {object} model.Response
+// @Security ApiKeyAuth
+// @Router /api/v1/ad/{id}/stats [get]
+func (tc *TrackingController) GetAdStats(c *gin.Context) {
+	adID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+	var req model.GetAdStatsRequest
+	if err := c.BindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	}
+
+	stats, err := tc.trackingService.GetAdStats(c.Request.Context(), adID.String(), &req)
+	switch {
+	case errors.Is(err, service.ErrInvalidStatsRange):
+		c.JSON(http.StatusBadRequest, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrAdNotFound):
+		c.JSON(http.StatusNotFound, model.Response{Msg: err.Error()})
+		return
+	case errors.Is(err, service.ErrForbidden):
+		c.JSON(http.StatusForbidden, model.Response{Msg: err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, model.Response{Msg: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/inmem"
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTrackingService struct {
+	model.TrackingService
+	landingURL string
+	err        error
+}
+
+func (f *fakeTrackingService) TrackImpression(ctx context.Context, adID string) error {
+	return f.err
+}
+
+func (f *fakeTrackingService) TrackClick(ctx context.Context, adID string) (string, error) {
+	return f.landingURL, f.err
+}
+
+func (f *fakeTrackingService) GetAdStats(ctx context.Context, adID string, req *model.GetAdStatsRequest) (*model.AdStats, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &model.AdStats{AdID: adID}, nil
+}
+
+func TestTrackingController(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        func(tc *TrackingController) gin.HandlerFunc
+		adID           string
+		query          string
+		landingURL     string
+		err            error
+		expectStatus   int
+		expectLocation string
+	}{
+		{
+			name:         "Test Impression",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.Impression },
+			adID:         uuid.NewString(),
+			expectStatus: http.StatusNoContent,
+		},
+		{
+			name:         "Test Impression NotFound",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.Impression },
+			adID:         uuid.NewString(),
+			err:          inmem.ErrNoAdsFound,
+			expectStatus: http.StatusNotFound,
+		},
+		{
+			name:         "Test Impression BadRequest: invalid id",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.Impression },
+			adID:         "invalid",
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Test Click redirect",
+			handler:        func(tc *TrackingController) gin.HandlerFunc { return tc.Click },
+			adID:           uuid.NewString(),
+			landingURL:     "https://example.com/landing",
+			expectStatus:   http.StatusFound,
+			expectLocation: "https://example.com/landing",
+		},
+		{
+			name:         "Test Click without landing URL",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.Click },
+			adID:         uuid.NewString(),
+			expectStatus: http.StatusNoContent,
+		},
+		{
+			name:         "Test GetAdStats",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.GetAdStats },
+			adID:         uuid.NewString(),
+			query:        "?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z",
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "Test GetAdStats BadRequest: invalid time",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.GetAdStats },
+			adID:         uuid.NewString(),
+			query:        "?from=yesterday",
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "Test GetAdStats BadRequest: invalid range",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.GetAdStats },
+			adID:         uuid.NewString(),
+			err:          service.ErrInvalidStatsRange,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "Test GetAdStats Forbidden",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.GetAdStats },
+			adID:         uuid.NewString(),
+			err:          service.ErrForbidden,
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "Test GetAdStats NotFound",
+			handler:      func(tc *TrackingController) gin.HandlerFunc { return tc.GetAdStats },
+			adID:         uuid.NewString(),
+			err:          service.ErrAdNotFound,
+			expectStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := NewTrackingController(&fakeTrackingService{landingURL: tt.landingURL, err: tt.err})
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/ad/"+tt.adID+tt.query, nil)
+			c.Params = gin.Params{{Key: "id", Value: tt.adID}}
+			tt.handler(tc)(c)
+			// the engine writes the status of the responses without body after the handlers
+			c.Writer.WriteHeaderNow()
+			assert.Equal(t, tt.expectStatus, w.Code)
+			assert.Equal(t, tt.expectLocation, w.Header().Get("Location"))
+		})
+	}
+}
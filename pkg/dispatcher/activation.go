@@ -0,0 +1,162 @@
+package dispatcher
+
+import (
+	"container/heap"
+	"dcard-backend-2024/pkg/model"
+	"time"
+)
+
+// activation is an ad waiting for its StartAt
+type activation struct {
+	ad    *model.Ad
+	index int
+}
+
+// activationQueue is a min-heap of the activations keyed by StartAt, it implements heap.Interface
+type activationQueue []*activation
+
+func (q activationQueue) Len() int { return len(q) }
+
+func (q activationQueue) Less(i, j int) bool {
+	return q[i].ad.StartAt.T().Before(q[j].ad.StartAt.T())
+}
+
+func (q activationQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *activationQueue) Push(x any) {
+	a := x.(*activation)
+	a.index = len(*q)
+	*q = append(*q, a)
+}
+
+func (q *activationQueue) Pop() any {
+	old := *q
+	n := len(old)
+	a := old[n-1]
+	old[n-1] = nil
+	a.index = -1
+	*q = old[:n-1]
+	return a
+}
+
+// activationScheduler keeps the ads that start in the future.
+// It is not safe for concurrent use, it is only accessed by the dispatcher loop.
+type activationScheduler struct {
+	queue activationQueue
+	// pending maps ad IDs to their activations, so the activation can be cancelled by delete or update
+	pending map[string]*activation
+	timer   *time.Timer
+	// timerAt is the StartAt the timer is set to, it is zero if the timer is not set
+	timerAt time.Time
+}
+
+func newActivationScheduler() *activationScheduler {
+	return &activationScheduler{
+		pending: make(map[string]*activation),
+	}
+}
+
+// Schedule adds the ad to the scheduler, it replaces the pending activation of the same ad
+func (s *activationScheduler) Schedule(ad *model.Ad) {
+	if a, ok := s.pending[ad.ID.String()]; ok {
+		a.ad = ad
+		heap.Fix(&s.queue, a.index)
+		return
+	}
+	a := &activation{ad: ad}
+	heap.Push(&s.queue, a)
+	s.pending[ad.ID.String()] = a
+}
+
+// Cancel removes the pending activation of the ad, if any
+func (s *activationScheduler) Cancel(adID string) {
+	a, ok := s.pending[adID]
+	if !ok {
+		return
+	}
+	heap.Remove(&s.queue, a.index)
+	delete(s.pending, adID)
+}
+
+// Get returns the pending ad with the given ID
+func (s *activationScheduler) Get(adID string) (*model.Ad, bool) {
+	a, ok := s.pending[adID]
+	if !ok {
+		return nil, false
+	}
+	return a.ad, true
+}
+
+// Reset removes all the pending activations
+func (s *activationScheduler) Reset() {
+	s.queue = nil
+	s.pending = make(map[string]*activation)
+}
+
+// PopDue removes and returns the ads whose StartAt is not after now, in the order of StartAt
+func (s *activationScheduler) PopDue(now time.Time) []*model.Ad {
+	var ads []*model.Ad
+	for len(s.queue) > 0 && !s.queue[0].ad.StartAt.T().After(now) {
+		a := heap.Pop(&s.queue).(*activation)
+		delete(s.pending, a.ad.ID.String())
+		ads = append(ads, a.ad)
+	}
+	return ads
+}
+
+// Ads returns the pending ads
+func (s *activationScheduler) Ads() []*model.Ad {
+	ads := make([]*model.Ad, 0, len(s.queue))
+	for _, a := range s.queue {
+		ads = append(ads, a.ad)
+	}
+	return ads
+}
+
+func (s *activationScheduler) Len() int {
+	return len(s.queue)
+}
+
+// C returns the channel fired at the earliest StartAt, or nil if there is no pending activation.
+// The timer is only reset when the earliest StartAt changes.
+func (s *activationScheduler) C() <-chan time.Time {
+	if len(s.queue) == 0 {
+		s.stopTimer()
+		return nil
+	}
+	next := s.queue[0].ad.StartAt.T()
+	if s.timer != nil && s.timerAt.Equal(next) {
+		return s.timer.C
+	}
+	s.stopTimer()
+	if s.timer == nil {
+		s.timer = time.NewTimer(time.Until(next))
+	} else {
+		s.timer.Reset(time.Until(next))
+	}
+	s.timerAt = next
+	return s.timer.C
+}
+
+// Fired marks the timer as consumed, it must be called after receiving from C
+func (s *activationScheduler) Fired() {
+	s.timerAt = time.Time{}
+}
+
+func (s *activationScheduler) stopTimer() {
+	if s.timer == nil || s.timerAt.IsZero() {
+		return
+	}
+	if !s.timer.Stop() {
+		// drain the fired but not received value, so the next receive does not get a stale tick
+		select {
+		case <-s.timer.C:
+		default:
+		}
+	}
+	s.timerAt = time.Time{}
+}
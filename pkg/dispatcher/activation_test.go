@@ -0,0 +1,93 @@
+package dispatcher
+
+import (
+	"dcard-backend-2024/pkg/inmem"
+	"dcard-backend-2024/pkg/model"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newScheduledAd(startAt time.Time) *model.Ad {
+	return &model.Ad{
+		ID:       uuid.New(),
+		Title:    "test",
+		Content:  "test",
+		StartAt:  model.CustomTime(startAt),
+		EndAt:    model.CustomTime(startAt.Add(1 * time.Hour * 24)),
+		AgeStart: 18,
+		AgeEnd:   65,
+		Gender:   []string{"F", "M"},
+		Country:  []string{"TW"},
+		Platform: []string{"ios"},
+	}
+}
+
+func TestActivationScheduler(t *testing.T) {
+	now := time.Now()
+	s := newActivationScheduler()
+	ads := []*model.Ad{
+		newScheduledAd(now.Add(3 * time.Hour)),
+		newScheduledAd(now.Add(1 * time.Hour)),
+		newScheduledAd(now.Add(2 * time.Hour)),
+		newScheduledAd(now.Add(4 * time.Hour)),
+	}
+	for _, ad := range ads {
+		s.Schedule(ad)
+	}
+	assert.Equal(t, 4, s.Len())
+
+	// reschedule the first ad before the others
+	moved := *ads[0]
+	moved.StartAt = model.CustomTime(now.Add(30 * time.Minute))
+	s.Schedule(&moved)
+	assert.Equal(t, 4, s.Len())
+
+	s.Cancel(ads[2].ID.String())
+	s.Cancel(uuid.NewString())
+	assert.Equal(t, 3, s.Len())
+
+	assert.Empty(t, s.PopDue(now))
+	assert.Equal(t, []*model.Ad{&moved, ads[1]}, s.PopDue(now.Add(90*time.Minute)))
+	assert.Equal(t, []*model.Ad{ads[3]}, s.Ads())
+
+	s.Reset()
+	assert.Equal(t, 0, s.Len())
+	assert.Nil(t, s.C())
+}
+
+func TestDispatcher_activation(t *testing.T) {
+	store := inmem.NewInMemoryStore()
+	r := NewDispatcher(store)
+	go r.Start()
+
+	started := newScheduledAd(time.Now().Add(50 * time.Millisecond))
+	deleted := newScheduledAd(time.Now().Add(50 * time.Millisecond))
+	rescheduled := newScheduledAd(time.Now().Add(50 * time.Millisecond))
+	for _, ad := range []*model.Ad{started, deleted, rescheduled} {
+		r.RequestChan <- &CreateAdRequest{Ad: ad}
+	}
+	r.RequestChan <- &DeleteAdRequest{AdID: deleted.ID.String()}
+	later := *rescheduled
+	later.StartAt = model.CustomTime(time.Now().Add(1 * time.Hour))
+	r.RequestChan <- &UpdateAdRequest{Ad: &later}
+	// a request round trip makes sure the previous requests are handled
+	r.RequestChan <- &SnapshotRequest{}
+	assert.Equal(t, int64(2), r.PendingActivations())
+
+	assert.Eventually(t, func() bool {
+		_, err := store.GetAdByID(started.ID.String())
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return r.PendingActivations() == 1
+	}, 3*time.Second, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := store.GetAdByID(deleted.ID.String())
+	assert.ErrorIs(t, err, inmem.ErrNoAdsFound)
+	_, err = store.GetAdByID(rescheduled.ID.String())
+	assert.ErrorIs(t, err, inmem.ErrNoAdsFound)
+}
@@ -1,9 +1,11 @@
 package dispatcher
 
 import (
+	"dcard-backend-2024/pkg/metrics"
 	"dcard-backend-2024/pkg/model"
 	"dcard-backend-2024/pkg/syncmap"
 	"log"
+	"reflect"
 	"sync/atomic"
 	"time"
 )
@@ -13,40 +15,66 @@ type Dispatcher struct {
 	RequestChan  chan interface{}
 	ResponseChan *syncmap.Map
 	Store        model.InMemoryStore
+	// activations holds the ads waiting for their StartAt, it is only accessed by the dispatcher loop
+	activations *activationScheduler
+	// pendingActivations is the number of the pending activations, it is read by the metrics
+	pendingActivations atomic.Int64
+	// paused holds the ads of the paused campaigns by ad ID, it is only accessed by the dispatcher loop
+	paused map[string]*model.Ad
 }
 
 func (r *Dispatcher) IsRunning() bool {
 	return r.Running.Load()
 }
 
+// PendingActivations returns the number of the ads waiting for their StartAt
+func (r *Dispatcher) PendingActivations() int64 {
+	return r.pendingActivations.Load()
+}
+
+// Send sends the request to the dispatcher loop, and records how long it waits to be received
+func (r *Dispatcher) Send(req interface{}) {
+	start := time.Now()
+	r.RequestChan <- req
+	metrics.DispatcherQueueWait.
+		WithLabelValues(reflect.TypeOf(req).Elem().Name()).
+		Observe(time.Since(start).Seconds())
+}
+
+func (r *Dispatcher) setPendingActivations() {
+	n := int64(r.scheduler().Len())
+	r.pendingActivations.Store(n)
+	metrics.DispatcherPendingActivations.Set(float64(n))
+}
+
 func NewDispatcher(store model.InMemoryStore) *Dispatcher {
 	return &Dispatcher{
 		RequestChan:  make(chan interface{}),
 		ResponseChan: &syncmap.Map{},
 		Store:        store,
+		activations:  newActivationScheduler(),
+		paused:       make(map[string]*model.Ad),
 	}
 }
 
+// handleCreateBatchAdRequest restores the ads, the pending activations are rebuilt from the batch
 func (r *Dispatcher) handleCreateBatchAdRequest(req *CreateBatchAdRequest) {
 	// err := r.Store.CreateBatchAds(req.Ads)
+	r.scheduler().Reset()
+	r.paused = make(map[string]*model.Ad)
 	for _, ad := range req.Ads {
-		if time.Now().After(ad.StartAt.T()) {
+		if ad.CampaignPaused {
+			_ = r.holdAd(ad)
+		} else if time.Now().After(ad.StartAt.T()) {
 			_, err := r.Store.CreateAd(ad)
 			if err != nil {
 				log.Printf("failed to create ad %s: %v", ad.ID, err)
 			}
 		} else {
-			log.Printf("ad %s is scheduled to start at %s", ad.ID, ad.StartAt.T())
-			time.AfterFunc(time.Until(ad.StartAt.T()), func() {
-				_, err := r.Store.CreateAd(ad)
-				if err != nil {
-					log.Printf("failed to create ad %s: %v", ad.ID, err)
-				} else {
-					log.Printf("scheduled ad %s is created", ad.ID)
-				}
-			})
+			r.scheduleAd(ad)
 		}
 	}
+	r.setPendingActivations()
 
 	// use sync map to store the response channel
 	if r.ResponseChan.Exists(req.RequestID) {
@@ -58,21 +86,15 @@ func (r *Dispatcher) handleCreateBatchAdRequest(req *CreateBatchAdRequest) {
 }
 
 func (r *Dispatcher) handleCreateAdRequest(req *CreateAdRequest) {
-	if time.Now().After(req.Ad.StartAt.T()) {
+	if req.Ad.CampaignPaused {
+		_ = r.holdAd(req.Ad)
+	} else if time.Now().After(req.Ad.StartAt.T()) {
 		_, err := r.Store.CreateAd(req.Ad)
 		if err != nil {
 			log.Printf("failed to create ad %s: %v", req.Ad.ID, err)
 		}
 	} else {
-		log.Printf("ad %s is scheduled to start at %s", req.Ad.ID, req.Ad.StartAt.T())
-		time.AfterFunc(time.Until(req.Ad.StartAt.T()), func() {
-			_, err := r.Store.CreateAd(req.Ad)
-			if err != nil {
-				log.Printf("failed to create ad %s: %v", req.Ad.ID, err)
-			} else {
-				log.Printf("scheduled ad %s is created", req.Ad.ID)
-			}
-		})
+		r.scheduleAd(req.Ad)
 	}
 
 	if r.ResponseChan.Exists(req.RequestID) {
@@ -84,6 +106,21 @@ func (r *Dispatcher) handleCreateAdRequest(req *CreateAdRequest) {
 	}
 }
 
+func (r *Dispatcher) handleUpdateAdRequest(req *UpdateAdRequest) {
+	err := r.placeAd(req.Ad)
+	if err != nil {
+		log.Printf("failed to update ad %s: %v", req.Ad.ID, err)
+	}
+
+	if r.ResponseChan.Exists(req.RequestID) {
+		r.ResponseChan.Load(req.RequestID) <- &UpdateAdResponse{
+			Response: Response{RequestID: req.RequestID},
+			AdID:     req.Ad.ID.String(),
+			Err:      err,
+		}
+	}
+}
+
 func (r *Dispatcher) handleGetAdRequest(req *GetAdRequest) {
 	ads, total, err := r.Store.GetAds(req.GetAdRequest)
 
@@ -97,7 +134,22 @@ func (r *Dispatcher) handleGetAdRequest(req *GetAdRequest) {
 	}
 }
 
+// handleGetAdByIDRequest looks up the ad served now, the scheduled ads and the paused ads are not in the store
+func (r *Dispatcher) handleGetAdByIDRequest(req *GetAdByIDRequest) {
+	ad, err := r.Store.GetAdByID(req.AdID)
+
+	if r.ResponseChan.Exists(req.RequestID) {
+		r.ResponseChan.Load(req.RequestID) <- &GetAdByIDResponse{
+			Response: Response{RequestID: req.RequestID},
+			Ad:       ad,
+			Err:      err,
+		}
+	}
+}
+
 func (r *Dispatcher) handleDeleteAdRequest(req *DeleteAdRequest) {
+	r.unscheduleAd(req.AdID)
+	delete(r.pausedAds(), req.AdID)
 	_ = r.Store.DeleteAd(req.AdID)
 
 	// if r.ResponseChan.Exists(req.RequestID) {
@@ -108,6 +160,131 @@ func (r *Dispatcher) handleDeleteAdRequest(req *DeleteAdRequest) {
 	// }
 }
 
+// handleCampaignRequest applies the status of the campaign to its ads.
+// The paused ads are held out of the store, the resumed ads are served or scheduled again, and the ended ads are deleted.
+func (r *Dispatcher) handleCampaignRequest(req *CampaignRequest) {
+	for _, adID := range req.AdIDs {
+		if req.Status == model.CampaignStatusEnded {
+			r.unscheduleAd(adID)
+			delete(r.pausedAds(), adID)
+			_ = r.Store.DeleteAd(adID)
+			continue
+		}
+		ad, ok := r.lookupAd(adID)
+		if !ok {
+			log.Printf("ad %s of campaign %s is not found", adID, req.CampaignID)
+			continue
+		}
+		// the ad may be read by the concurrent queries, the cascaded fields are set on a copy
+		updated := *ad
+		updated.CampaignPaused = req.Status == model.CampaignStatusPaused
+		updated.Version = req.Version
+		if err := r.placeAd(&updated); err != nil {
+			log.Printf("failed to update ad %s of campaign %s: %v", adID, req.CampaignID, err)
+		}
+	}
+
+	if r.ResponseChan.Exists(req.RequestID) {
+		r.ResponseChan.Load(req.RequestID) <- &CampaignResponse{
+			Response: Response{RequestID: req.RequestID},
+		}
+	}
+}
+
+// handleSnapshotRequest collects the served, the scheduled and the paused ads.
+// It runs in the dispatcher loop, so every request sent before it is already applied.
+func (r *Dispatcher) handleSnapshotRequest(req *SnapshotRequest) {
+	ads := append(r.Store.ListAds(), r.scheduler().Ads()...)
+	for _, ad := range r.pausedAds() {
+		ads = append(ads, ad)
+	}
+
+	if r.ResponseChan.Exists(req.RequestID) {
+		r.ResponseChan.Load(req.RequestID) <- &SnapshotResponse{
+			Response: Response{RequestID: req.RequestID},
+			Ads:      ads,
+		}
+	}
+}
+
+// placeAd serves, schedules or holds the ad according to its StartAt and its campaign,
+// it replaces the previous placement of the same ad
+func (r *Dispatcher) placeAd(ad *model.Ad) error {
+	if ad.CampaignPaused {
+		return r.holdAd(ad)
+	}
+	delete(r.pausedAds(), ad.ID.String())
+	if time.Now().After(ad.StartAt.T()) {
+		r.unscheduleAd(ad.ID.String())
+		return r.Store.UpdateAd(ad)
+	}
+	// the ad is moved to the future, stop serving it until it starts
+	err := r.Store.DeleteAd(ad.ID.String())
+	r.scheduleAd(ad)
+	return err
+}
+
+// holdAd keeps the ad of a paused campaign out of the store and the scheduler until the campaign is resumed
+func (r *Dispatcher) holdAd(ad *model.Ad) error {
+	r.unscheduleAd(ad.ID.String())
+	r.pausedAds()[ad.ID.String()] = ad
+	return r.Store.DeleteAd(ad.ID.String())
+}
+
+// lookupAd finds the ad in the paused ads, the scheduled ads and the store,
+// the expired ads waiting for their delete task are not found in the store
+func (r *Dispatcher) lookupAd(adID string) (*model.Ad, bool) {
+	if ad, ok := r.pausedAds()[adID]; ok {
+		return ad, true
+	}
+	if ad, ok := r.scheduler().Get(adID); ok {
+		return ad, true
+	}
+	ad, err := r.Store.GetAdByID(adID)
+	return ad, err == nil
+}
+
+// scheduleAd creates the ad in the store at its StartAt.
+// A later schedule, update or delete of the same ad supersedes the pending one.
+func (r *Dispatcher) scheduleAd(ad *model.Ad) {
+	log.Printf("ad %s is scheduled to start at %s", ad.ID, ad.StartAt.T())
+	r.scheduler().Schedule(ad)
+	r.setPendingActivations()
+}
+
+// unscheduleAd cancels the pending activation of the ad, if any
+func (r *Dispatcher) unscheduleAd(adID string) {
+	r.scheduler().Cancel(adID)
+	r.setPendingActivations()
+}
+
+// activateDueAds creates the scheduled ads whose StartAt has come
+func (r *Dispatcher) activateDueAds(now time.Time) {
+	for _, ad := range r.scheduler().PopDue(now) {
+		_, err := r.Store.CreateAd(ad)
+		if err != nil {
+			log.Printf("failed to create ad %s: %v", ad.ID, err)
+		} else {
+			log.Printf("scheduled ad %s is created", ad.ID)
+		}
+	}
+	r.setPendingActivations()
+}
+
+func (r *Dispatcher) pausedAds() map[string]*model.Ad {
+	if r.paused == nil {
+		r.paused = make(map[string]*model.Ad)
+	}
+	return r.paused
+}
+
+func (r *Dispatcher) scheduler() *activationScheduler {
+	if r.activations == nil {
+		r.activations = newActivationScheduler()
+	}
+	return r.activations
+}
+
 func (r *Dispatcher) Start() {
 	r.Running.Store(true)
 	log.Println("Dispatcher started")
@@ -120,11 +297,24 @@ func (r *Dispatcher) Start() {
 			case *CreateAdRequest:
 				// the create ad request is from the redis stream
 				r.handleCreateAdRequest(req.(*CreateAdRequest))
+			case *UpdateAdRequest:
+				// the update ad request is from the redis stream
+				r.handleUpdateAdRequest(req.(*UpdateAdRequest))
 			case *GetAdRequest:
 				go r.handleGetAdRequest(req.(*GetAdRequest))
+			case *GetAdByIDRequest:
+				go r.handleGetAdByIDRequest(req.(*GetAdByIDRequest))
 			case *DeleteAdRequest:
 				r.handleDeleteAdRequest(req.(*DeleteAdRequest))
+			case *SnapshotRequest:
+				r.handleSnapshotRequest(req.(*SnapshotRequest))
+			case *CampaignRequest:
+				// the campaign request is from the redis stream
+				r.handleCampaignRequest(req.(*CampaignRequest))
 			}
+		case <-r.scheduler().C():
+			r.scheduler().Fired()
+			r.activateDueAds(time.Now())
 		}
 	}
 }
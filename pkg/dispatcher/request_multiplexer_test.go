@@ -184,6 +184,93 @@ func TestDispatcher_handleCreateAdRequest(t *testing.T) {
 	}
 }
 
+func TestDispatcher_handleUpdateAdRequest(t *testing.T) {
+	ad := &model.Ad{
+		ID:       uuid.New(),
+		Title:    "test",
+		Content:  "test",
+		StartAt:  model.CustomTime(time.Now().Add(-1 * time.Hour * 24)),
+		EndAt:    model.CustomTime(time.Now().Add(1 * time.Hour * 24)),
+		AgeStart: 18,
+		AgeEnd:   65,
+		Gender:   []string{"F", "M"},
+		Country:  []string{"TW"},
+		Platform: []string{"ios"},
+		Version:  1,
+	}
+	store := inmem.NewInMemoryStore()
+	_, err := store.CreateAd(ad)
+	assert.Nil(t, err)
+
+	updated := *ad
+	updated.Country = []string{"JP"}
+	updated.Version = 2
+
+	r := &Dispatcher{
+		RequestChan:  make(chan interface{}),
+		ResponseChan: &syncmap.Map{},
+		Store:        store,
+	}
+	req := &UpdateAdRequest{
+		Request: Request{RequestID: "test"},
+		Ad:      &updated,
+	}
+	r.ResponseChan.Store(req.RequestID, make(chan interface{}))
+	go r.handleUpdateAdRequest(req)
+	select {
+	case resp := <-r.ResponseChan.Load(req.RequestID):
+		if resp, ok := resp.(*UpdateAdResponse); ok {
+			assert.Nil(t, resp.Err)
+			assert.Equal(t, ad.ID.String(), resp.AdID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Dispatcher.handleUpdateAdRequest() = %v, want %v", nil, nil)
+	}
+
+	ads, total, err := store.GetAds(&model.GetAdRequest{Age: 20, Country: "JP", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 2, ads[0].Version)
+	_, total, err = store.GetAds(&model.GetAdRequest{Age: 20, Country: "TW", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, total)
+}
+
+func TestDispatcher_handleSnapshotRequest(t *testing.T) {
+	newAd := func(startAt time.Time) *model.Ad {
+		return &model.Ad{
+			ID:       uuid.New(),
+			Title:    "test",
+			Content:  "test",
+			StartAt:  model.CustomTime(startAt),
+			EndAt:    model.CustomTime(startAt.Add(2 * time.Hour * 24)),
+			AgeStart: 18,
+			AgeEnd:   65,
+			Gender:   []string{"F", "M"},
+			Country:  []string{"TW"},
+			Platform: []string{"ios"},
+		}
+	}
+	served := newAd(time.Now().Add(-1 * time.Hour * 24))
+	scheduled := newAd(time.Now().Add(1 * time.Hour * 24))
+	deleted := newAd(time.Now().Add(1 * time.Hour * 24))
+	r := &Dispatcher{
+		RequestChan:  make(chan interface{}),
+		ResponseChan: &syncmap.Map{},
+		Store:        inmem.NewInMemoryStore(),
+	}
+	r.handleCreateBatchAdRequest(&CreateBatchAdRequest{Ads: []*model.Ad{served, scheduled, deleted}})
+	r.handleDeleteAdRequest(&DeleteAdRequest{AdID: deleted.ID.String()})
+
+	req := &SnapshotRequest{Request: Request{RequestID: "test"}}
+	r.ResponseChan.Store(req.RequestID, make(chan interface{}, 1))
+	r.handleSnapshotRequest(req)
+	resp, ok := (<-r.ResponseChan.Load(req.RequestID)).(*SnapshotResponse)
+	assert.True(t, ok)
+	assert.Nil(t, resp.Err)
+	assert.ElementsMatch(t, []*model.Ad{served, scheduled}, resp.Ads)
+}
+
 func TestDispatcher_handleGetAdRequest(t *testing.T) {
 	type fields struct {
 		RequestChan  chan interface{}
@@ -241,6 +328,65 @@ func TestDispatcher_handleGetAdRequest(t *testing.T) {
 	}
 }
 
+func TestDispatcher_handleGetAdByIDRequest(t *testing.T) {
+	now := time.Now()
+	newAd := func(startAt, endAt time.Time) *model.Ad {
+		return &model.Ad{
+			ID:       uuid.New(),
+			Title:    "test",
+			StartAt:  model.CustomTime(startAt),
+			EndAt:    model.CustomTime(endAt),
+			AgeStart: 18,
+			AgeEnd:   65,
+			Country:  []string{"TW"},
+		}
+	}
+	tests := []struct {
+		name      string
+		ad        *model.Ad
+		expectErr error
+	}{
+		{
+			name: "Test handleGetAdByIDRequest",
+			ad:   newAd(now.Add(-time.Hour), now.Add(time.Hour)),
+		},
+		{
+			name:      "Test handleGetAdByIDRequest expired",
+			ad:        newAd(now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			expectErr: inmem.ErrNoAdsFound,
+		},
+		{
+			name:      "Test handleGetAdByIDRequest not started",
+			ad:        newAd(now.Add(time.Hour), now.Add(2*time.Hour)),
+			expectErr: inmem.ErrNoAdsFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewDispatcher(inmem.NewInMemoryStore())
+			// the ads are put in the store directly, as if their delete task or their activation is pending
+			_, err := r.Store.CreateAd(tt.ad)
+			assert.Nil(t, err)
+			req := &GetAdByIDRequest{Request: Request{RequestID: "test"}, AdID: tt.ad.ID.String()}
+			r.ResponseChan.Store(req.RequestID, make(chan interface{}))
+			go r.handleGetAdByIDRequest(req)
+			select {
+			case v := <-r.ResponseChan.Load(req.RequestID):
+				resp, ok := v.(*GetAdByIDResponse)
+				assert.True(t, ok)
+				assert.ErrorIs(t, resp.Err, tt.expectErr)
+				if tt.expectErr == nil {
+					assert.Equal(t, tt.ad, resp.Ad)
+				} else {
+					assert.Nil(t, resp.Ad)
+				}
+			case <-time.After(3 * time.Second):
+				t.Errorf("Dispatcher.handleGetAdByIDRequest() timed out")
+			}
+		})
+	}
+}
+
 func TestDispatcher_Start(t *testing.T) {
 	type fields struct {
 	}
@@ -364,3 +510,73 @@ func TestNewDispatcher(t *testing.T) {
 		})
 	}
 }
+
+func TestDispatcher_handleCampaignRequest(t *testing.T) {
+	store := inmem.NewInMemoryStore()
+	r := NewDispatcher(store)
+	go r.Start()
+
+	campaignID := uuid.New()
+	served := newScheduledAd(time.Now().Add(-1 * time.Hour))
+	served.CampaignID = &campaignID
+	scheduled := newScheduledAd(time.Now().Add(1 * time.Hour))
+	scheduled.CampaignID = &campaignID
+	other := newScheduledAd(time.Now().Add(-1 * time.Hour))
+	for _, ad := range []*model.Ad{served, scheduled, other} {
+		r.RequestChan <- &CreateAdRequest{Ad: ad}
+	}
+	adIDs := []string{served.ID.String(), scheduled.ID.String()}
+	snapshot := func() []*model.Ad {
+		r.ResponseChan.Store("snapshot", make(chan interface{}, 1))
+		defer r.ResponseChan.Delete("snapshot")
+		r.RequestChan <- &SnapshotRequest{Request: Request{RequestID: "snapshot"}}
+		return (<-r.ResponseChan.Load("snapshot")).(*SnapshotResponse).Ads
+	}
+	isServed := func() bool {
+		_, err := store.GetAdByID(served.ID.String())
+		return err == nil
+	}
+
+	// pause holds the ads of the campaign out of the store and the scheduler
+	r.RequestChan <- &CampaignRequest{CampaignID: campaignID.String(), Status: model.CampaignStatusPaused, Version: 4, AdIDs: adIDs}
+	assert.Len(t, snapshot(), 3)
+	assert.False(t, isServed())
+	assert.Equal(t, int64(0), r.PendingActivations())
+	_, err := store.GetAdByID(other.ID.String())
+	assert.Nil(t, err)
+	ads, _, err := store.GetAds(&model.GetAdRequest{Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []*model.Ad{other}, ads)
+	// the ads are not modified in place, the paused copies are held
+	assert.False(t, served.CampaignPaused)
+	for _, ad := range snapshot() {
+		if ad.ID != other.ID {
+			assert.True(t, ad.CampaignPaused)
+			assert.Equal(t, 4, ad.Version)
+		}
+	}
+
+	// an ad created in the paused campaign is held as well
+	late := newScheduledAd(time.Now().Add(-1 * time.Hour))
+	late.CampaignID = &campaignID
+	late.CampaignPaused = true
+	r.RequestChan <- &CreateAdRequest{Ad: late}
+	adIDs = append(adIDs, late.ID.String())
+	assert.Len(t, snapshot(), 4)
+	_, err = store.GetAdByID(late.ID.String())
+	assert.ErrorIs(t, err, inmem.ErrNoAdsFound)
+
+	// resume serves the started ads and schedules the others again
+	r.RequestChan <- &CampaignRequest{CampaignID: campaignID.String(), Status: model.CampaignStatusActive, Version: 6, AdIDs: adIDs}
+	assert.Len(t, snapshot(), 4)
+	assert.True(t, isServed())
+	assert.Equal(t, int64(1), r.PendingActivations())
+	_, err = store.GetAdByID(late.ID.String())
+	assert.Nil(t, err)
+
+	// end deletes all the ads of the campaign
+	r.RequestChan <- &CampaignRequest{CampaignID: campaignID.String(), Status: model.CampaignStatusEnded, Version: 7, AdIDs: adIDs}
+	assert.Equal(t, []*model.Ad{other}, snapshot())
+	assert.False(t, isServed())
+	assert.Equal(t, int64(0), r.PendingActivations())
+}
@@ -87,6 +87,38 @@ func (r *GetAdResponse) Error() error {
 	return r.Err
 }
 
+type GetAdByIDRequest struct {
+	Request
+	AdID string
+}
+
+type GetAdByIDResponse struct {
+	IResult
+	Response
+	Ad  *model.Ad
+	Err error
+}
+
+func (r *GetAdByIDResponse) Error() error {
+	return r.Err
+}
+
+type UpdateAdRequest struct {
+	Request
+	*model.Ad
+}
+
+type UpdateAdResponse struct {
+	IResult
+	Response
+	AdID string
+	Err  error
+}
+
+func (r *UpdateAdResponse) Error() error {
+	return r.Err
+}
+
 type DeleteAdRequest struct {
 	Request
 	AdID string
@@ -101,3 +133,38 @@ type DeleteAdResponse struct {
 func (r *DeleteAdResponse) Error() error {
 	return r.Err
 }
+
+type SnapshotRequest struct {
+	Request
+}
+
+type SnapshotResponse struct {
+	IResult
+	Response
+	Ads []*model.Ad
+	Err error
+}
+
+func (r *SnapshotResponse) Error() error {
+	return r.Err
+}
+
+// CampaignRequest cascades the status of the campaign to its ads,
+// AdIDs are the active ads of the campaign and Version is the version of the log entry
+type CampaignRequest struct {
+	Request
+	CampaignID string               `json:"campaign_id"`
+	Status     model.CampaignStatus `json:"status"`
+	Version    int                  `json:"version"`
+	AdIDs      []string             `json:"ad_ids"`
+}
+
+type CampaignResponse struct {
+	IResult
+	Response
+	Err error
+}
+
+func (r *CampaignResponse) Error() error {
+	return r.Err
+}
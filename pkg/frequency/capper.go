@@ -0,0 +1,261 @@
+package frequency
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/metrics"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const dayLayout = "20060102"
+
+// userCounts is the impressions of the capped ads served to a user on a day
+type userCounts struct {
+	day string
+	// counts is the impressions of every ad across the replicas as of the last sync, plus the pending ones
+	counts map[string]int64
+	// pending is the impressions served by this replica which are not synced to redis yet
+	pending  map[string]int64
+	syncedAt time.Time
+}
+
+func newUserCounts(day string) *userCounts {
+	return &userCounts{
+		day:     day,
+		counts:  make(map[string]int64),
+		pending: make(map[string]int64),
+	}
+}
+
+// Capper counts the impressions per user per ad per day in memory,
+// and shares the counts with the other replicas through a redis hash per user per day.
+//
+// The serving path only reads the local counts, the counts of a user are synced with redis
+// when they are older than syncInterval, so a user may exceed the cap by the impressions served
+// by the other replicas within a sync interval.
+// The counts are kept if redis is unreachable, and the caps are enforced by the local counts only.
+// The days are in the local timezone, the unsynced impressions of the previous day are dropped.
+type Capper struct {
+	cache        *redis.Client
+	keyPrefix    string
+	syncInterval time.Duration
+	mu           sync.Mutex
+	users        map[string]*userCounts
+	// now returns the current time, it is replaced in the tests
+	now     func() time.Time
+	closed  atomic.Bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func NewCapper(cache *redis.Client, keyPrefix string, syncInterval time.Duration) *Capper {
+	return &Capper{
+		cache:        cache,
+		keyPrefix:    keyPrefix,
+		syncInterval: syncInterval,
+		users:        make(map[string]*userCounts),
+		now:          time.Now,
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// Filter implements model.FrequencyCapper.
+func (c *Capper) Filter(ctx context.Context, userID string, ads []*model.Ad) []*model.Ad {
+	if userID == "" || !anyCapped(ads) {
+		return ads
+	}
+	if c.stale(userID) {
+		c.sync(ctx, []string{userID})
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u := c.user(userID)
+	ret := make([]*model.Ad, 0, len(ads))
+	for _, ad := range ads {
+		if ad.MaxImpressionsPerUserPerDay > 0 && u.counts[ad.ID.String()] >= int64(ad.MaxImpressionsPerUserPerDay) {
+			metrics.FrequencyCappedAds.Inc()
+			continue
+		}
+		ret = append(ret, ad)
+	}
+	return ret
+}
+
+// Record implements model.FrequencyCapper.
+func (c *Capper) Record(ctx context.Context, userID string, ads []*model.Ad) {
+	if userID == "" || !anyCapped(ads) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u := c.user(userID)
+	for _, ad := range ads {
+		if ad.MaxImpressionsPerUserPerDay == 0 {
+			continue
+		}
+		adID := ad.ID.String()
+		u.counts[adID]++
+		u.pending[adID]++
+	}
+}
+
+// Run implements model.FrequencyCapper.
+// It syncs the users with pending impressions every syncInterval,
+// and evicts the users who are not served in a sync interval.
+func (c *Capper) Run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sync(context.Background(), c.pendingUsers(true))
+		case <-c.done:
+			c.sync(context.Background(), c.pendingUsers(false))
+			return
+		}
+	}
+}
+
+// Close implements model.FrequencyCapper.
+func (c *Capper) Close(ctx context.Context) error {
+	if c.closed.CompareAndSwap(false, true) {
+		close(c.done)
+	}
+	select {
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// user returns the counts of the user on the current day, c.mu must be held
+func (c *Capper) user(userID string) *userCounts {
+	day := c.now().Format(dayLayout)
+	u, ok := c.users[userID]
+	if !ok || u.day != day {
+		u = newUserCounts(day)
+		c.users[userID] = u
+	}
+	return u
+}
+
+func (c *Capper) stale(userID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.users[userID]
+	return !ok || u.day != c.now().Format(dayLayout) || c.now().Sub(u.syncedAt) >= c.syncInterval
+}
+
+// pendingUsers returns the users with pending impressions, the idle users are evicted if evict is true
+func (c *Capper) pendingUsers(evict bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	userIDs := make([]string, 0)
+	for userID, u := range c.users {
+		if len(u.pending) > 0 {
+			userIDs = append(userIDs, userID)
+		} else if evict && c.now().Sub(u.syncedAt) >= c.syncInterval {
+			delete(c.users, userID)
+		}
+	}
+	return userIDs
+}
+
+func (c *Capper) key(day string, userID string) string {
+	return fmt.Sprintf("%s:%s:%s", c.keyPrefix, day, userID)
+}
+
+// sync adds the pending impressions of the users to redis and reads back the counts of the other replicas
+func (c *Capper) sync(ctx context.Context, userIDs []string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	start := c.now()
+	day := start.Format(dayLayout)
+	// the keys expire an hour after the end of the day
+	y, m, d := start.Date()
+	expireAt := time.Date(y, m, d+1, 1, 0, 0, 0, start.Location())
+
+	c.mu.Lock()
+	pending := make(map[string]map[string]int64, len(userIDs))
+	for _, userID := range userIDs {
+		u := c.user(userID)
+		pending[userID] = u.pending
+		u.pending = make(map[string]int64)
+	}
+	c.mu.Unlock()
+
+	pipe := c.cache.Pipeline()
+	reads := make(map[string]*redis.MapStringStringCmd, len(userIDs))
+	for _, userID := range userIDs {
+		key := c.key(day, userID)
+		for adID, n := range pending[userID] {
+			pipe.HIncrBy(ctx, key, adID, n)
+		}
+		if len(pending[userID]) > 0 {
+			pipe.ExpireAt(ctx, key, expireAt)
+		}
+		reads[userID] = pipe.HGetAll(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if err != nil {
+		metrics.FrequencySyncDuration.WithLabelValues("error").Observe(now.Sub(start).Seconds())
+		log.Printf("error syncing the frequency counts of %d users: %v", len(userIDs), err)
+		for _, userID := range userIDs {
+			u := c.user(userID)
+			if u.day != day {
+				continue
+			}
+			// retry the pending impressions with the next sync, and serve by the local counts until then
+			for adID, n := range pending[userID] {
+				u.pending[adID] += n
+			}
+			u.syncedAt = now
+		}
+		return
+	}
+	metrics.FrequencySyncDuration.WithLabelValues("ok").Observe(now.Sub(start).Seconds())
+	for _, userID := range userIDs {
+		u := c.user(userID)
+		if u.day != day {
+			continue
+		}
+		counts := make(map[string]int64)
+		for adID, v := range reads[userID].Val() {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			counts[adID] = n
+		}
+		// the impressions recorded during the sync are not in redis yet
+		for adID, n := range u.pending {
+			counts[adID] += n
+		}
+		u.counts = counts
+		u.syncedAt = now
+	}
+}
+
+func anyCapped(ads []*model.Ad) bool {
+	for _, ad := range ads {
+		if ad.MaxImpressionsPerUserPerDay > 0 {
+			return true
+		}
+	}
+	return false
+}
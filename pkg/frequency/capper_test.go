@@ -0,0 +1,104 @@
+package frequency
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAds(caps ...uint32) []*model.Ad {
+	ads := make([]*model.Ad, 0, len(caps))
+	for _, c := range caps {
+		ads = append(ads, &model.Ad{ID: uuid.New(), MaxImpressionsPerUserPerDay: c})
+	}
+	return ads
+}
+
+func TestCapper(t *testing.T) {
+	cache, mock := redismock.NewClientMock()
+	capper := NewCapper(cache, "freq", time.Minute)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	capper.now = func() time.Time { return now }
+	key := "freq:20240101:user-1"
+	ads := newAds(2, 1, 0)
+
+	// the other replicas served ads[0] twice
+	mock.ExpectHGetAll(key).SetVal(map[string]string{ads[0].ID.String(): "2"})
+	served := capper.Filter(context.Background(), "user-1", ads)
+	assert.Equal(t, ads[1:], served)
+	capper.Record(context.Background(), "user-1", served)
+
+	// the counts are fresh, the local impression caps ads[1]
+	served = capper.Filter(context.Background(), "user-1", ads)
+	assert.Equal(t, ads[2:], served)
+	// the uncapped ads are not counted
+	assert.Equal(t, map[string]int64{ads[1].ID.String(): 1}, capper.users["user-1"].pending)
+
+	// the pending impressions are synced
+	mock.ExpectHIncrBy(key, ads[1].ID.String(), 1).SetVal(1)
+	mock.ExpectExpireAt(key, time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)).SetVal(true)
+	mock.ExpectHGetAll(key).SetVal(map[string]string{ads[0].ID.String(): "2", ads[1].ID.String(): "1"})
+	capper.sync(context.Background(), capper.pendingUsers(true))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Empty(t, capper.users["user-1"].pending)
+	assert.Equal(t, int64(1), capper.users["user-1"].counts[ads[1].ID.String()])
+
+	// the counts are reset on the next day
+	now = now.Add(12 * time.Hour)
+	mock.ExpectHGetAll("freq:20240102:user-1").SetVal(map[string]string{})
+	assert.Equal(t, ads, capper.Filter(context.Background(), "user-1", ads))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// the requests without the user are not capped
+	assert.Equal(t, ads, capper.Filter(context.Background(), "", ads))
+}
+
+func TestCapper_syncError(t *testing.T) {
+	cache, mock := redismock.NewClientMock()
+	capper := NewCapper(cache, "freq", time.Minute)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	capper.now = func() time.Time { return now }
+	key := "freq:20240101:user-1"
+	ads := newAds(1)
+
+	mock.ExpectHGetAll(key).SetErr(fmt.Errorf("connection refused"))
+	assert.Equal(t, ads, capper.Filter(context.Background(), "user-1", ads))
+	capper.Record(context.Background(), "user-1", ads)
+	// the local counts are enforced without redis
+	assert.Empty(t, capper.Filter(context.Background(), "user-1", ads))
+
+	// the failed impressions are retried by the next sync
+	mock.ExpectHIncrBy(key, ads[0].ID.String(), 1).SetErr(fmt.Errorf("connection refused"))
+	capper.sync(context.Background(), capper.pendingUsers(true))
+	assert.Equal(t, int64(1), capper.users["user-1"].pending[ads[0].ID.String()])
+
+	mock.ExpectHIncrBy(key, ads[0].ID.String(), 1).SetVal(1)
+	mock.ExpectExpireAt(key, time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)).SetVal(true)
+	mock.ExpectHGetAll(key).SetVal(map[string]string{ads[0].ID.String(): "1"})
+	capper.sync(context.Background(), capper.pendingUsers(true))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Empty(t, capper.users["user-1"].pending)
+}
+
+func TestCapper_Close(t *testing.T) {
+	cache, mock := redismock.NewClientMock()
+	capper := NewCapper(cache, "freq", time.Hour)
+	capper.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	ads := newAds(3)
+	key := "freq:20240101:user-1"
+	capper.Record(context.Background(), "user-1", ads)
+	go capper.Run()
+
+	mock.ExpectHIncrBy(key, ads[0].ID.String(), 1).SetVal(1)
+	mock.ExpectExpireAt(key, time.Date(2024, 1, 2, 1, 0, 0, 0, time.UTC)).SetVal(true)
+	mock.ExpectHGetAll(key).SetVal(map[string]string{ads[0].ID.String(): "1"})
+	// Close syncs the pending impressions
+	assert.Nil(t, capper.Close(context.Background()))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
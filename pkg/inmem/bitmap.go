@@ -0,0 +1,393 @@
+package inmem
+
+import (
+	"bytes"
+	"dcard-backend-2024/pkg/metrics"
+	"dcard-backend-2024/pkg/model"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/wangjia184/sortedset"
+)
+
+// BitmapStoreImpl is an in-memory ad store keeping an inverted index of roaring bitmaps.
+// Every ad is assigned a dense integer ID, and every index key of the fields of the layout
+// (see model.IndexField.AdValues) maps to the bitmap of the dense IDs of the ads under the key,
+// so an ad is stored once instead of once per leaf of the index tree.
+//
+// GetAds intersects the unions of the bitmaps of the request keys of every field,
+// removes the ads outside of their time windows, checks the remaining constrained ads against the constraints of the request,
+// and reads the page in the (Score, ID) order of the ads.
+type BitmapStoreImpl struct {
+	layout model.IndexLayout
+	// ads maps the dense IDs to the ads, nil if the ID is free
+	ads []*model.Ad
+	// ids maps the ad IDs to the dense IDs
+	ids map[string]uint32
+	// free is the dense IDs of the deleted ads, they are reused so the bitmaps stay dense
+	free []uint32
+	// postings maps the key and the index key of a field to the bitmap of the ads under the index key
+	postings map[string]map[interface{}]*roaring.Bitmap
+	// ranked maps the ad IDs to the dense IDs in the (Score, ID) order
+	ranked *sortedset.SortedSet
+	// adWindows enforces the StartAt and EndAt of the ads at query time
+	adWindows *timeWindowIndex
+	// adExclusions enforces the exclusion lists of the ads at query time
+	adExclusions *exclusionIndex
+	// adTargeting evaluates the targeting expressions of the candidate ads at query time
+	adTargeting *targetingIndex
+	// adSchedules enforces the weekly schedules of the ads at query time
+	adSchedules *scheduleIndex
+	// adGeo enforces the distances to the circles of the ads at query time
+	adGeo *geoIndex
+	// adTags finds the tagged ads sharing a tag with the request
+	adTags *tagIndex
+	// constrained is the bitmap of the constrained ads, see model.Ad.Constrained
+	constrained *roaring.Bitmap
+	mutex       sync.RWMutex
+	// now returns the query time, it is replaced in the tests
+	now func() time.Time
+}
+
+// NewBitmapStore creates the bitmap store with the default index layout
+func NewBitmapStore() model.InMemoryStore {
+	return NewBitmapStoreWithLayout(model.DefaultIndexLayout())
+}
+
+// NewBitmapStoreWithLayout creates the bitmap store indexing the fields of the layout,
+// the order of the fields does not matter
+func NewBitmapStoreWithLayout(layout model.IndexLayout) model.InMemoryStore {
+	postings := make(map[string]map[interface{}]*roaring.Bitmap, len(layout))
+	for _, f := range layout {
+		postings[f.Key] = make(map[interface{}]*roaring.Bitmap)
+	}
+	return &BitmapStoreImpl{
+		layout:       layout,
+		ids:          make(map[string]uint32),
+		postings:     postings,
+		ranked:       sortedset.New(),
+		adWindows:    newTimeWindowIndex(),
+		adExclusions: newExclusionIndex(layout),
+		adTargeting:  newTargetingIndex(),
+		adSchedules:  newScheduleIndex(),
+		adGeo:        newGeoIndex(),
+		adTags:       newTagIndex(layout),
+		constrained:  roaring.NewBitmap(),
+		mutex:        sync.RWMutex{},
+		now:          time.Now,
+	}
+}
+
+// CreateBatchAds implements model.InMemoryStore.
+func (s *BitmapStoreImpl) CreateBatchAds(ads []*model.Ad) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, ad := range ads {
+		s.addAd(ad)
+	}
+	metrics.InMemoryAds.Set(float64(len(s.ids)))
+	return nil
+}
+
+// CreateAd implements model.InMemoryStore.
+func (s *BitmapStoreImpl) CreateAd(ad *model.Ad) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.addAd(ad)
+	metrics.InMemoryAds.Set(float64(len(s.ids)))
+	return ad.ID.String(), nil
+}
+
+// GetAds implements model.InMemoryStore, with the same semantics as InMemoryStoreImpl.GetAds.
+func (s *BitmapStoreImpl) GetAds(req *model.GetAdRequest) ([]*model.Ad, int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	matched, err := s.match(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	filter := newAdFilter()
+	now := s.now()
+	s.adWindows.Reject(filter, now)
+	s.adSchedules.Reject(filter, req, now)
+	s.adGeo.Reject(filter, req)
+	if err := s.adExclusions.Reject(filter, req); err != nil {
+		return nil, 0, err
+	}
+	for adID := range filter.rejected {
+		if id, ok := s.ids[adID]; ok {
+			matched.Remove(id)
+		}
+	}
+	s.adTargeting.Reject(filter, req)
+	filter.checkAppVersion(req)
+	if len(filter.checks) > 0 {
+		candidates := roaring.And(matched, s.constrained)
+		for it := candidates.Iterator(); it.HasNext(); {
+			if id := it.Next(); !filter.match(s.ads[id]) {
+				matched.Remove(id)
+			}
+		}
+	}
+
+	total := int(matched.GetCardinality())
+	if !s.adTags.Applies(req) {
+		return s.page(matched, req, total), total, nil
+	}
+	tagged, err := s.adTags.Candidates(req, filter.Active)
+	if err != nil {
+		return nil, 0, err
+	}
+	ads, total := mergeTagged(req, s.page(matched, untaggedPage(req), total), total, tagged)
+	return ads, total, nil
+}
+
+// page reads the page of the request from the matched ads, total is the cardinality of the matched ads
+func (s *BitmapStoreImpl) page(matched *roaring.Bitmap, req *model.GetAdRequest, total int) []*model.Ad {
+	if total == 0 || (req.After == nil && req.Offset >= total) {
+		return []*model.Ad{}
+	}
+	need := req.Limit
+	if req.After == nil {
+		need += req.Offset
+	}
+	// the ranked scan reads about need * len(ads) / total ads before the page is filled,
+	// so the sparse results are sorted instead
+	if uint64(need)*uint64(len(s.ids)) <= uint64(total)*uint64(total) {
+		return s.scanRanked(matched, req)
+	}
+	return s.sortMatched(matched, req)
+}
+
+// GetAdByID implements model.InMemoryStore.
+func (s *BitmapStoreImpl) GetAdByID(adID string) (*model.Ad, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	id, ok := s.ids[adID]
+	// the ads outside of their window are not served, the same as by GetAds
+	if !ok || !s.ads[id].ServesAt(s.now()) {
+		return nil, ErrNoAdsFound
+	}
+	return s.ads[id], nil
+}
+
+// ListAds implements model.InMemoryStore.
+func (s *BitmapStoreImpl) ListAds() []*model.Ad {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ads := make([]*model.Ad, 0, len(s.ids))
+	for _, id := range s.ids {
+		ads = append(ads, s.ads[id])
+	}
+	return ads
+}
+
+// UpdateAd implements model.InMemoryStore.
+// The old ad is removed from the bitmaps of its index keys and the new one keeps the dense ID.
+func (s *BitmapStoreImpl) UpdateAd(ad *model.Ad) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.addAd(ad)
+	metrics.InMemoryAds.Set(float64(len(s.ids)))
+	return nil
+}
+
+// DeleteAd implements model.InMemoryStore.
+func (s *BitmapStoreImpl) DeleteAd(adID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id, ok := s.ids[adID]
+	if !ok {
+		return nil
+	}
+	s.removeAd(id)
+	delete(s.ids, adID)
+	s.ads[id] = nil
+	s.free = append(s.free, id)
+	metrics.InMemoryAds.Set(float64(len(s.ids)))
+	return nil
+}
+
+// addAd indexes the ad, replacing the ad with the same ID, s.mutex must be held
+func (s *BitmapStoreImpl) addAd(ad *model.Ad) {
+	adID := ad.ID.String()
+	id, ok := s.ids[adID]
+	switch {
+	case ok:
+		s.removeAd(id)
+	case len(s.free) > 0:
+		id = s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+	default:
+		id = uint32(len(s.ads))
+		s.ads = append(s.ads, nil)
+	}
+	s.ids[adID] = id
+	s.ads[id] = ad
+
+	for _, f := range s.layout {
+		values, err := f.AdValues(ad)
+		if err != nil {
+			log.Printf("AddAd: Error getting value by key \"%s\": %s\n", f.Key, err)
+			continue
+		}
+		for _, v := range values {
+			bitmap, ok := s.postings[f.Key][v]
+			if !ok {
+				bitmap = roaring.NewBitmap()
+				s.postings[f.Key][v] = bitmap
+			}
+			bitmap.Add(id)
+		}
+	}
+	s.ranked.AddOrUpdate(adID, sortedset.SCORE(ad.Score()), id)
+	s.adWindows.AddAd(ad)
+	s.adExclusions.AddAd(ad)
+	s.adTargeting.AddAd(ad)
+	s.adSchedules.AddAd(ad)
+	s.adGeo.AddAd(ad)
+	s.adTags.AddAd(ad)
+	if ad.Constrained() {
+		s.constrained.Add(id)
+	}
+}
+
+// removeAd removes the ad of the dense ID from the indexes but keeps the ID, s.mutex must be held
+func (s *BitmapStoreImpl) removeAd(id uint32) {
+	ad := s.ads[id]
+	for _, f := range s.layout {
+		values, err := f.AdValues(ad)
+		if err != nil {
+			log.Printf("Error getting value by key \"%s\": %s\n", f.Key, err)
+			continue
+		}
+		for _, v := range values {
+			bitmap, ok := s.postings[f.Key][v]
+			if !ok {
+				continue
+			}
+			bitmap.Remove(id)
+			if bitmap.IsEmpty() {
+				delete(s.postings[f.Key], v)
+			}
+		}
+	}
+	s.ranked.Remove(ad.ID.String())
+	s.adWindows.DeleteAd(ad)
+	s.adExclusions.DeleteAd(ad)
+	s.adTargeting.DeleteAd(ad)
+	s.adSchedules.DeleteAd(ad)
+	s.adGeo.DeleteAd(ad)
+	s.adTags.DeleteAd(ad)
+	s.constrained.Remove(id)
+}
+
+// match returns the bitmap of the ads matching every field of the request, the result is owned by the caller
+func (s *BitmapStoreImpl) match(req *model.GetAdRequest) (*roaring.Bitmap, error) {
+	var matched *roaring.Bitmap
+	for _, f := range s.layout {
+		values, err := f.RequestValues(req)
+		if err != nil {
+			return nil, err
+		}
+		bitmaps := make([]*roaring.Bitmap, 0, len(values))
+		for _, v := range values {
+			if bitmap, ok := s.postings[f.Key][v]; ok {
+				bitmaps = append(bitmaps, bitmap)
+			}
+		}
+		if len(bitmaps) == 0 {
+			return roaring.NewBitmap(), nil
+		}
+		if matched == nil {
+			matched = roaring.FastOr(bitmaps...)
+		} else {
+			matched.And(roaring.FastOr(bitmaps...))
+		}
+	}
+	if matched == nil {
+		// every ad matches the empty layout
+		matched = roaring.NewBitmap()
+		for _, id := range s.ids {
+			matched.Add(id)
+		}
+	}
+	return matched, nil
+}
+
+// scanRanked reads the page by scanning the ads in the (Score, ID) order from the start or after the cursor
+func (s *BitmapStoreImpl) scanRanked(matched *roaring.Bitmap, req *model.GetAdRequest) []*model.Ad {
+	ret := make([]*model.Ad, 0, req.Limit)
+	start, skip := 1, 0
+	if req.After != nil {
+		start = rankAfter(s.ranked, req.After)
+	} else {
+		skip = req.Offset
+	}
+	if start == 0 || start > s.ranked.GetCount() {
+		return ret
+	}
+	s.ranked.IterFuncByRankRange(start, s.ranked.GetCount(), func(_ string, value interface{}) bool {
+		id := value.(uint32)
+		if !matched.Contains(id) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		ret = append(ret, s.ads[id])
+		return len(ret) < req.Limit
+	})
+	return ret
+}
+
+// sortMatched reads the page by sorting the matched ads
+func (s *BitmapStoreImpl) sortMatched(matched *roaring.Bitmap, req *model.GetAdRequest) []*model.Ad {
+	ads := make([]*model.Ad, 0, matched.GetCardinality())
+	it := matched.Iterator()
+	for it.HasNext() {
+		ad := s.ads[it.Next()]
+		if req.After != nil && !after(ad, req.After) {
+			continue
+		}
+		ads = append(ads, ad)
+	}
+	sort.Slice(ads, func(i, j int) bool {
+		return less(ads[i], ads[j])
+	})
+	if req.After == nil {
+		ads = ads[min(req.Offset, len(ads)):]
+	}
+	if len(ads) > req.Limit {
+		ads = ads[:req.Limit]
+	}
+	return ads
+}
+
+// less reports whether a is ordered before b by (Score, ID),
+// the bytes of the IDs are ordered as their string keys in the sorted sets
+func less(a, b *model.Ad) bool {
+	if a.Score() != b.Score() {
+		return a.Score() < b.Score()
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// after reports whether the ad is ordered after the cursor
+func after(ad *model.Ad, cursor *model.AdCursor) bool {
+	if ad.Score() != cursor.Score {
+		return ad.Score() > cursor.Score
+	}
+	return ad.ID.String() > cursor.AdID
+}
@@ -0,0 +1,83 @@
+package inmem
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"reflect"
+)
+
+// exclusionIndex indexes the ads by the excluded values of the excludable fields of the layout,
+// so the ads excluding a value of the request can be rejected without parsing their exclusion lists.
+// The ads are still indexed in the tree by their inclusion lists, or by model.IndexAnyValue if the list is empty.
+type exclusionIndex struct {
+	keys []string
+	// ads maps the key and the excluded value to the ads excluding the value by their IDs
+	ads map[string]map[string]map[string]*model.Ad
+}
+
+func newExclusionIndex(layout model.IndexLayout) *exclusionIndex {
+	x := &exclusionIndex{ads: make(map[string]map[string]map[string]*model.Ad)}
+	for _, f := range layout {
+		if f.Excludable() {
+			x.keys = append(x.keys, f.Key)
+			x.ads[f.Key] = make(map[string]map[string]*model.Ad)
+		}
+	}
+	return x
+}
+
+func (x *exclusionIndex) AddAd(ad *model.Ad) {
+	for _, key := range x.keys {
+		for _, v := range ad.ExcludedValues(key) {
+			ads, ok := x.ads[key][v]
+			if !ok {
+				ads = make(map[string]*model.Ad)
+				x.ads[key][v] = ads
+			}
+			ads[ad.ID.String()] = ad
+		}
+	}
+}
+
+func (x *exclusionIndex) DeleteAd(ad *model.Ad) {
+	for _, key := range x.keys {
+		for _, v := range ad.ExcludedValues(key) {
+			ads := x.ads[key][v]
+			delete(ads, ad.ID.String())
+			if len(ads) == 0 {
+				delete(x.ads[key], v)
+			}
+		}
+	}
+}
+
+// Reject lets the filter reject the ads excluding a value of the request, the fields missing in the request exclude nothing.
+// The ads excluding the values are looked up by the constrained ads of the leaves, so they are not collected here.
+func (x *exclusionIndex) Reject(f *adFilter, req *model.GetAdRequest) error {
+	excluding := make([]map[string]*model.Ad, 0, len(x.keys))
+	for _, key := range x.keys {
+		value, err := req.GetValueByKey(key)
+		if err != nil {
+			return err
+		}
+		if reflect.ValueOf(value).IsZero() {
+			continue
+		}
+		if ads, ok := x.ads[key][fmt.Sprintf("%v", value)]; ok {
+			excluding = append(excluding, ads)
+		}
+	}
+	if len(excluding) == 0 {
+		return nil
+	}
+	f.check(func(ad *model.Ad) bool {
+		adID := ad.ID.String()
+		for _, ads := range excluding {
+			if _, ok := ads[adID]; ok {
+				return false
+			}
+		}
+		return true
+	})
+	return nil
+}
@@ -0,0 +1,100 @@
+package inmem
+
+import (
+	"dcard-backend-2024/pkg/model"
+
+	"github.com/wangjia184/sortedset"
+)
+
+// adFilter rejects the ads which are indexed under the request but are not served at the query time:
+// the ads outside of their [StartAt, EndAt) window, the ads excluding a value of the request,
+// the ads whose targeting expression does not match the request, the ads outside of their app version range,
+// the ads off their weekly schedule, and the ads of the grid cell of the request outside of their circles.
+// The tagged candidates of the tag index are checked against the filter too.
+// The ads outside of their windows are found by the time window index, and every leaf counts and skips its own ones.
+// The other constraints are checked against the constrained ads of a leaf (see model.Ad.Constrained) when the leaf is read,
+// so no set of the excluded or the unmatched ads of the whole store is built per request.
+type adFilter struct {
+	// rejected maps the IDs of the rejected ads to the ads
+	rejected map[string]*model.Ad
+	// checks are the constraints of the request the constrained ads are checked against
+	checks []func(ad *model.Ad) bool
+}
+
+func newAdFilter() *adFilter {
+	return &adFilter{rejected: make(map[string]*model.Ad)}
+}
+
+func (f *adFilter) reject(ad *model.Ad) {
+	f.rejected[ad.ID.String()] = ad
+}
+
+// check adds a constraint of the request, the constrained ads failing it are rejected
+func (f *adFilter) check(fn func(ad *model.Ad) bool) {
+	f.checks = append(f.checks, fn)
+}
+
+// match reports whether the ad passes every constraint of the request
+func (f *adFilter) match(ad *model.Ad) bool {
+	for _, fn := range f.checks {
+		if !fn(ad) {
+			return false
+		}
+	}
+	return true
+}
+
+// Active reports whether the ad is neither rejected nor failing a constraint of the request
+func (f *adFilter) Active(ad *model.Ad) bool {
+	if f == nil {
+		return true
+	}
+	if _, ok := f.rejected[ad.ID.String()]; ok {
+		return false
+	}
+	return !ad.Constrained() || f.match(ad)
+}
+
+// checkAppVersion lets the filter reject the ads whose app version range does not contain the version of the request
+func (f *adFilter) checkAppVersion(req *model.GetAdRequest) {
+	if req.AppVersion == 0 {
+		return
+	}
+	f.check(func(ad *model.Ad) bool {
+		return ad.ServesAppVersion(req.AppVersion)
+	})
+}
+
+// rejectedIn returns the IDs of the ads of the sorted set rejected by the filter,
+// and of the constrained ads of the set failing a constraint of the request.
+// The rejected ads are looked up in the set, or the set is walked if it is smaller,
+// so a leaf is not charged for the rejected ads of the other leaves.
+func (f *adFilter) rejectedIn(ads *sortedset.SortedSet, constrained map[string]*model.Ad) map[string]struct{} {
+	ret := make(map[string]struct{})
+	if f == nil {
+		return ret
+	}
+	if len(f.rejected) <= ads.GetCount() {
+		for adID := range f.rejected {
+			if ads.GetByKey(adID) != nil {
+				ret[adID] = struct{}{}
+			}
+		}
+	} else if ads.GetCount() > 0 {
+		ads.IterFuncByRankRange(1, ads.GetCount(), func(adID string, _ interface{}) bool {
+			if _, ok := f.rejected[adID]; ok {
+				ret[adID] = struct{}{}
+			}
+			return true
+		})
+	}
+	if len(f.checks) == 0 {
+		return ret
+	}
+	for adID, ad := range constrained {
+		if _, ok := ret[adID]; !ok && !f.match(ad) {
+			ret[adID] = struct{}{}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,60 @@
+package inmem
+
+import (
+	"dcard-backend-2024/pkg/model"
+)
+
+// geoIndex indexes the ads with circles by the grid cells covering the circles, and the circles are not in the index tree,
+// so the circles do not multiply the leaf entries of the ads by their cells.
+// The request with coordinates serves the ads with circles only if they are among the ads of its cell containing it,
+// the ads of the cell are checked by their distances once per request and the constrained ads of the leaves are looked up.
+type geoIndex struct {
+	// ads maps the cell to the ads with a circle covering the cell by their IDs
+	ads map[model.GeoCell]map[string]*model.Ad
+}
+
+func newGeoIndex() *geoIndex {
+	return &geoIndex{ads: make(map[model.GeoCell]map[string]*model.Ad)}
+}
+
+func (x *geoIndex) AddAd(ad *model.Ad) {
+	for _, cell := range ad.Geo.Cells() {
+		ads, ok := x.ads[cell]
+		if !ok {
+			ads = make(map[string]*model.Ad)
+			x.ads[cell] = ads
+		}
+		ads[ad.ID.String()] = ad
+	}
+}
+
+func (x *geoIndex) DeleteAd(ad *model.Ad) {
+	for _, cell := range ad.Geo.Cells() {
+		ads := x.ads[cell]
+		delete(ads, ad.ID.String())
+		if len(ads) == 0 {
+			delete(x.ads, cell)
+		}
+	}
+}
+
+// Reject lets the filter reject the ads with circles not containing the coordinates of the request,
+// the request without coordinates is not constrained by the circles
+func (x *geoIndex) Reject(f *adFilter, req *model.GetAdRequest) {
+	if req.Geo == nil {
+		return
+	}
+	contained := make(map[string]struct{})
+	for adID, ad := range x.ads[req.Geo.Cell()] {
+		if ad.Geo.Contains(*req.Geo) {
+			contained[adID] = struct{}{}
+		}
+	}
+	f.check(func(ad *model.Ad) bool {
+		if len(ad.Geo) == 0 {
+			return true
+		}
+		_, ok := contained[ad.ID.String()]
+		return ok
+	})
+}
@@ -1,9 +1,12 @@
 package inmem
 
 import (
+	"dcard-backend-2024/pkg/metrics"
 	"dcard-backend-2024/pkg/model"
 	"fmt"
 	"log"
+	"math"
+	"sort"
 	"sync"
 
 	cmap "github.com/orcaman/concurrent-map/v2"
@@ -12,7 +15,9 @@ import (
 
 type IndexNode interface {
 	AddAd(ad *model.Ad)
-	GetAd(req *model.GetAdRequest) ([]*model.Ad, error)
+	// GetAd returns the page of ads matching the request and the total number of matching ads,
+	// the ads rejected by the filter are skipped
+	GetAd(req *model.GetAdRequest, filter *adFilter) ([]*model.Ad, int, error)
 	DeleteAd(ad *model.Ad)
 }
 
@@ -20,12 +25,20 @@ type FieldStringer struct {
 	Value interface{}
 }
 
+// String is the shard key of the children map, the strings and the stringers are not formatted
+// since the requests look up several keys per node
 func (f FieldStringer) String() string {
+	switch v := f.Value.(type) {
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
 	return fmt.Sprintf("%v", f.Value)
 }
 
 func (g *IndexInternalNode) AddAd(ad *model.Ad) {
-	values, err := ad.GetValueByKey(g.Key)
+	values, err := g.field().AdValues(ad)
 	if err != nil {
 		log.Printf("AddAd: Error getting value by key \"%s\": %s\n", g.Key, err)
 		return
@@ -42,12 +55,7 @@ func (g *IndexInternalNode) AddAd(ad *model.Ad) {
 
 			child, exists := g.Children.Get(field)
 			if !exists {
-				nextKey := model.Ad{}.GetNextIndexKey(g.Key)
-				if nextKey == "" {
-					child = NewIndexLeafNode()
-				} else {
-					child = NewIndexInternalNode(nextKey)
-				}
+				child = newIndexNode(g.layout, g.depth+1)
 				g.Children.Set(field, child)
 			}
 
@@ -59,25 +67,66 @@ func (g *IndexInternalNode) AddAd(ad *model.Ad) {
 }
 
 // GetAd implements IndexNode.
-func (g *IndexInternalNode) GetAd(req *model.GetAdRequest) ([]*model.Ad, error) {
-	values, err := req.GetValueByKey(g.Key)
+// The request may match the ads under several children, e.g. the blocks of the interval strategy containing the value,
+// or model.IndexAnyValue of an excludable field whose excluding ads are rejected by the filter when the leaves are read.
+func (g *IndexInternalNode) GetAd(req *model.GetAdRequest, filter *adFilter) ([]*model.Ad, int, error) {
+	values, err := g.field().RequestValues(req)
 	if err != nil {
-		return nil, fmt.Errorf("GetAd: Error getting value by key \"%s\": %s", g.Key, err)
+		return nil, 0, fmt.Errorf("GetAd: Error getting value by key \"%s\": %s", g.Key, err)
 	}
 
-	Field := FieldStringer{Value: values}
-	child, exists := g.Children.Get(Field)
-	if !exists {
-		return nil, nil
+	children := make([]IndexNode, 0, len(values))
+	for _, v := range values {
+		if child, exists := g.Children.Get(FieldStringer{Value: v}); exists {
+			children = append(children, child)
+		}
 	}
 
-	ads, err := child.GetAd(req)
-	return ads, nil
+	switch len(children) {
+	case 0:
+		return nil, 0, nil
+	case 1:
+		return children[0].GetAd(req, filter)
+	default:
+		return getMerged(children, req, filter)
+	}
+}
+
+// getMerged reads the first Offset+Limit ads (or Limit ads after the cursor) of every child,
+// and merges them in the (Score, ID) order of the leaves.
+// The children hold disjoint ads, since an ad is indexed under at most one of the keys of the request:
+// the ads are only indexed by model.IndexAnyValue if they have no value of the field,
+// and the blocks covering the range of an ad are disjoint.
+func getMerged(children []IndexNode, req *model.GetAdRequest, filter *adFilter) ([]*model.Ad, int, error) {
+	sub := *req
+	if req.After == nil {
+		sub.Offset, sub.Limit = 0, req.Offset+req.Limit
+	}
+	merged := make([]*model.Ad, 0, sub.Limit)
+	total := 0
+	for _, child := range children {
+		ads, count, err := child.GetAd(&sub, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		merged = append(merged, ads...)
+		total += count
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return less(merged[i], merged[j])
+	})
+	if req.After == nil {
+		merged = merged[min(req.Offset, len(merged)):]
+	}
+	if len(merged) > req.Limit {
+		merged = merged[:req.Limit]
+	}
+	return merged, total, nil
 }
 
 // DeleteAd implements IndexNode.
 func (g *IndexInternalNode) DeleteAd(ad *model.Ad) {
-	values, err := ad.GetValueByKey(g.Key)
+	values, err := g.field().AdValues(ad)
 	if err != nil {
 		log.Printf("Error getting value by key \"%s\": %s\n", g.Key, err)
 		return
@@ -97,36 +146,111 @@ func (g *IndexInternalNode) DeleteAd(ad *model.Ad) {
 type IndexInternalNode struct {
 	Key      string                                       // The key this node indexes on, e.g., "country", "age"
 	Children cmap.ConcurrentMap[FieldStringer, IndexNode] // The children of this node
+	layout   model.IndexLayout                            // The layout of the whole tree
+	depth    int                                          // The level of this node, layout[depth] is the field of Key
 }
 
-func NewIndexInternalNode(key string) IndexNode {
+// NewIndexInternalNode creates the node indexing on layout[depth]
+func NewIndexInternalNode(layout model.IndexLayout, depth int) IndexNode {
+	metrics.InMemoryIndexNodes.WithLabelValues("internal").Inc()
 	return &IndexInternalNode{
-		Key:      key,
+		Key:      layout[depth].Key,
 		Children: cmap.NewStringer[FieldStringer, IndexNode](),
+		layout:   layout,
+		depth:    depth,
+	}
+}
+
+func (g *IndexInternalNode) field() model.IndexField {
+	return g.layout[g.depth]
+}
+
+// newIndexNode creates the node at the given depth of the layout, the node below the last field is a leaf
+func newIndexNode(layout model.IndexLayout, depth int) IndexNode {
+	if depth >= len(layout) {
+		return NewIndexLeafNode()
 	}
+	return NewIndexInternalNode(layout, depth)
 }
 
 type IndexLeafNode struct {
 	mu  sync.RWMutex
 	Ads *sortedset.SortedSet // map[string]*model.Ad
+	// constrained maps the IDs of the constrained ads of the leaf to the ads, see model.Ad.Constrained
+	constrained map[string]*model.Ad
 }
 
 func (g *IndexLeafNode) AddAd(ad *model.Ad) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	g.Ads.AddOrUpdate(ad.ID.String(), sortedset.SCORE(ad.CreatedAt.T().Unix()), ad)
+	g.Ads.AddOrUpdate(ad.ID.String(), sortedset.SCORE(ad.Score()), ad)
+	if ad.Constrained() {
+		g.constrained[ad.ID.String()] = ad
+	} else {
+		delete(g.constrained, ad.ID.String())
+	}
 }
 
 // GetAd implements IndexNode.
-func (g *IndexLeafNode) GetAd(req *model.GetAdRequest) ([]*model.Ad, error) {
+// The total is the cardinality of the leaf minus its rejected ads, since the leaf holds every ad matching the request.
+// The page is read by walking the leaf from the rank of the offset or the cursor and skipping the rejected ads,
+// the rank of the offset is moved past the rejected ads ranked before it.
+func (g *IndexLeafNode) GetAd(req *model.GetAdRequest, filter *adFilter) ([]*model.Ad, int, error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
-	ad := g.Ads.GetByRankRange(req.Offset, req.Offset+req.Limit, false)
-	ret := make([]*model.Ad, len(ad))
-	for i, a := range ad {
-		ret[i] = a.Value.(*model.Ad)
+	rejected := filter.rejectedIn(g.Ads, g.constrained)
+	total := g.Ads.GetCount() - len(rejected)
+	ret := make([]*model.Ad, 0, min(req.Limit, total))
+	start := 0
+	if req.After != nil {
+		start = rankAfter(g.Ads, req.After)
+	} else if req.Offset < total {
+		start = g.rankOf(req.Offset, rejected)
+	}
+	if start == 0 {
+		return ret, total, nil
+	}
+	g.Ads.IterFuncByRankRange(start, g.Ads.GetCount(), func(adID string, value interface{}) bool {
+		if _, ok := rejected[adID]; ok {
+			return true
+		}
+		ret = append(ret, value.(*model.Ad))
+		return len(ret) < req.Limit
+	})
+	return ret, total, nil
+}
+
+// rankOf returns the rank of the ad at the offset of the ads not rejected, the rank of the sorted set is 1-based
+func (g *IndexLeafNode) rankOf(offset int, rejected map[string]struct{}) int {
+	ranks := make([]int, 0, len(rejected))
+	for adID := range rejected {
+		ranks = append(ranks, g.Ads.FindRank(adID))
+	}
+	sort.Ints(ranks)
+	rank := offset + 1
+	for _, r := range ranks {
+		if r > rank {
+			break
+		}
+		rank++
+	}
+	return rank
+}
+
+// rankAfter returns the rank of the first ad of the sorted set ordered after the (Score, ID) of the cursor, 0 if there is none,
+// the cursor ad itself does not need to be in the set anymore
+func rankAfter(ads *sortedset.SortedSet, cursor *model.AdCursor) int {
+	score := sortedset.SCORE(cursor.Score)
+	ties := ads.GetByScoreRange(score, score, nil)
+	nodes := ads.GetByScoreRange(score, math.MaxInt64, &sortedset.GetByScoreRangeOptions{
+		Limit: len(ties) + 1,
+	})
+	for _, node := range nodes {
+		if node.Score() > score || node.Key() > cursor.AdID {
+			return ads.FindRank(node.Key())
+		}
 	}
-	return ret, nil
+	return 0
 }
 
 // DeleteAd implements IndexNode.
@@ -134,10 +258,13 @@ func (g *IndexLeafNode) DeleteAd(ad *model.Ad) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	g.Ads.Remove(ad.ID.String())
+	delete(g.constrained, ad.ID.String())
 }
 
 func NewIndexLeafNode() IndexNode {
+	metrics.InMemoryIndexNodes.WithLabelValues("leaf").Inc()
 	return &IndexLeafNode{
-		Ads: sortedset.New(),
+		Ads:         sortedset.New(),
+		constrained: make(map[string]*model.Ad),
 	}
 }
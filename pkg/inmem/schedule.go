@@ -0,0 +1,47 @@
+package inmem
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"time"
+)
+
+// scheduleIndex holds the served hours of the scheduled ads, so the schedules are not expanded per request.
+// The local time depends on the time zone of the request, so the scheduled ads are checked at query time
+// as the constrained ads of the leaves.
+type scheduleIndex struct {
+	// hours maps the IDs of the scheduled ads to their served hours, see model.Schedule.Hours
+	hours map[string][7]uint32
+}
+
+func newScheduleIndex() *scheduleIndex {
+	return &scheduleIndex{hours: make(map[string][7]uint32)}
+}
+
+func (x *scheduleIndex) AddAd(ad *model.Ad) {
+	if len(ad.Schedule) == 0 {
+		return
+	}
+	x.hours[ad.ID.String()] = ad.Schedule.Hours()
+}
+
+func (x *scheduleIndex) DeleteAd(ad *model.Ad) {
+	delete(x.hours, ad.ID.String())
+}
+
+// Reject lets the filter reject the ads off their schedule at now in the time zone of the request,
+// the request without a time zone is in the time zone of the server, APP_SERVER_TIMEZONE set as time.Local by the bootstrap
+func (x *scheduleIndex) Reject(f *adFilter, req *model.GetAdRequest, now time.Time) {
+	if len(x.hours) == 0 {
+		return
+	}
+	loc := req.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	weekday, hour := local.Weekday(), uint32(1)<<local.Hour()
+	f.check(func(ad *model.Ad) bool {
+		hours, ok := x.hours[ad.ID.String()]
+		return !ok || hours[weekday]&hour != 0
+	})
+}
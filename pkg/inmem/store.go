@@ -1,9 +1,11 @@
 package inmem
 
 import (
+	"dcard-backend-2024/pkg/metrics"
 	"dcard-backend-2024/pkg/model"
 	"fmt"
 	"sync"
+	"time"
 )
 
 var (
@@ -20,14 +22,41 @@ type InMemoryStoreImpl struct {
 	// ads maps ad IDs to ads
 	ads         map[string]*model.Ad
 	adIndexRoot IndexNode
-	mutex       sync.RWMutex
+	// adWindows enforces the StartAt and EndAt of the ads at query time
+	adWindows *timeWindowIndex
+	// adExclusions enforces the exclusion lists of the ads at query time
+	adExclusions *exclusionIndex
+	// adTargeting evaluates the targeting expressions of the candidate ads at query time
+	adTargeting *targetingIndex
+	// adSchedules enforces the weekly schedules of the ads at query time
+	adSchedules *scheduleIndex
+	// adGeo enforces the distances to the circles of the ads at query time
+	adGeo *geoIndex
+	// adTags finds the tagged ads sharing a tag with the request
+	adTags *tagIndex
+	mutex  sync.RWMutex
+	// now returns the query time, it is replaced in the tests
+	now func() time.Time
 }
 
+// NewInMemoryStore creates the store with the default index layout
 func NewInMemoryStore() model.InMemoryStore {
+	return NewInMemoryStoreWithLayout(model.DefaultIndexLayout())
+}
+
+// NewInMemoryStoreWithLayout creates the store indexing the ads by the given layout
+func NewInMemoryStoreWithLayout(layout model.IndexLayout) model.InMemoryStore {
 	return &InMemoryStoreImpl{
-		ads:         make(map[string]*model.Ad),
-		adIndexRoot: NewIndexInternalNode(model.Ad{}.GetNextIndexKey("")),
-		mutex:       sync.RWMutex{},
+		ads:          make(map[string]*model.Ad),
+		adIndexRoot:  newIndexNode(layout, 0),
+		adWindows:    newTimeWindowIndex(),
+		adExclusions: newExclusionIndex(layout),
+		adTargeting:  newTargetingIndex(),
+		adSchedules:  newScheduleIndex(),
+		adGeo:        newGeoIndex(),
+		adTags:       newTagIndex(layout),
+		mutex:        sync.RWMutex{},
+		now:          time.Now,
 	}
 }
 
@@ -40,7 +69,14 @@ func (s *InMemoryStoreImpl) CreateBatchAds(ads []*model.Ad) (err error) {
 	for _, ad := range ads {
 		s.ads[ad.ID.String()] = ad
 		s.adIndexRoot.AddAd(ad)
+		s.adWindows.AddAd(ad)
+		s.adExclusions.AddAd(ad)
+		s.adTargeting.AddAd(ad)
+		s.adSchedules.AddAd(ad)
+		s.adGeo.AddAd(ad)
+		s.adTags.AddAd(ad)
 	}
+	metrics.InMemoryAds.Set(float64(len(s.ads)))
 	return nil
 }
 
@@ -50,24 +86,120 @@ func (s *InMemoryStoreImpl) CreateAd(ad *model.Ad) (string, error) {
 
 	s.ads[ad.ID.String()] = ad
 	s.adIndexRoot.AddAd(ad)
+	s.adWindows.AddAd(ad)
+	s.adExclusions.AddAd(ad)
+	s.adTargeting.AddAd(ad)
+	s.adSchedules.AddAd(ad)
+	s.adGeo.AddAd(ad)
+	s.adTags.AddAd(ad)
+	metrics.InMemoryAds.Set(float64(len(s.ads)))
 	return ad.ID.String(), nil
 }
 
+// GetAds returns the page of ads and the total number of active ads matching the request,
+// the ads are active if the query time is in [StartAt, EndAt), even if they are not removed yet,
+// none of the values of the request is excluded by the ad, the targeting expression of the ad matches the request,
+// the app version of the request is in the range of the ad,
+// the query time is in the weekly schedule of the ad in the time zone of the request,
+// the coordinates of the request are in a circle of the ad, and the ad is untagged or shares a tag with the request.
+// The ads are ordered by the (Score, ID) of the request, see model.GetAdRequest.Score.
 func (s *InMemoryStoreImpl) GetAds(req *model.GetAdRequest) (ads []*model.Ad, count int, err error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	ads, err = s.adIndexRoot.GetAd(req)
+	filter := newAdFilter()
+	now := s.now()
+	s.adWindows.Reject(filter, now)
+	s.adSchedules.Reject(filter, req, now)
+	s.adGeo.Reject(filter, req)
+	if err = s.adExclusions.Reject(filter, req); err != nil {
+		return nil, 0, err
+	}
+	s.adTargeting.Reject(filter, req)
+	filter.checkAppVersion(req)
+	if !s.adTags.Applies(req) {
+		return s.adIndexRoot.GetAd(req, filter)
+	}
+	tagged, err := s.adTags.Candidates(req, filter.Active)
+	if err != nil {
+		return nil, 0, err
+	}
+	ads, count, err = s.adIndexRoot.GetAd(untaggedPage(req), filter)
 	if err != nil {
 		return nil, 0, err
 	}
-	return ads, len(ads), nil
+	ads, count = mergeTagged(req, ads, count, tagged)
+	return ads, count, nil
+}
+
+// GetAdByID implements model.InMemoryStore.
+func (s *InMemoryStoreImpl) GetAdByID(adID string) (*model.Ad, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ad, ok := s.ads[adID]
+	// the ads outside of their window are not served, the same as by GetAds
+	if !ok || !ad.ServesAt(s.now()) {
+		return nil, ErrNoAdsFound
+	}
+	return ad, nil
+}
+
+// ListAds implements model.InMemoryStore.
+func (s *InMemoryStoreImpl) ListAds() []*model.Ad {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ads := make([]*model.Ad, 0, len(s.ads))
+	for _, ad := range s.ads {
+		ads = append(ads, ad)
+	}
+	return ads
+}
+
+// UpdateAd implements model.InMemoryStore.
+// It removes the index paths of the old ad (if any) and indexes the new one
+func (s *InMemoryStoreImpl) UpdateAd(ad *model.Ad) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if old, ok := s.ads[ad.ID.String()]; ok {
+		s.adIndexRoot.DeleteAd(old)
+		s.adWindows.DeleteAd(old)
+		s.adExclusions.DeleteAd(old)
+		s.adTargeting.DeleteAd(old)
+		s.adSchedules.DeleteAd(old)
+		s.adGeo.DeleteAd(old)
+		s.adTags.DeleteAd(old)
+	}
+	s.ads[ad.ID.String()] = ad
+	s.adIndexRoot.AddAd(ad)
+	s.adWindows.AddAd(ad)
+	s.adExclusions.AddAd(ad)
+	s.adTargeting.AddAd(ad)
+	s.adSchedules.AddAd(ad)
+	s.adGeo.AddAd(ad)
+	s.adTags.AddAd(ad)
+	metrics.InMemoryAds.Set(float64(len(s.ads)))
+	return nil
 }
 
 // DeleteAd implements model.InMemoryStore.
 func (s *InMemoryStoreImpl) DeleteAd(adID string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.adIndexRoot.DeleteAd(s.ads[adID])
+	ad, ok := s.ads[adID]
+	if !ok {
+		return nil
+	}
+	s.adIndexRoot.DeleteAd(ad)
+	s.adWindows.DeleteAd(ad)
+	s.adExclusions.DeleteAd(ad)
+	s.adTargeting.DeleteAd(ad)
+	s.adSchedules.DeleteAd(ad)
+	s.adGeo.DeleteAd(ad)
+	s.adTags.DeleteAd(ad)
+	delete(s.ads, adID)
+	metrics.InMemoryAds.Set(float64(len(s.ads)))
 	return nil
 }
@@ -2,7 +2,9 @@ package inmem
 
 import (
 	"dcard-backend-2024/pkg/model"
+	"math"
 	"math/rand"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -88,100 +90,141 @@ func NewMockAd() *model.Ad {
 	}
 }
 
+// storeFactory creates the store under test indexing the ads by the layout
+type storeFactory func(layout model.IndexLayout) model.InMemoryStore
+
+// storeFactories are the implementations of model.InMemoryStore the tests run against
+var storeFactories = []struct {
+	name     string
+	newStore storeFactory
+}{
+	{name: "tree", newStore: NewInMemoryStoreWithLayout},
+	{name: "bitmap", newStore: NewBitmapStoreWithLayout},
+}
+
+// forEachStore runs the test against every implementation of model.InMemoryStore
+func forEachStore(t *testing.T, test func(t *testing.T, newStore storeFactory)) {
+	for _, f := range storeFactories {
+		t.Run(f.name, func(t *testing.T) {
+			test(t, f.newStore)
+		})
+	}
+}
+
+// setNow replaces the query time of the store
+func setNow(store model.InMemoryStore, now func() time.Time) {
+	switch s := store.(type) {
+	case *InMemoryStoreImpl:
+		s.now = now
+	case *BitmapStoreImpl:
+		s.now = now
+	}
+}
+
 func TestCreateAd(t *testing.T) {
-	store := NewInMemoryStore()
-	ad := NewMockAd()
-	ad.Version = 1
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ad := NewMockAd()
+		ad.Version = 1
 
-	id, err := store.CreateAd(ad)
-	assert.Equal(t, ad.ID.String(), id)
-	assert.Nil(t, err)
-	assert.NotEmpty(t, id)
+		id, err := store.CreateAd(ad)
+		assert.Equal(t, ad.ID.String(), id)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, id)
+	})
 }
 
 func TestGetAds(t *testing.T) {
-	store := NewInMemoryStore()
-	ad := NewMockAd()
-	ad.Version = 1
-	_, err := store.CreateAd(ad)
-	assert.Nil(t, err)
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ad := NewMockAd()
+		ad.Version = 1
+		_, err := store.CreateAd(ad)
+		assert.Nil(t, err)
 
-	request := &model.GetAdRequest{
-		Age:      uint8(randRange(int(ad.AgeStart), int(ad.AgeEnd))),
-		Country:  ad.Country[0],
-		Gender:   ad.Gender[0],
-		Platform: ad.Platform[0],
-		Offset:   0,
-		Limit:    10,
-	}
+		request := &model.GetAdRequest{
+			Age:      uint8(randRange(int(ad.AgeStart), int(ad.AgeEnd))),
+			Country:  ad.Country[0],
+			Gender:   ad.Gender[0],
+			Platform: ad.Platform[0],
+			Offset:   0,
+			Limit:    10,
+		}
 
-	ads, total, err := store.GetAds(request)
-	assert.Nil(t, err)
-	assert.Equal(t, 1, total)
-	assert.Equal(t, ad.ID, ads[0].ID)
-	assert.Len(t, ads, total)
+		ads, total, err := store.GetAds(request)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, total)
+		assert.Equal(t, ad.ID, ads[0].ID)
+		assert.Len(t, ads, total)
+	})
 }
 
 func TestGetNoAds(t *testing.T) {
-	store := NewInMemoryStore()
-	ad := NewMockAd()
-	ad.Version = 1
-	_, err := store.CreateAd(ad)
-	assert.Nil(t, err)
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ad := NewMockAd()
+		ad.Version = 1
+		_, err := store.CreateAd(ad)
+		assert.Nil(t, err)
 
-	request := &model.GetAdRequest{
-		Age:      uint8(randRange(int(ad.AgeStart), int(ad.AgeEnd))),
-		Country:  ad.Country[0],
-		Gender:   ad.Gender[0],
-		Platform: "1",
-		Offset:   0,
-		Limit:    10,
-	}
+		request := &model.GetAdRequest{
+			Age:      uint8(randRange(int(ad.AgeStart), int(ad.AgeEnd))),
+			Country:  ad.Country[0],
+			Gender:   ad.Gender[0],
+			Platform: "1",
+			Offset:   0,
+			Limit:    10,
+		}
 
-	_, count, err := store.GetAds(request)
-	assert.Nil(t, err)
-	assert.Equal(t, 0, count)
+		_, count, err := store.GetAds(request)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+	})
 }
 
 func TestCreateBatchAds(t *testing.T) {
-	store := NewInMemoryStore()
-	ads := []*model.Ad{}
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ads := []*model.Ad{}
 
-	batchSize := rand.Int() % 1000
+		batchSize := rand.Int() % 1000
 
-	for i := 0; i < batchSize; i++ {
-		ad := NewMockAd()
-		ad.Version = i + 1
-		ads = append(ads, ad)
-	}
+		for i := 0; i < batchSize; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ads = append(ads, ad)
+		}
 
-	err := store.CreateBatchAds(ads)
-	assert.Nil(t, err)
+		err := store.CreateBatchAds(ads)
+		assert.Nil(t, err)
+	})
 }
 
 func TestCreatePerformance(t *testing.T) {
-	store := NewInMemoryStore()
-	ads := []*model.Ad{}
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ads := []*model.Ad{}
 
-	batchSize := rand.Int()%1000 + 1000 // 1000 to 2000
+		batchSize := rand.Int()%1000 + 1000 // 1000 to 2000
 
-	for i := 0; i < batchSize; i++ {
-		ad := NewMockAd()
-		ad.Version = i + 1
-		ads = append(ads, ad)
-	}
+		for i := 0; i < batchSize; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ads = append(ads, ad)
+		}
 
-	start := time.Now()
+		start := time.Now()
 
-	err := store.CreateBatchAds(ads)
-	assert.Nil(t, err)
+		err := store.CreateBatchAds(ads)
+		assert.Nil(t, err)
 
-	elapsed := time.Since(start)
-	averageOpsPerSecond := float64(batchSize) / elapsed.Seconds()
-	t.Logf("Create performance: %.2f ops/sec", averageOpsPerSecond)
-	if averageOpsPerSecond < 10 {
-		assert.False(t, true, "Average operations per second is too low")
-	}
+		elapsed := time.Since(start)
+		averageOpsPerSecond := float64(batchSize) / elapsed.Seconds()
+		t.Logf("Create performance: %.2f ops/sec", averageOpsPerSecond)
+		if averageOpsPerSecond < 10 {
+			assert.False(t, true, "Average operations per second is too low")
+		}
+	})
 }
 
 func generateRandomGetAdRequest() model.GetAdRequest {
@@ -200,7 +243,13 @@ func generateRandomGetAdRequest() model.GetAdRequest {
 	}
 }
 func TestReadAdsPerformanceAndAccuracy(t *testing.T) {
-	store := NewInMemoryStore()
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		testReadAdsPerformanceAndAccuracy(t, newStore)
+	})
+}
+
+func testReadAdsPerformanceAndAccuracy(t *testing.T, newStore storeFactory) {
+	store := newStore(model.DefaultIndexLayout())
 
 	// Populate the store with a batch of ads
 	batchSize := 3000
@@ -278,6 +327,1071 @@ func TestReadAdsPerformanceAndAccuracy(t *testing.T) {
 
 func BenchmarkReadAds(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		TestReadAdsPerformanceAndAccuracy(&testing.T{})
+		testReadAdsPerformanceAndAccuracy(&testing.T{}, NewInMemoryStoreWithLayout)
+	}
+}
+
+func TestUpdateAd(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ad := NewMockAd()
+		ad.Version = 1
+		_, err := store.CreateAd(ad)
+		assert.Nil(t, err)
+
+		updated := *ad
+		updated.Version = 2
+		updated.Country = []string{"JP"}
+		updated.Platform = []string{"web"}
+		err = store.UpdateAd(&updated)
+		assert.Nil(t, err)
+
+		request := &model.GetAdRequest{
+			Age:      ad.AgeStart,
+			Country:  "JP",
+			Platform: "web",
+			Offset:   0,
+			Limit:    10,
+		}
+		ads, total, err := store.GetAds(request)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, total)
+		assert.Equal(t, 2, ads[0].Version)
+
+		// the old index paths are removed
+		for _, country := range ad.Country {
+			if country == "JP" {
+				continue
+			}
+			request.Country = country
+			request.Platform = ""
+			_, total, err = store.GetAds(request)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, total)
+		}
+	})
+}
+
+func TestDeleteAd(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ad := NewMockAd()
+		ad.Version = 1
+		_, err := store.CreateAd(ad)
+		assert.Nil(t, err)
+
+		err = store.DeleteAd(ad.ID.String())
+		assert.Nil(t, err)
+		// deleting an unknown ad is a no-op
+		err = store.DeleteAd(ad.ID.String())
+		assert.Nil(t, err)
+
+		request := &model.GetAdRequest{
+			Age:     ad.AgeStart,
+			Country: ad.Country[0],
+			Offset:  0,
+			Limit:   10,
+		}
+		_, total, err := store.GetAds(request)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, total)
+	})
+}
+
+func TestGetAdByID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ad := NewMockAd()
+		ad.Version = 1
+		_, err := store.CreateAd(ad)
+		assert.Nil(t, err)
+
+		got, err := store.GetAdByID(ad.ID.String())
+		assert.Nil(t, err)
+		assert.Equal(t, ad.ID, got.ID)
+
+		// the ad is not found outside of its window by the query time of the store
+		setNow(store, func() time.Time { return ad.EndAt.T() })
+		_, err = store.GetAdByID(ad.ID.String())
+		assert.ErrorIs(t, err, ErrNoAdsFound)
+		setNow(store, func() time.Time { return ad.StartAt.T().Add(-time.Second) })
+		_, err = store.GetAdByID(ad.ID.String())
+		assert.ErrorIs(t, err, ErrNoAdsFound)
+		setNow(store, time.Now)
+
+		err = store.DeleteAd(ad.ID.String())
+		assert.Nil(t, err)
+		_, err = store.GetAdByID(ad.ID.String())
+		assert.ErrorIs(t, err, ErrNoAdsFound)
+	})
+}
+
+func TestGetAdsTotal(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		batchSize := 25
+		for i := 0; i < batchSize; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{"TW"}
+			ad.CreatedAt = model.CustomTime(time.Now().Add(time.Duration(i) * time.Second))
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		seen := map[string]struct{}{}
+		for offset := 0; offset < batchSize; offset += 10 {
+			ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Offset: offset, Limit: 10})
+			assert.Nil(t, err)
+			assert.Equal(t, batchSize, total)
+			assert.Len(t, ads, min(10, batchSize-offset))
+			for _, ad := range ads {
+				seen[ad.ID.String()] = struct{}{}
+			}
+		}
+		// the pages do not overlap
+		assert.Len(t, seen, batchSize)
+
+		ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Offset: 30, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, batchSize, total)
+		assert.Len(t, ads, 0)
+	})
+}
+
+func TestGetAdsAfterCursor(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		batchSize := 25
+		ads := []*model.Ad{}
+		for i := 0; i < batchSize; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{"TW"}
+			// some of the ads share the same score
+			ad.Rank = -int64(i / 3)
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+			ads = append(ads, ad)
+		}
+
+		request := &model.GetAdRequest{Age: 30, Country: "TW", Limit: 10}
+		first, _, err := store.GetAds(request)
+		assert.Nil(t, err)
+		assert.Len(t, first, 10)
+
+		// the ads on the first page are expired and a new ad is inserted before the cursor
+		for _, ad := range first[:5] {
+			assert.Nil(t, store.DeleteAd(ad.ID.String()))
+		}
+		newAd := NewMockAd()
+		newAd.AgeStart, newAd.AgeEnd = 18, 65
+		newAd.Country = []string{"TW"}
+		newAd.Rank = 0
+		_, err = store.CreateAd(newAd)
+		assert.Nil(t, err)
+
+		last := first[len(first)-1]
+		request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		seen := map[string]struct{}{}
+		for _, ad := range first {
+			seen[ad.ID.String()] = struct{}{}
+		}
+		for {
+			page, _, err := store.GetAds(request)
+			assert.Nil(t, err)
+			if len(page) == 0 {
+				break
+			}
+			for _, ad := range page {
+				_, dup := seen[ad.ID.String()]
+				assert.False(t, dup, "duplicated ad across pages")
+				seen[ad.ID.String()] = struct{}{}
+			}
+			last = page[len(page)-1]
+			request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		}
+		// every ad is seen exactly once, except the one inserted before the cursor
+		assert.Len(t, seen, batchSize)
+	})
+}
+
+func TestGetAdsRanking(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		ranking := model.DefaultRanking()
+		now := time.Now()
+		newAd := func(bid float64, createdAt time.Time) *model.Ad {
+			ad := NewMockAd()
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{"TW"}
+			ad.Bid = bid
+			ad.CreatedAt = model.CustomTime(createdAt)
+			ad.Rank = ranking.Rank(ad, 0)
+			return ad
+		}
+		// the higher bid beats the newer ad, the newer ad wins the tie of the bid
+		want := []*model.Ad{
+			newAd(5, now.Add(-24*time.Hour)),
+			newAd(2, now),
+			newAd(2, now.Add(-time.Hour)),
+			newAd(0, now),
+		}
+		for _, i := range []int{3, 1, 0, 2} {
+			_, err := store.CreateAd(want[i])
+			assert.Nil(t, err)
+		}
+
+		ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, len(want), total)
+		assert.Equal(t, want, ads)
+	})
+}
+
+func TestGetAdsTimeWindow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		now := time.Now()
+		store := newStore(model.DefaultIndexLayout())
+		setNow(store, func() time.Time { return now })
+
+		newAd := func(i int, startAt, endAt time.Time) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{"TW"}
+			ad.StartAt, ad.EndAt = model.CustomTime(startAt), model.CustomTime(endAt)
+			ad.CreatedAt = model.CustomTime(now.Add(time.Duration(i) * time.Second))
+			return ad
+		}
+		active := map[string]struct{}{}
+		for i := 0; i < 20; i++ {
+			var ad *model.Ad
+			switch i % 4 {
+			case 0:
+				// the delete task has not removed the expired ad yet
+				ad = newAd(i, now.Add(-2*time.Hour), now.Add(-1*time.Hour))
+			case 1:
+				// the ad is not started yet
+				ad = newAd(i, now.Add(1*time.Hour), now.Add(2*time.Hour))
+			case 2:
+				// EndAt is exclusive
+				ad = newAd(i, now.Add(-1*time.Hour), now)
+			default:
+				// StartAt is inclusive
+				ad = newAd(i, now, now.Add(1*time.Hour))
+				active[ad.ID.String()] = struct{}{}
+			}
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		seen := map[string]struct{}{}
+		for offset := 0; offset < len(active); offset += 2 {
+			ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Offset: offset, Limit: 2})
+			assert.Nil(t, err)
+			assert.Equal(t, len(active), total)
+			assert.Len(t, ads, min(2, len(active)-offset))
+			for _, ad := range ads {
+				assert.Contains(t, active, ad.ID.String())
+				seen[ad.ID.String()] = struct{}{}
+			}
+		}
+		assert.Len(t, seen, len(active))
+
+		request := &model.GetAdRequest{Age: 30, Country: "TW", Limit: 2, After: &model.AdCursor{}}
+		seen = map[string]struct{}{}
+		for {
+			page, _, err := store.GetAds(request)
+			assert.Nil(t, err)
+			if len(page) == 0 {
+				break
+			}
+			for _, ad := range page {
+				assert.Contains(t, active, ad.ID.String())
+				seen[ad.ID.String()] = struct{}{}
+			}
+			last := page[len(page)-1]
+			request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		}
+		assert.Len(t, seen, len(active))
+
+		// the ads become active once the time passes their StartAt
+		now = now.Add(90 * time.Minute)
+		_, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 5, total)
+	})
+}
+
+func TestGetAdsSchedule(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.Nil(t, err)
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		var now time.Time
+		store := newStore(model.DefaultIndexLayout())
+		setNow(store, func() time.Time { return now })
+
+		newAd := func(version int, schedule model.Schedule) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = version
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{"US"}
+			ad.StartAt, ad.EndAt = model.CustomTime(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)), model.CustomTime(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC))
+			ad.Schedule = schedule
+			return ad
+		}
+		// weekdays 18:00-23:00
+		evening := newAd(1, model.Schedule{{Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}, StartHour: 18, EndHour: 23}})
+		// Sunday 01:00-03:00, across the DST transitions
+		night := newAd(2, model.Schedule{{Weekdays: []string{"sun"}, StartHour: 1, EndHour: 3}})
+		always := newAd(3, nil)
+		for _, ad := range []*model.Ad{evening, night, always} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		tests := []struct {
+			name string
+			now  time.Time
+			tz   *time.Location
+			want []*model.Ad
+		}{
+			{name: "friday evening", now: time.Date(2026, 10, 16, 19, 0, 0, 0, newYork), tz: newYork, want: []*model.Ad{evening, always}},
+			{name: "friday night", now: time.Date(2026, 10, 16, 23, 0, 0, 0, newYork), tz: newYork, want: []*model.Ad{always}},
+			{name: "server time zone", now: time.Date(2026, 10, 16, 19, 0, 0, 0, newYork), want: []*model.Ad{always}},
+			{name: "skipped hour", now: time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC), tz: newYork, want: []*model.Ad{always}},
+			{name: "before skipped hour", now: time.Date(2026, 3, 8, 6, 30, 0, 0, time.UTC), tz: newYork, want: []*model.Ad{night, always}},
+			{name: "repeated hour", now: time.Date(2026, 11, 1, 7, 30, 0, 0, time.UTC), tz: newYork, want: []*model.Ad{night, always}},
+			{name: "after repeated hour", now: time.Date(2026, 11, 1, 8, 30, 0, 0, time.UTC), tz: newYork, want: []*model.Ad{always}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				now = tt.now
+				ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "US", Location: tt.tz, Limit: 10})
+				assert.Nil(t, err)
+				assert.Equal(t, len(tt.want), total)
+				assert.ElementsMatch(t, tt.want, ads)
+			})
+		}
+
+		// the schedule is removed from the index with the old version of the ad
+		updated := *evening
+		updated.Version, updated.Schedule = 4, nil
+		assert.Nil(t, store.UpdateAd(&updated))
+		now = time.Date(2026, 10, 16, 23, 0, 0, 0, newYork)
+		_, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "US", Location: newYork, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, total)
+	})
+}
+
+func TestGetAdsGeo(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		newAd := func(version int, geo model.GeoCircles) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = version
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{"TW"}
+			ad.Geo = geo
+			return ad
+		}
+		// around Taipei 101
+		xinyi := newAd(1, model.GeoCircles{{Lat: 25.0340, Long: 121.5645, RadiusKm: 2}})
+		// around Taipei Main Station or Kaohsiung Main Station
+		stations := newAd(2, model.GeoCircles{{Lat: 25.0478, Long: 121.5170, RadiusKm: 1}, {Lat: 22.6394, Long: 120.3025, RadiusKm: 1}})
+		everywhere := newAd(3, nil)
+		for _, ad := range []*model.Ad{xinyi, stations, everywhere} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		tests := []struct {
+			name  string
+			point *model.GeoPoint
+			want  []*model.Ad
+		}{
+			{name: "in circle", point: &model.GeoPoint{Lat: 25.0330, Long: 121.5600}, want: []*model.Ad{xinyi, everywhere}},
+			// the same grid cell as Taipei 101 but 3.5km away
+			{name: "out of circle in cell", point: &model.GeoPoint{Lat: 25.0150, Long: 121.5350}, want: []*model.Ad{everywhere}},
+			{name: "second circle", point: &model.GeoPoint{Lat: 22.6400, Long: 120.3030}, want: []*model.Ad{stations, everywhere}},
+			{name: "other cell", point: &model.GeoPoint{Lat: 24.1477, Long: 120.6736}, want: []*model.Ad{everywhere}},
+			{name: "no coordinates", want: []*model.Ad{xinyi, stations, everywhere}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Geo: tt.point, Limit: 10})
+				assert.Nil(t, err)
+				assert.Equal(t, len(tt.want), total)
+				assert.ElementsMatch(t, tt.want, ads)
+			})
+		}
+
+		// the circles are removed from the index with the old version of the ad
+		updated := *xinyi
+		updated.Version, updated.Geo = 4, nil
+		assert.Nil(t, store.UpdateAd(&updated))
+		_, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Geo: &model.GeoPoint{Lat: 25.0150, Long: 121.5350}, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, total)
+	})
+}
+
+func TestGetAdsTags(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		newAd := func(version int, rank int64, country string, tags []string) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = version
+			ad.Rank = rank
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country = []string{country}
+			ad.Tags = tags
+			return ad
+		}
+		const boost = 10
+		gaming := newAd(1, 5, "TW", []string{"gaming"})
+		// two matched tags outrank the untagged ad of a higher rank
+		gamingTravel := newAd(2, 1, "TW", []string{"Gaming", "travel"})
+		makeup := newAd(3, 30, "TW", []string{"makeup"})
+		untagged := newAd(4, 20, "TW", nil)
+		otherCountry := newAd(5, 100, "JP", []string{"gaming"})
+		for _, ad := range []*model.Ad{gaming, gamingTravel, makeup, untagged, otherCountry} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		tests := []struct {
+			name string
+			tags []string
+			want []*model.Ad
+		}{
+			// gamingTravel: 1+20, untagged: 20, gaming: 5+10
+			{name: "boosted by matched tags", tags: []string{"gaming", "travel"}, want: []*model.Ad{gamingTravel, untagged, gaming}},
+			{name: "case-insensitive", tags: []string{"MAKEUP"}, want: []*model.Ad{makeup, untagged}},
+			{name: "no matched tags", tags: []string{"food"}, want: []*model.Ad{untagged}},
+			{name: "no tags", want: []*model.Ad{makeup, untagged, gaming, gamingTravel}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := &model.GetAdRequest{Age: 30, Country: "TW", Tags: tt.tags, TagBoost: boost, Limit: 10}
+				ads, total, err := store.GetAds(req)
+				assert.Nil(t, err)
+				assert.Equal(t, len(tt.want), total)
+				assert.Equal(t, tt.want, ads)
+
+				// the pages after the cursors of the request are the same ads
+				paged := make([]*model.Ad, 0)
+				req.Limit = 1
+				for {
+					page, _, err := store.GetAds(req)
+					assert.Nil(t, err)
+					if len(page) == 0 {
+						break
+					}
+					paged = append(paged, page...)
+					last := page[0]
+					req.After = &model.AdCursor{Score: req.Score(last), AdID: last.ID.String()}
+				}
+				assert.Equal(t, tt.want, paged)
+
+				// and so are the offsets
+				req.After = nil
+				req.Offset = 1
+				ads, _, err = store.GetAds(req)
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want[1:min(2, len(tt.want))], ads)
+			})
+		}
+
+		// the tags are removed from the index with the old version of the ad
+		updated := *makeup
+		updated.Version, updated.Tags = 6, []string{"food"}
+		assert.Nil(t, store.UpdateAd(&updated))
+		ads, _, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Tags: []string{"food"}, TagBoost: boost, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []*model.Ad{&updated, untagged}, ads)
+	})
+}
+
+func TestGetAdsWithIndexLayout(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		layout, err := model.ParseIndexLayout("Country:multi,Gender:multi,Age:range")
+		assert.Nil(t, err)
+		store := newStore(layout)
+		ad := NewMockAd()
+		ad.Version = 1
+		ad.AgeStart, ad.AgeEnd = 20, 30
+		ad.Country = []string{"TW"}
+		ad.Gender = []string{"F"}
+		_, err = store.CreateAd(ad)
+		assert.Nil(t, err)
+
+		tests := []struct {
+			name      string
+			request   model.GetAdRequest
+			wantTotal int
+		}{
+			{name: "all fields", request: model.GetAdRequest{Age: 25, Country: "TW", Gender: "F", Platform: ad.Platform[0]}, wantTotal: 1},
+			{name: "platform is not indexed", request: model.GetAdRequest{Age: 25, Country: "TW", Platform: "meow"}, wantTotal: 1},
+			{name: "no fields", request: model.GetAdRequest{}, wantTotal: 1},
+			{name: "age out of range", request: model.GetAdRequest{Age: 31, Country: "TW"}, wantTotal: 0},
+			{name: "other country", request: model.GetAdRequest{Age: 25, Country: "JP"}, wantTotal: 0},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.request.Limit = 10
+				_, total, err := store.GetAds(&tt.request)
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantTotal, total)
+			})
+		}
+
+		assert.Nil(t, store.DeleteAd(ad.ID.String()))
+		_, total, err := store.GetAds(&model.GetAdRequest{Country: "TW", Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, total)
+	})
+}
+
+func TestGetAdsExclusion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		newAd := func(version int, country, excludeCountry, platform, excludePlatform, gender, excludeGender []string) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = version
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country, ad.ExcludeCountry = country, excludeCountry
+			ad.Platform, ad.ExcludePlatform = platform, excludePlatform
+			ad.Gender, ad.ExcludeGender = gender, excludeGender
+			return ad
+		}
+		all := []string{"android", "ios", "web"}
+		both := []string{"M", "F"}
+		// TW except ios
+		a := newAd(1, []string{"TW"}, nil, nil, []string{"ios"}, both, nil)
+		// everywhere except JP
+		b := newAd(2, nil, []string{"JP"}, all, nil, both, nil)
+		c := newAd(3, []string{"JP"}, nil, all, nil, both, nil)
+		// everywhere except JP and TW, on the web, to everyone except M
+		d := newAd(4, nil, []string{"JP", "TW"}, []string{"web"}, nil, nil, []string{"M"})
+		for _, ad := range []*model.Ad{a, b, c, d} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		tests := []struct {
+			name    string
+			request model.GetAdRequest
+			want    []*model.Ad
+		}{
+			{name: "included country", request: model.GetAdRequest{Country: "TW", Platform: "web"}, want: []*model.Ad{a, b}},
+			{name: "excluded platform", request: model.GetAdRequest{Country: "TW", Platform: "ios"}, want: []*model.Ad{b}},
+			{name: "excluded country", request: model.GetAdRequest{Country: "JP"}, want: []*model.Ad{c}},
+			{name: "other country", request: model.GetAdRequest{Country: "US"}, want: []*model.Ad{b, d}},
+			{name: "included gender", request: model.GetAdRequest{Country: "US", Platform: "web", Gender: "F"}, want: []*model.Ad{b, d}},
+			{name: "excluded gender", request: model.GetAdRequest{Country: "US", Platform: "web", Gender: "M"}, want: []*model.Ad{b}},
+			{name: "no fields", request: model.GetAdRequest{}, want: []*model.Ad{a, b, c, d}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.request.Age, tt.request.Limit = 30, 10
+				ads, total, err := store.GetAds(&tt.request)
+				assert.Nil(t, err)
+				assert.Equal(t, len(tt.want), total)
+				assert.ElementsMatch(t, tt.want, ads)
+			})
+		}
+
+		// the exclusion is removed from the index with the old version of the ad
+		updated := *a
+		updated.Version, updated.ExcludePlatform = 5, nil
+		updated.Platform = all
+		assert.Nil(t, store.UpdateAd(&updated))
+		ads, total, err := store.GetAds(&model.GetAdRequest{Age: 30, Country: "TW", Platform: "ios", Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, total)
+		assert.ElementsMatch(t, []*model.Ad{&updated, b}, ads)
+	})
+}
+
+func TestGetAdsLanguageRegionAppVersion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		version := func(s string) model.AppVersion {
+			v, err := model.ParseAppVersion(s)
+			assert.Nil(t, err)
+			return v
+		}
+		newAd := func(v int, language, region []string, minVersion, maxVersion model.AppVersion) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = v
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country, ad.Platform, ad.Gender = nil, nil, nil
+			ad.Language, ad.Region = language, region
+			ad.AppVersionStart, ad.AppVersionEnd = minVersion, maxVersion
+			return ad
+		}
+		// every Chinese UI from 5.12.0
+		a := newAd(1, []string{"zh"}, nil, version("5.12.0"), 0)
+		// Taiwanese Mandarin in Taipei, before 6.0.0
+		b := newAd(2, []string{"zh-TW"}, []string{"TW-TPE"}, 0, version("5.99.99"))
+		// English or Japanese in Tokyo, 5.0.0 to 5.12.0
+		c := newAd(3, []string{"en", "ja"}, []string{"JP-13"}, version("5.0.0"), version("5.12.0"))
+		// everyone
+		d := newAd(4, nil, nil, 0, 0)
+		for _, ad := range []*model.Ad{a, b, c, d} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		tests := []struct {
+			name    string
+			request model.GetAdRequest
+			want    []*model.Ad
+		}{
+			{name: "language prefix", request: model.GetAdRequest{Language: "zh-Hant-TW", AppVersion: version("5.12.0")}, want: []*model.Ad{a, d}},
+			{name: "language and region", request: model.GetAdRequest{Language: "zh-TW", Region: "TW-TPE"}, want: []*model.Ad{a, b, d}},
+			{name: "other region", request: model.GetAdRequest{Language: "zh-TW", Region: "TW-KHH", AppVersion: version("5.1.0")}, want: []*model.Ad{d}},
+			{name: "version range", request: model.GetAdRequest{Language: "en", AppVersion: version("5.3.7")}, want: []*model.Ad{c, d}},
+			{name: "newer version", request: model.GetAdRequest{Language: "zh", AppVersion: version("7.0.0")}, want: []*model.Ad{a, d}},
+			{name: "no fields", request: model.GetAdRequest{}, want: []*model.Ad{a, b, c, d}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.request.Age, tt.request.Limit = 30, 10
+				ads, total, err := store.GetAds(&tt.request)
+				assert.Nil(t, err)
+				assert.Equal(t, len(tt.want), total)
+				assert.ElementsMatch(t, tt.want, ads)
+			})
+		}
+	})
+}
+
+func TestGetAdsExclusionPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		var want []*model.Ad
+		for i := 0; i < 20; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Platform = []string{"ios"}
+			ad.Rank = int64(i / 2)
+			// the ads included and the ads not excluded are interleaved by rank
+			if i%2 == 0 {
+				ad.Country = []string{"US"}
+			} else {
+				ad.Country, ad.ExcludeCountry = nil, []string{"JP"}
+			}
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+			want = append(want, ad)
+		}
+		sort.Slice(want, func(i, j int) bool {
+			if want[i].Score() != want[j].Score() {
+				return want[i].Score() < want[j].Score()
+			}
+			return want[i].ID.String() < want[j].ID.String()
+		})
+
+		var byOffset []*model.Ad
+		for offset := 0; offset < len(want); offset += 3 {
+			ads, total, err := store.GetAds(&model.GetAdRequest{Country: "US", Platform: "ios", Offset: offset, Limit: 3})
+			assert.Nil(t, err)
+			assert.Equal(t, len(want), total)
+			byOffset = append(byOffset, ads...)
+		}
+		assert.Equal(t, want, byOffset)
+
+		var byCursor []*model.Ad
+		request := &model.GetAdRequest{Country: "US", Platform: "ios", Limit: 3, After: &model.AdCursor{Score: math.MinInt64}}
+		for {
+			page, _, err := store.GetAds(request)
+			assert.Nil(t, err)
+			if len(page) == 0 {
+				break
+			}
+			byCursor = append(byCursor, page...)
+			last := page[len(page)-1]
+			request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		}
+		assert.Equal(t, want, byCursor)
+	})
+}
+
+func TestGetAdsTargeting(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		newAd := func(version int, expr string, country []string) *model.Ad {
+			ad := NewMockAd()
+			ad.Version = version
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country, ad.Platform, ad.Gender = country, nil, nil
+			ad.Targeting = expr
+			return ad
+		}
+		// the inclusion lists are left to the expressions
+		a := newAd(1, "country IN (TW, JP) AND (platform = ios OR age >= 30) AND NOT gender = M", nil)
+		b := newAd(2, "platform != web", []string{"TW"})
+		// the invalid expression is never served
+		c := newAd(3, "country = ", nil)
+		d := NewMockAd()
+		d.Version, d.AgeStart, d.AgeEnd = 4, 18, 65
+		d.Country, d.Platform, d.Gender = []string{"TW"}, []string{"web"}, []string{"F"}
+		for _, ad := range []*model.Ad{a, b, c, d} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		tests := []struct {
+			name    string
+			request model.GetAdRequest
+			want    []*model.Ad
+		}{
+			{name: "ios", request: model.GetAdRequest{Country: "TW", Platform: "ios", Gender: "F", Age: 20}, want: []*model.Ad{a, b}},
+			{name: "too young on the web", request: model.GetAdRequest{Country: "TW", Platform: "web", Gender: "F", Age: 20}, want: []*model.Ad{d}},
+			{name: "age", request: model.GetAdRequest{Country: "JP", Platform: "web", Gender: "F", Age: 40}, want: []*model.Ad{a}},
+			{name: "excluded gender", request: model.GetAdRequest{Country: "TW", Platform: "ios", Gender: "M", Age: 20}, want: []*model.Ad{b}},
+			{name: "other country", request: model.GetAdRequest{Country: "US", Platform: "ios", Age: 20}, want: []*model.Ad{}},
+			{name: "no fields", request: model.GetAdRequest{}, want: []*model.Ad{a, b, d}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.request.Limit = 10
+				ads, total, err := store.GetAds(&tt.request)
+				assert.Nil(t, err)
+				assert.Equal(t, len(tt.want), total)
+				assert.ElementsMatch(t, tt.want, ads)
+			})
+		}
+
+		// the expression is replaced with the old version of the ad
+		updated := *b
+		updated.Version, updated.Targeting = 5, "platform = web"
+		assert.Nil(t, store.UpdateAd(&updated))
+		ads, total, err := store.GetAds(&model.GetAdRequest{Age: 20, Country: "TW", Platform: "web", Gender: "F", Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, total)
+		assert.ElementsMatch(t, []*model.Ad{&updated, d}, ads)
+
+		assert.Nil(t, store.DeleteAd(a.ID.String()))
+		ads, total, err = store.GetAds(&model.GetAdRequest{Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, total)
+		assert.ElementsMatch(t, []*model.Ad{&updated, d}, ads)
+	})
+}
+
+func TestGetAdsTargetingPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		store := newStore(model.DefaultIndexLayout())
+		var want []*model.Ad
+		for i := 0; i < 30; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ad.AgeStart, ad.AgeEnd = 18, 65
+			ad.Country, ad.Platform = nil, []string{"ios"}
+			ad.Rank = int64(i / 3)
+			// the matching and the unmatched targeted ads are interleaved by rank
+			switch i % 3 {
+			case 0:
+				ad.Targeting = "age >= 30"
+			case 1:
+				ad.Targeting = "age < 30"
+			default:
+				ad.Country = []string{"US"}
+			}
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+			if i%3 != 1 {
+				want = append(want, ad)
+			}
+		}
+		sort.Slice(want, func(i, j int) bool {
+			if want[i].Score() != want[j].Score() {
+				return want[i].Score() < want[j].Score()
+			}
+			return want[i].ID.String() < want[j].ID.String()
+		})
+
+		var byOffset []*model.Ad
+		for offset := 0; offset < len(want); offset += 3 {
+			ads, total, err := store.GetAds(&model.GetAdRequest{Age: 40, Country: "US", Platform: "ios", Offset: offset, Limit: 3})
+			assert.Nil(t, err)
+			assert.Equal(t, len(want), total)
+			byOffset = append(byOffset, ads...)
+		}
+		assert.Equal(t, want, byOffset)
+
+		var byCursor []*model.Ad
+		request := &model.GetAdRequest{Age: 40, Country: "US", Platform: "ios", Limit: 3, After: &model.AdCursor{Score: math.MinInt64}}
+		for {
+			page, _, err := store.GetAds(request)
+			assert.Nil(t, err)
+			if len(page) == 0 {
+				break
+			}
+			byCursor = append(byCursor, page...)
+			last := page[len(page)-1]
+			request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		}
+		assert.Equal(t, want, byCursor)
+	})
+}
+
+func TestGetAdsIntervalLayout(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore storeFactory) {
+		rangeLayout, err := model.ParseIndexLayout("Age:range,Country:multi,Platform:multi,Gender:multi")
+		assert.Nil(t, err)
+		byRange, byInterval := newStore(rangeLayout), newStore(model.DefaultIndexLayout())
+		for i := 0; i < 500; i++ {
+			ad := NewMockAd()
+			ad.Version = i + 1
+			ad.Rank = int64(rand.Intn(10))
+			_, err = byRange.CreateAd(ad)
+			assert.Nil(t, err)
+			_, err = byInterval.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+
+		// the interval strategy serves the same pages as the per-year expansion
+		for i := 0; i < 200; i++ {
+			request := generateRandomGetAdRequest()
+			request.Age = uint8(randRange(0, 70))
+			request.Offset = randRange(0, 20)
+			want, wantTotal, err := byRange.GetAds(&request)
+			assert.Nil(t, err)
+			got, gotTotal, err := byInterval.GetAds(&request)
+			assert.Nil(t, err)
+			assert.Equal(t, wantTotal, gotTotal)
+			assert.Equal(t, want, got)
+		}
+	})
+}
+
+func TestIndexLeafNodeRejected(t *testing.T) {
+	leaf := NewIndexLeafNode().(*IndexLeafNode)
+	var want []*model.Ad
+	filter := newAdFilter()
+	for i := 0; i < 10; i++ {
+		ad := NewMockAd()
+		ad.Rank = int64(10 - i)
+		leaf.AddAd(ad)
+		// the first ads and every third one are rejected
+		if i < 2 || i%3 == 0 {
+			filter.reject(ad)
+		} else {
+			want = append(want, ad)
+		}
+	}
+
+	for _, others := range []int{0, 50} {
+		// the ads rejected in the other leaves are not charged to this one
+		for i := 0; i < others; i++ {
+			filter.reject(NewMockAd())
+		}
+		var byOffset []*model.Ad
+		for offset := 0; offset < len(want)+2; offset += 2 {
+			ads, total, err := leaf.GetAd(&model.GetAdRequest{Offset: offset, Limit: 2}, filter)
+			assert.Nil(t, err)
+			assert.Equal(t, len(want), total)
+			byOffset = append(byOffset, ads...)
+		}
+		assert.Equal(t, want, byOffset)
+
+		var byCursor []*model.Ad
+		request := &model.GetAdRequest{Limit: 2, After: &model.AdCursor{Score: math.MinInt64}}
+		for {
+			page, _, err := leaf.GetAd(request, filter)
+			assert.Nil(t, err)
+			if len(page) == 0 {
+				break
+			}
+			byCursor = append(byCursor, page...)
+			last := page[len(page)-1]
+			request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		}
+		assert.Equal(t, want, byCursor)
+	}
+}
+
+// countIndexNodes returns the number of the nodes of the index tree and the number of the ads in the leaves
+func countIndexNodes(node IndexNode) (nodes int, entries int) {
+	switch n := node.(type) {
+	case *IndexInternalNode:
+		nodes = 1
+		for _, child := range n.Children.Items() {
+			childNodes, childEntries := countIndexNodes(child)
+			nodes += childNodes
+			entries += childEntries
+		}
+	case *IndexLeafNode:
+		nodes, entries = 1, n.Ads.GetCount()
+	}
+	return nodes, entries
+}
+
+func BenchmarkIndexLayout(b *testing.B) {
+	ads := make([]*model.Ad, 1000)
+	for i := range ads {
+		ads[i] = NewMockAd()
+		ads[i].Version = i + 1
+	}
+	requests := make([]model.GetAdRequest, 1000)
+	for i := range requests {
+		requests[i] = generateRandomGetAdRequest()
+	}
+	for _, layout := range []string{
+		"Age:range,Country:multi,Platform:multi,Gender:multi",
+		"Age:interval,Country:multi,Platform:multi,Gender:multi",
+		"Country:multi,Platform:multi,Gender:multi,Age:interval",
+	} {
+		layout, err := model.ParseIndexLayout(layout)
+		if err != nil {
+			b.Fatal(err)
+		}
+		strategy := layout.String()
+		b.Run(strategy+"/create", func(b *testing.B) {
+			var store *InMemoryStoreImpl
+			for i := 0; i < b.N; i++ {
+				store = NewInMemoryStoreWithLayout(layout).(*InMemoryStoreImpl)
+				if err := store.CreateBatchAds(ads); err != nil {
+					b.Fatal(err)
+				}
+			}
+			nodes, entries := countIndexNodes(store.adIndexRoot)
+			b.ReportMetric(float64(nodes), "nodes")
+			b.ReportMetric(float64(entries), "entries")
+		})
+		b.Run(strategy+"/get", func(b *testing.B) {
+			store := NewInMemoryStoreWithLayout(layout)
+			if err := store.CreateBatchAds(ads); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.GetAds(&requests[i%len(requests)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBitmapStoreMatchesTree(t *testing.T) {
+	tree, bitmap := NewInMemoryStore(), NewBitmapStore()
+	for i := 0; i < 1000; i++ {
+		ad := NewMockAd()
+		ad.Version = i + 1
+		ad.Rank = int64(rand.Intn(20))
+		if i%5 == 0 {
+			ad.Country, ad.ExcludeCountry = nil, []string{countries[rand.Intn(len(countries))]}
+		}
+		if i%7 == 0 {
+			ad.Platform, ad.Targeting = nil, "platform = ios OR age >= 30"
+		}
+		for _, store := range []model.InMemoryStore{tree, bitmap} {
+			_, err := store.CreateAd(ad)
+			assert.Nil(t, err)
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		request := generateRandomGetAdRequest()
+		if i%3 == 0 {
+			request.Country = ""
+		}
+		request.Offset = randRange(0, 30)
+		want, wantTotal, err := tree.GetAds(&request)
+		assert.Nil(t, err)
+		got, gotTotal, err := bitmap.GetAds(&request)
+		assert.Nil(t, err)
+		assert.Equal(t, wantTotal, gotTotal)
+		assert.Equal(t, want, got)
+
+		// the next page after the cursor
+		if len(want) == 0 {
+			continue
+		}
+		last := want[len(want)-1]
+		request.After = &model.AdCursor{Score: last.Score(), AdID: last.ID.String()}
+		want, _, err = tree.GetAds(&request)
+		assert.Nil(t, err)
+		got, _, err = bitmap.GetAds(&request)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	}
+}
+
+func BenchmarkStores(b *testing.B) {
+	ads := make([]*model.Ad, 1000)
+	for i := range ads {
+		ads[i] = NewMockAd()
+		ads[i].Version = i + 1
+	}
+	requests := make([]model.GetAdRequest, 1000)
+	for i := range requests {
+		requests[i] = generateRandomGetAdRequest()
+	}
+	for _, f := range storeFactories {
+		b.Run(f.name+"/create", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := f.newStore(model.DefaultIndexLayout()).CreateBatchAds(ads); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(f.name+"/get", func(b *testing.B) {
+			store := f.newStore(model.DefaultIndexLayout())
+			if err := store.CreateBatchAds(ads); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.GetAds(&requests[i%len(requests)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// newTargetedMockAd returns the mock ad with 10 countries, both mobile platforms, a circle and an open-ended app version,
+// the fields which used to multiply the leaf entries of the ad in the tree
+func newTargetedMockAd() *model.Ad {
+	ad := NewMockAd()
+	ad.Country = shuffle(countries, false)[:10]
+	ad.Platform = []string{"ios", "android"}
+	ad.AgeStart, ad.AgeEnd = 18, 35
+	ad.AppVersionStart = model.AppVersion(2<<32 | 1<<16)
+	ad.Geo = model.GeoCircles{{Lat: 25.0340, Long: 121.5645, RadiusKm: 40}}
+	return ad
+}
+
+func BenchmarkCreateTargetedAds(b *testing.B) {
+	ads := make([]*model.Ad, 600)
+	for i := range ads {
+		ads[i] = newTargetedMockAd()
+		ads[i].Version = i + 1
+	}
+	for _, f := range storeFactories {
+		b.Run(f.name, func(b *testing.B) {
+			var store model.InMemoryStore
+			for i := 0; i < b.N; i++ {
+				store = f.newStore(model.DefaultIndexLayout())
+				if err := store.CreateBatchAds(ads); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if tree, ok := store.(*InMemoryStoreImpl); ok {
+				_, entries := countIndexNodes(tree.adIndexRoot)
+				b.ReportMetric(float64(entries)/float64(len(ads)), "entries/ad")
+			}
+		})
 	}
 }
@@ -0,0 +1,186 @@
+package inmem
+
+import (
+	"bytes"
+	"dcard-backend-2024/pkg/model"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// tagIndex is the inverted index of the tags of the ads.
+// The tags strategy of the layout only serves the untagged ads to the requests with tags,
+// so the tagged ads sharing a tag with the request are found here and merged with the page of the untagged ads.
+// The tagged ads are ordered by their scores boosted by the matched tags, see model.GetAdRequest.Score.
+type tagIndex struct {
+	// key is the field of the tags strategy of the layout, empty if the layout has none and the tags are ignored
+	key string
+	// adField and reqField are the indexes of the key in model.Ad and model.GetAdRequest
+	adField, reqField []int
+	// others is the fields of the layout the candidates are matched against
+	others model.IndexLayout
+	// ads maps the lower-cased tag to the ads with the tag by their IDs
+	ads map[string]map[string]*model.Ad
+}
+
+func newTagIndex(layout model.IndexLayout) *tagIndex {
+	x := &tagIndex{ads: make(map[string]map[string]*model.Ad)}
+	for _, f := range layout {
+		if f.Strategy == model.IndexStrategyTags && x.key == "" {
+			// the layout is validated, so both fields exist
+			adField, _ := reflect.TypeOf(model.Ad{}).FieldByName(f.Key)
+			reqField, _ := reflect.TypeOf(model.GetAdRequest{}).FieldByName(f.Key)
+			x.key, x.adField, x.reqField = f.Key, adField.Index, reqField.Index
+		} else {
+			x.others = append(x.others, f)
+		}
+	}
+	return x
+}
+
+func (x *tagIndex) AddAd(ad *model.Ad) {
+	for _, tag := range x.tags(reflect.ValueOf(ad).Elem(), x.adField) {
+		ads, ok := x.ads[tag]
+		if !ok {
+			ads = make(map[string]*model.Ad)
+			x.ads[tag] = ads
+		}
+		ads[ad.ID.String()] = ad
+	}
+}
+
+func (x *tagIndex) DeleteAd(ad *model.Ad) {
+	for _, tag := range x.tags(reflect.ValueOf(ad).Elem(), x.adField) {
+		ads := x.ads[tag]
+		delete(ads, ad.ID.String())
+		if len(ads) == 0 {
+			delete(x.ads, tag)
+		}
+	}
+}
+
+// Applies reports whether the request has tags and the layout indexes them
+func (x *tagIndex) Applies(req *model.GetAdRequest) bool {
+	return len(x.tags(reflect.ValueOf(req).Elem(), x.reqField)) > 0
+}
+
+// Candidates returns the tagged ads sharing a tag with the request and matching every other field of the layout,
+// the ads not active by the store are skipped before their fields are matched.
+// The index keys the request looks up on the other fields are computed once for the candidates.
+func (x *tagIndex) Candidates(req *model.GetAdRequest, active func(ad *model.Ad) bool) ([]*model.Ad, error) {
+	reqValues := make([][]interface{}, len(x.others))
+	for i, f := range x.others {
+		values, err := f.RequestValues(req)
+		if err != nil {
+			return nil, err
+		}
+		reqValues[i] = values
+	}
+	seen := make(map[string]struct{})
+	ret := make([]*model.Ad, 0)
+	for _, tag := range x.tags(reflect.ValueOf(req).Elem(), x.reqField) {
+		for adID, ad := range x.ads[tag] {
+			if _, ok := seen[adID]; ok {
+				continue
+			}
+			seen[adID] = struct{}{}
+			if !active(ad) {
+				continue
+			}
+			matched, err := x.match(ad, reqValues)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				ret = append(ret, ad)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// match reports whether the ad matches the index keys of the request on every other field of the layout
+func (x *tagIndex) match(ad *model.Ad, reqValues [][]interface{}) (bool, error) {
+	for i, f := range x.others {
+		if ok, err := f.Match(ad, reqValues[i]); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// tags returns the distinct lower-cased tags of the field of the ad or the request at the index
+func (x *tagIndex) tags(v reflect.Value, index []int) []string {
+	if x.key == "" {
+		return nil
+	}
+	field := v.FieldByIndex(index)
+	if field.Kind() != reflect.Slice {
+		return nil
+	}
+	tags := make([]string, 0, field.Len())
+	for i := 0; i < field.Len(); i++ {
+		tag := strings.ToLower(field.Index(i).String())
+		if !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// untaggedPage returns the request of the untagged ads to merge with the tagged ones,
+// the first Offset+Limit ads or Limit ads after the cursor, so an offset page costs O(Offset) and a cursor page does not
+func untaggedPage(req *model.GetAdRequest) *model.GetAdRequest {
+	sub := *req
+	if req.After == nil {
+		sub.Offset, sub.Limit = 0, req.Offset+req.Limit
+	}
+	return &sub
+}
+
+// mergeTagged merges the page of the untagged ads read by untaggedPage with the tagged candidates
+// in the (Score, ID) order of the request, and adds the candidates to the total
+func mergeTagged(req *model.GetAdRequest, untagged []*model.Ad, total int, tagged []*model.Ad) ([]*model.Ad, int) {
+	merged := make([]*model.Ad, 0, len(untagged)+len(tagged))
+	merged = append(merged, untagged...)
+	for _, ad := range tagged {
+		if req.After == nil || afterFor(req, ad, req.After) {
+			merged = append(merged, ad)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return lessFor(req, merged[i], merged[j])
+	})
+	if req.After == nil {
+		merged = merged[min(req.Offset, len(merged)):]
+	}
+	if len(merged) > req.Limit {
+		merged = merged[:req.Limit]
+	}
+	return merged, total + len(tagged)
+}
+
+// lessFor reports whether a is ordered before b by the (Score, ID) of the request
+func lessFor(req *model.GetAdRequest, a, b *model.Ad) bool {
+	if sa, sb := req.Score(a), req.Score(b); sa != sb {
+		return sa < sb
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// afterFor reports whether the ad is ordered after the cursor by the (Score, ID) of the request
+func afterFor(req *model.GetAdRequest, ad *model.Ad, cursor *model.AdCursor) bool {
+	if score := req.Score(ad); score != cursor.Score {
+		return score > cursor.Score
+	}
+	return ad.ID.String() > cursor.AdID
+}
@@ -0,0 +1,53 @@
+package inmem
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/targeting"
+	"log"
+)
+
+// targetingIndex holds the compiled targeting expressions of the ads,
+// the index keys of the store only generate the candidates and the expressions filter them at query time.
+type targetingIndex struct {
+	// exprs maps the IDs of the targeted ads to their expressions, nil if the expression is invalid
+	exprs map[string]*targeting.Expr
+}
+
+func newTargetingIndex() *targetingIndex {
+	return &targetingIndex{exprs: make(map[string]*targeting.Expr)}
+}
+
+// AddAd compiles the expression of the ad, the ad with an invalid expression is never served
+func (x *targetingIndex) AddAd(ad *model.Ad) {
+	if ad.Targeting == "" {
+		return
+	}
+	expr, err := targeting.Parse(ad.Targeting)
+	if err != nil {
+		log.Printf("AddAd: Error parsing the targeting of ad %s: %s\n", ad.ID, err)
+	}
+	x.exprs[ad.ID.String()] = expr
+}
+
+func (x *targetingIndex) DeleteAd(ad *model.Ad) {
+	delete(x.exprs, ad.ID.String())
+}
+
+// Match reports whether the targeting expression of the ad matches the request, the ads without one match every request
+func (x *targetingIndex) Match(ad *model.Ad, req *model.GetAdRequest) bool {
+	expr, ok := x.exprs[ad.ID.String()]
+	if !ok {
+		return true
+	}
+	return expr != nil && expr.Match(req)
+}
+
+// Reject lets the filter evaluate the expressions of the candidates of the request
+func (x *targetingIndex) Reject(f *adFilter, req *model.GetAdRequest) {
+	if len(x.exprs) == 0 {
+		return
+	}
+	f.check(func(ad *model.Ad) bool {
+		return x.Match(ad, req)
+	})
+}
@@ -0,0 +1,50 @@
+package inmem
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"math"
+	"time"
+
+	"github.com/wangjia184/sortedset"
+)
+
+// timeWindowIndex indexes the ads by StartAt and by EndAt,
+// so the ads outside of their [StartAt, EndAt) window at a given time can be found without scanning the store.
+// The ads outside of their window stay in the store until the activation or the delete task catches up,
+// the leaves of the tree only count the ones they hold, see adFilter.rejectedIn.
+type timeWindowIndex struct {
+	byStartAt *sortedset.SortedSet
+	byEndAt   *sortedset.SortedSet
+}
+
+func newTimeWindowIndex() *timeWindowIndex {
+	return &timeWindowIndex{
+		byStartAt: sortedset.New(),
+		byEndAt:   sortedset.New(),
+	}
+}
+
+func (w *timeWindowIndex) AddAd(ad *model.Ad) {
+	w.byStartAt.AddOrUpdate(ad.ID.String(), sortedset.SCORE(ad.StartAt.T().UnixNano()), ad)
+	w.byEndAt.AddOrUpdate(ad.ID.String(), sortedset.SCORE(ad.EndAt.T().UnixNano()), ad)
+}
+
+func (w *timeWindowIndex) DeleteAd(ad *model.Ad) {
+	w.byStartAt.Remove(ad.ID.String())
+	w.byEndAt.Remove(ad.ID.String())
+}
+
+// Reject adds the ads outside of their window at now to the filter
+func (w *timeWindowIndex) Reject(f *adFilter, now time.Time) {
+	nowScore := sortedset.SCORE(now.UnixNano())
+	// EndAt <= now
+	for _, node := range w.byEndAt.GetByScoreRange(math.MinInt64, nowScore, nil) {
+		f.reject(node.Value.(*model.Ad))
+	}
+	// StartAt > now, the ads are not in the first range since StartAt < EndAt
+	for _, node := range w.byStartAt.GetByScoreRange(nowScore+1, math.MaxInt64, nil) {
+		if ad := node.Value.(*model.Ad); ad.EndAt.T().After(now) {
+			f.reject(ad)
+		}
+	}
+}
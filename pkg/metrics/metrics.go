@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// HTTPRequestDuration is the latency of the http requests per route
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of the http requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// DispatcherQueueWait is the time a request waits to be received by the dispatcher loop
+	DispatcherQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dispatcher_queue_wait_seconds",
+		Help:    "Time a request waits on the dispatcher request channel.",
+		Buckets: []float64{.00001, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"type"})
+
+	// DispatcherPendingActivations is the number of the ads waiting for their StartAt
+	DispatcherPendingActivations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dispatcher_pending_activations",
+		Help: "Number of the ads waiting for their StartAt.",
+	})
+
+	// ResponseTimeouts is the number of the requests timed out waiting for the dispatcher response
+	ResponseTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ad_service_response_timeouts_total",
+		Help: "Number of the requests timed out waiting for the dispatcher response.",
+	}, []string{"operation"})
+
+	// ReplicatedLogLag is the number of the versions between the head of the replicated log and the applied version
+	ReplicatedLogLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "replicated_log_consumer_lag",
+		Help: "Versions between the head of the replicated log and the version applied by this instance.",
+	})
+
+	// InMemoryAds is the number of the ads in the in-memory store
+	InMemoryAds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inmem_ads",
+		Help: "Number of the ads in the in-memory store.",
+	})
+
+	// InMemoryIndexNodes is the number of the nodes of the index tree
+	InMemoryIndexNodes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inmem_index_nodes",
+		Help: "Number of the nodes of the index tree.",
+	}, []string{"type"})
+
+	// LockObtainDuration is the latency of obtaining the redis lock, including the retries
+	LockObtainDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "redislock_obtain_duration_seconds",
+		Help:    "Latency of obtaining the redis lock.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1},
+	})
+
+	// LockObtainFailures is the number of the failed attempts to obtain the redis lock
+	LockObtainFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redislock_obtain_failures_total",
+		Help: "Number of the failed attempts to obtain the redis lock.",
+	})
+
+	// DeleteTasks is the number of the handled asynq delete tasks by outcome
+	DeleteTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "asynq_delete_tasks_total",
+		Help: "Number of the handled asynq delete tasks by outcome.",
+	}, []string{"outcome"})
+
+	// TrackingEvents is the number of the tracking events by type and result, the dropped events exceed the buffer
+	TrackingEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_events_total",
+		Help: "Number of the tracking events by type and result.",
+	}, []string{"type", "result"})
+
+	// TrackingFlushDuration is the latency of writing a batch of the aggregated events into the database
+	TrackingFlushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tracking_flush_duration_seconds",
+		Help:    "Latency of writing a batch of the aggregated tracking events.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// FrequencyCappedAds is the number of the candidate ads skipped because the user reached their caps
+	FrequencyCappedAds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "frequency_capped_ads_total",
+		Help: "Number of the candidate ads skipped by the frequency caps.",
+	})
+
+	// FrequencySyncDuration is the latency of syncing the impression counts of the users with redis
+	FrequencySyncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "frequency_sync_duration_seconds",
+		Help:    "Latency of syncing the per user impression counts with redis.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// BudgetThrottledAds is the number of the candidate ads skipped by the budgets, by the exhausted budget or the pacing
+	BudgetThrottledAds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "budget_throttled_ads_total",
+		Help: "Number of the candidate ads skipped by the budgets and the pacing.",
+	}, []string{"reason"})
+
+	// BudgetSyncDuration is the latency of syncing the impression counts of the budgeted ads with redis
+	BudgetSyncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "budget_sync_duration_seconds",
+		Help:    "Latency of syncing the per ad impression counts with redis.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+)
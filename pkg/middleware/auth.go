@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AccessClaims are the claims of the access token, the subject is the principal ID
+type AccessClaims struct {
+	Role model.Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// NewAccessToken signs an access token of the principal with HS256, the token expires after expiry
+func NewAccessToken(secret string, principal *model.Principal, expiry time.Duration) (string, error) {
+	now := time.Now()
+	claims := AccessClaims{
+		Role: principal.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   principal.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiry)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+}
+
+// ParseAccessToken validates the signature and the expiry of the token and returns its principal
+func ParseAccessToken(secret string, token string) (*model.Principal, error) {
+	var claims AccessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	if !claims.Role.Valid() {
+		return nil, fmt.Errorf("token has unknown role %q", claims.Role)
+	}
+	return &model.Principal{ID: claims.Subject, Role: claims.Role}, nil
+}
+
+// AuthMiddleware authenticates the request by the `Authorization: Bearer <token>` header.
+// The principal is put into the context of the request, see model.PrincipalFromContext.
+func AuthMiddleware(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, model.Response{Msg: "missing bearer token"})
+			return
+		}
+		principal, err := ParseAccessToken(secret, token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, model.Response{Msg: err.Error()})
+			return
+		}
+		c.Request = c.Request.WithContext(model.WithPrincipal(c.Request.Context(), principal))
+		c.Next()
+	}
+}
+
+// RequireRoles rejects the principal without one of the roles, it must be used after AuthMiddleware
+func RequireRoles(roles ...model.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := model.PrincipalFromContext(c.Request.Context())
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, model.Response{Msg: "unauthenticated"})
+			return
+		}
+		if !slices.Contains(roles, principal.Role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, model.Response{Msg: fmt.Sprintf("role %s is not allowed", principal.Role)})
+			return
+		}
+		c.Next()
+	}
+}
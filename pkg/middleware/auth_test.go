@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	secret := "access-secret"
+	engine := gin.New()
+	engine.POST("/ad", AuthMiddleware(secret), RequireRoles(model.RoleAdvertiser, model.RoleAdmin), func(c *gin.Context) {
+		principal, ok := model.PrincipalFromContext(c.Request.Context())
+		assert.True(t, ok)
+		c.String(http.StatusOK, principal.ID)
+	})
+
+	token := func(secret string, role model.Role, expiry time.Duration) string {
+		token, err := NewAccessToken(secret, &model.Principal{ID: "user-1", Role: role}, expiry)
+		assert.Nil(t, err)
+		return "Bearer " + token
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		expectStatus  int
+	}{
+		{
+			name:          "advertiser",
+			authorization: token(secret, model.RoleAdvertiser, time.Hour),
+			expectStatus:  http.StatusOK,
+		},
+		{
+			name:          "admin",
+			authorization: token(secret, model.RoleAdmin, time.Hour),
+			expectStatus:  http.StatusOK,
+		},
+		{
+			name:          "reader",
+			authorization: token(secret, model.RoleReader, time.Hour),
+			expectStatus:  http.StatusForbidden,
+		},
+		{
+			name:          "unknown role",
+			authorization: token(secret, model.Role("root"), time.Hour),
+			expectStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "missing token",
+			authorization: "",
+			expectStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "not bearer",
+			authorization: "Basic dXNlcjpwYXNz",
+			expectStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "wrong secret",
+			authorization: token("another-secret", model.RoleAdmin, time.Hour),
+			expectStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "expired",
+			authorization: token(secret, model.RoleAdmin, -time.Minute),
+			expectStatus:  http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/ad", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			engine.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectStatus, w.Code)
+			if tt.expectStatus == http.StatusOK {
+				assert.Equal(t, "user-1", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(MetricsMiddleware())
+	engine.GET("/api/v1/ad/:id", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+	engine.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	for _, path := range []string{"/api/v1/ad/1", "/api/v1/ad/2", "/unknown"} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	// the requests are grouped by the route pattern instead of the path
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/api/v1/ad/:id",status="404"} 2`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`)
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
@@ -17,16 +19,58 @@ var (
 )
 
 type Ad struct {
-	ID       uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
-	Title    string         `gorm:"type:text" json:"title"`
-	Content  string         `gorm:"type:text" json:"content"`
-	StartAt  CustomTime     `gorm:"type:timestamptz" json:"start_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
-	EndAt    CustomTime     `gorm:"type:timestamptz" json:"end_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
-	AgeStart uint8          `gorm:"type:integer" json:"age_start"`
-	AgeEnd   uint8          `gorm:"type:integer" json:"age_end"`
-	Gender   pq.StringArray `gorm:"type:text[]" json:"gender"`
-	Country  pq.StringArray `gorm:"type:text[]" json:"country"`
-	Platform pq.StringArray `gorm:"type:text[]" json:"platform"`
+	ID      uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	Title   string    `gorm:"type:text" json:"title"`
+	Content string    `gorm:"type:text" json:"content"`
+	// LandingURL is where the click on the ad redirects to
+	LandingURL string         `gorm:"type:text" json:"landing_url,omitempty"`
+	StartAt    CustomTime     `gorm:"type:timestamptz" json:"start_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	EndAt      CustomTime     `gorm:"type:timestamptz" json:"end_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	AgeStart   uint8          `gorm:"type:integer" json:"age_start"`
+	AgeEnd     uint8          `gorm:"type:integer" json:"age_end"`
+	Gender     pq.StringArray `gorm:"type:text[]" json:"gender"`
+	Country    pq.StringArray `gorm:"type:text[]" json:"country"`
+	Platform   pq.StringArray `gorm:"type:text[]" json:"platform"`
+	// ExcludeGender, ExcludeCountry and ExcludePlatform are the values the ad is not served to.
+	// If the inclusion list of the field is empty, the ad is served to every value of the field except the excluded ones.
+	ExcludeGender   pq.StringArray `gorm:"type:text[]" json:"exclude_gender,omitempty"`
+	ExcludeCountry  pq.StringArray `gorm:"type:text[]" json:"exclude_country,omitempty"`
+	ExcludePlatform pq.StringArray `gorm:"type:text[]" json:"exclude_platform,omitempty"`
+	// Language is the BCP 47 language tags of the UI the ad is served to, e.g. zh matches zh-TW, empty for every language
+	Language pq.StringArray `gorm:"type:text[]" json:"language,omitempty"`
+	// Region is the ISO 3166-2 subdivisions the ad is served to, e.g. TW-TPE, empty for every region
+	Region pq.StringArray `gorm:"type:text[]" json:"region,omitempty"`
+	// AppVersionStart and AppVersionEnd are the inclusive range of the app versions the ad is served to,
+	// the zero AppVersionEnd is unbounded
+	AppVersionStart AppVersion `gorm:"type:bigint" json:"app_version_min,omitempty" swaggertype:"string" example:"5.12.0"`
+	AppVersionEnd   AppVersion `gorm:"type:bigint" json:"app_version_max,omitempty" swaggertype:"string" example:"6.0.0"`
+	// Targeting is the optional boolean targeting expression of the ad, see the targeting package.
+	// The ad is served to the requests matching both the targeting fields and the expression,
+	// the empty inclusion lists of the fields are left to the expression.
+	Targeting string `gorm:"type:text" json:"targeting,omitempty"`
+	// Schedule is the weekly schedule of the ad in the local time of the viewer, empty to serve the whole StartAt-EndAt window
+	Schedule Schedule `gorm:"type:jsonb" json:"schedule,omitempty"`
+	// Geo is the circles the ad is served in, empty for every location
+	Geo GeoCircles `gorm:"type:jsonb" json:"geo,omitempty"`
+	// Tags is the interests the ad is served to, the ad is served to the viewers with any of the interests
+	// and ranked higher by the number of them, empty for every viewer
+	Tags pq.StringArray `gorm:"type:text[]" json:"tags,omitempty"`
+	// OwnerID is the ID of the principal who created the ad, only the owner and the admins can modify the ad
+	OwnerID string `gorm:"type:text;index" json:"owner_id"`
+	// CampaignID is the campaign of the ad, nil if the ad does not belong to a campaign
+	CampaignID *uuid.UUID `gorm:"type:uuid;index" json:"campaign_id,omitempty"`
+	// CampaignPaused is cascaded from the status of the campaign, the ads of the paused campaigns are not served
+	CampaignPaused bool `gorm:"type:boolean" json:"campaign_paused,omitempty"`
+	// Bid is the CPM bid of the ad
+	Bid float64 `gorm:"type:double precision" json:"bid"`
+	// Rank is computed by the Ranking when the ad is created or updated, the ads of higher ranks are served first
+	Rank int64 `gorm:"type:bigint" json:"rank"`
+	// MaxImpressionsPerUserPerDay is the frequency cap of the ad, 0 if the ad is not capped
+	MaxImpressionsPerUserPerDay uint32 `gorm:"type:integer" json:"max_impressions_per_user_per_day"`
+	// DailyBudget is the impressions of the ad per day, the delivery is paced evenly across the day, 0 if unlimited
+	DailyBudget uint64 `gorm:"type:bigint" json:"daily_budget"`
+	// LifetimeBudget is the impressions of the ad from StartAt to EndAt, 0 if unlimited
+	LifetimeBudget uint64 `gorm:"type:bigint" json:"lifetime_budget"`
 	// Version, cant use sequence number, because the version is not continuous if we want to support update and delete
 	Version   int        `gorm:"index" json:"version"`
 	IsActive  bool       `gorm:"type:boolean; default:true" json:"-" default:"true"`
@@ -36,21 +80,16 @@ type Ad struct {
 // GetValueByKey returns the value of the field with the given key.
 // If the field is a slice, it returns a slice of interfaces.
 // If the field is a single value, it returns a slice of length 1.
-// You can also add custom logic for specific fields, but still return a slice of interfaces.
+// The zero value is appended, so the request without this field matches the ad.
+// The range fields (e.g. AgeStart, AgeEnd) are expanded by IndexField.AdValues.
 func (a *Ad) GetValueByKey(key string) ([]interface{}, error) {
-	v := reflect.ValueOf(*a)
-	fieldVal := v.FieldByName(key)
+	fieldVal := fieldByName(reflect.ValueOf(a).Elem(), key)
 
-	if key == "Age" {
-		slice := make([]interface{}, a.AgeEnd-a.AgeStart+1)
-		for i := a.AgeStart; i <= a.AgeEnd; i++ {
-			slice[i-a.AgeStart] = i
-		}
-		defaultVal := reflect.Zero(reflect.TypeOf(a.AgeStart)).Interface()
-		slice = append(slice, defaultVal)
-		// slice = UniqueSlice(slice)
-		return slice, nil
-	} else if fieldVal.Kind() == reflect.Slice {
+	if !fieldVal.IsValid() {
+		return nil, fmt.Errorf("no such field: %s in obj", key)
+	}
+
+	if fieldVal.Kind() == reflect.Slice {
 		length := fieldVal.Len()
 		slice := make([]interface{}, length)
 		for i := 0; i < length; i++ {
@@ -71,6 +110,55 @@ func (a *Ad) GetValueByKey(key string) ([]interface{}, error) {
 	}
 }
 
+// ExcludedValues returns the excluded values of the field with the given key, nil if the field has no exclusion list
+func (a *Ad) ExcludedValues(key string) []string {
+	fieldVal := fieldByName(reflect.ValueOf(a).Elem(), excludePrefix+key)
+	if !fieldVal.IsValid() || fieldVal.Kind() != reflect.Slice {
+		return nil
+	}
+	values := make([]string, fieldVal.Len())
+	for i := range values {
+		values[i] = fmt.Sprintf("%v", fieldVal.Index(i).Interface())
+	}
+	return values
+}
+
+// Excludes reports whether the value of the field with the given key is excluded by the ad
+func (a *Ad) Excludes(key string, value interface{}) bool {
+	s := fmt.Sprintf("%v", value)
+	for _, v := range a.ExcludedValues(key) {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Constrained reports whether the ad is checked against the request at query time beyond its index keys,
+// by its exclusion lists, its targeting expression, its app version range, its schedule or its circles
+func (a *Ad) Constrained() bool {
+	return len(a.ExcludeGender) > 0 || len(a.ExcludeCountry) > 0 || len(a.ExcludePlatform) > 0 || a.Targeting != "" ||
+		a.AppVersionStart != 0 || a.AppVersionEnd != 0 || len(a.Schedule) > 0 || len(a.Geo) > 0
+}
+
+// ServesAt reports whether now is in the [StartAt, EndAt) window of the ad
+func (a *Ad) ServesAt(now time.Time) bool {
+	return !now.Before(a.StartAt.T()) && now.Before(a.EndAt.T())
+}
+
+// CheckExclusions returns an error if a value is both included and excluded by the ad
+func (a *Ad) CheckExclusions() error {
+	for _, key := range []string{"Gender", "Country", "Platform"} {
+		included, _ := a.GetValueByKey(key)
+		for _, v := range included[:len(included)-1] {
+			if a.Excludes(key, v) {
+				return fmt.Errorf("%v is both included and excluded by %s", v, key)
+			}
+		}
+	}
+	return nil
+}
+
 func UniqueSlice(slice []interface{}) []interface{} {
 	uniqueElements := make(map[interface{}]struct{})
 	var result []interface{}
@@ -83,19 +171,30 @@ func UniqueSlice(slice []interface{}) []interface{} {
 	return result
 }
 
-func (a Ad) GetNextIndexKey(currentKey string) string {
-	switch currentKey {
-	case "":
-		return "Age"
-	case "Age":
-		return "Country"
-	case "Country":
-		return "Platform"
-	case "Platform":
-		return "Gender"
-	default:
-		return ""
+// Score is the ranking score of the ad in the index, the ads are ordered by (Score, ID) ascending,
+// so the score is the negated rank to serve the ads of higher ranks first
+func (a *Ad) Score() int64 {
+	return -a.Rank
+}
+
+// MatchedTags returns the number of the interests of the request the ad is tagged with, case-insensitively
+func (r *GetAdRequest) MatchedTags(ad *Ad) int {
+	n := 0
+	for _, tag := range ad.Tags {
+		for _, interest := range r.Tags {
+			if strings.EqualFold(tag, interest) {
+				n++
+				break
+			}
+		}
 	}
+	return n
+}
+
+// Score is the ranking score of the ad for the request, the score of the ad boosted by its matched tags,
+// the ads are served to the request in the (Score, ID) order
+func (r *GetAdRequest) Score(ad *Ad) int64 {
+	return ad.Score() - int64(r.MatchedTags(ad))*r.TagBoost
 }
 
 func (a *Ad) BeforeCreate(*gorm.DB) (err error) {
@@ -112,14 +211,41 @@ type GetAdRequest struct {
 	Country  string `form:"country" binding:"omitempty,iso3166_1_alpha2"`
 	Gender   string `form:"gender" binding:"omitempty,oneof=M F"`
 	Platform string `form:"platform" binding:"omitempty,oneof=android ios web"`
+	// Language is the BCP 47 language tag of the UI, e.g. zh-TW
+	Language string `form:"language" binding:"omitempty,bcp47_language_tag"`
+	// Region is the ISO 3166-2 subdivision, e.g. TW-TPE
+	Region string `form:"region" binding:"omitempty,iso3166_2"`
+	// AppVersionQuery is the semantic version of the client app, e.g. 5.12.0
+	AppVersionQuery string `form:"app_version" binding:"omitempty,semver"`
+	// AppVersion is the decoded AppVersionQuery, AppVersionStart <= AppVersion <= AppVersionEnd
+	AppVersion AppVersion `form:"-"`
+	// TZ is the IANA time zone of the viewer the schedules of the ads are evaluated in, e.g. Asia/Tokyo
+	TZ string `form:"tz" binding:"omitempty,timezone"`
+	// Location is the loaded TZ, nil if TZ is omitted and the schedules are evaluated in the time zone of the server,
+	// APP_SERVER_TIMEZONE which the bootstrap sets as time.Local
+	Location *time.Location `form:"-"`
+	// Lat and Long are the coordinates of the viewer in degrees, both or neither
+	Lat  *float64 `form:"lat" binding:"required_with=Long,omitempty,gte=-90,lte=90"`
+	Long *float64 `form:"long" binding:"required_with=Lat,omitempty,gte=-180,lte=180"`
+	// Geo is the decoded Lat and Long, nil if the request has no coordinates
+	Geo *GeoPoint `form:"-"`
+	// Tags is the interests of the viewer, the ads with tags are only served if any of them is one of the interests
+	Tags []string `form:"tags" binding:"omitempty,max=20,dive,min=1,max=32"`
+	// TagBoost is the score of every interest of the request an ad is tagged with, set by the service from the ranking
+	TagBoost int64 `form:"-"`
+	// UserID is the user or device the ads are served to, the frequency caps are only enforced if it is set
+	UserID string `form:"user_id" binding:"omitempty,max=128"`
 
 	Offset int `form:"offset,default=0" binding:"min=0"`
 	Limit  int `form:"limit,default=10" binding:"min=1,max=100"`
+	// Cursor is the next_cursor of the previous page, Offset is ignored if it is set
+	Cursor string `form:"cursor"`
+	// After is the decoded Cursor
+	After *AdCursor `form:"-"`
 }
 
 func (r *GetAdRequest) GetValueByKey(key string) (interface{}, error) {
-	v := reflect.ValueOf(*r)
-	fieldVal := v.FieldByName(key)
+	fieldVal := fieldByName(reflect.ValueOf(r).Elem(), key)
 
 	if !fieldVal.IsValid() {
 		return nil, fmt.Errorf("no such field: %s in obj", key)
@@ -133,8 +259,13 @@ func (r *GetAdRequest) GetValueByKey(key string) (interface{}, error) {
 }
 
 type GetAdsPageResponse struct {
-	Ads   []*Ad `json:"ads"`
-	Total int   `json:"total"`
+	Ads []*Ad `json:"ads"`
+	// Total is the number of active ads matching the request, not the page length
+	Total int `json:"total"`
+	// HasMore reports whether there are ads after this page
+	HasMore bool `json:"has_more"`
+	// NextCursor is the cursor of the next page, empty if there is no more ads
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type AsynqDeletePayload struct {
@@ -158,15 +289,250 @@ func (AsynqDeletePayload) TypeName() string {
 }
 
 type CreateAdRequest struct {
-	Title    string     `json:"title" binding:"required,min=5,max=100"`
-	Content  string     `json:"content" binding:"required"`
-	StartAt  CustomTime `json:"start_at" binding:"required" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
-	EndAt    CustomTime `json:"end_at" binding:"required,gtfield=StartAt" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
-	AgeStart uint8      `json:"age_start" binding:"gtefield=AgeStart,lte=100" example:"18"`
-	AgeEnd   uint8      `json:"age_end" binding:"required" example:"65"`
-	Gender   []string   `json:"gender" binding:"required,dive,oneof=M F" example:"F"`
-	Country  []string   `json:"country" binding:"required,dive,iso3166_1_alpha2" example:"TW"`
-	Platform []string   `json:"platform" binding:"required,dive,oneof=android ios web" example:"ios"`
+	Title   string `json:"title" binding:"required,min=5,max=100"`
+	Content string `json:"content" binding:"required"`
+	// LandingURL is where the click on the ad redirects to
+	LandingURL string     `json:"landing_url" binding:"omitempty,url" example:"https://www.dcard.tw"`
+	StartAt    CustomTime `json:"start_at" binding:"required" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	EndAt      CustomTime `json:"end_at" binding:"required,gtfield=StartAt" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	AgeStart   uint8      `json:"age_start" binding:"lte=100" example:"18"`
+	AgeEnd     uint8      `json:"age_end" binding:"required,gtefield=AgeStart,lte=100" example:"65"`
+	Gender     []string   `json:"gender" binding:"required_without_all=ExcludeGender Targeting,dive,oneof=M F" example:"F"`
+	Country    []string   `json:"country" binding:"required_without_all=ExcludeCountry Targeting,dive,iso3166_1_alpha2" example:"TW"`
+	Platform   []string   `json:"platform" binding:"required_without_all=ExcludePlatform Targeting,dive,oneof=android ios web" example:"ios"`
+	// ExcludeGender, ExcludeCountry and ExcludePlatform are the values the ad is not served to,
+	// the inclusion list of the field may be omitted to serve every other value
+	ExcludeGender   []string `json:"exclude_gender" binding:"omitempty,dive,oneof=M F" example:"M"`
+	ExcludeCountry  []string `json:"exclude_country" binding:"omitempty,dive,iso3166_1_alpha2" example:"JP"`
+	ExcludePlatform []string `json:"exclude_platform" binding:"omitempty,dive,oneof=android ios web" example:"web"`
+	// Language and Region are served to every value if omitted
+	Language []string `json:"language" binding:"omitempty,dive,bcp47_language_tag" example:"zh-TW"`
+	Region   []string `json:"region" binding:"omitempty,dive,iso3166_2" example:"TW-TPE"`
+	// AppVersionMin and AppVersionMax are the inclusive range of the app versions, the omitted maximum is unbounded
+	AppVersionMin AppVersion `json:"app_version_min" swaggertype:"string" example:"5.12.0"`
+	AppVersionMax AppVersion `json:"app_version_max" binding:"omitempty,gtefield=AppVersionMin" swaggertype:"string" example:"6.0.0"`
+	// Targeting is the boolean targeting expression, the inclusion lists of the fields may be omitted to leave them to the expression
+	Targeting string `json:"targeting" binding:"omitempty,max=1024,targeting" example:"country IN (TW, JP) AND (platform = ios OR age >= 30)"`
+	// Schedule is the weekly schedule in the local time of the viewer, the ad is served in the whole window if omitted
+	Schedule Schedule `json:"schedule" binding:"omitempty,max=32,dive"`
+	// Geo is the circles the ad is served in, the ad is served in every location if omitted
+	Geo GeoCircles `json:"geo" binding:"omitempty,max=16,dive"`
+	// Tags is the interests the ad is served to, at most 20 case-insensitive tags
+	Tags []string `json:"tags" binding:"omitempty,max=20,uniquefold,dive,min=1,max=32" example:"gaming"`
+	// Bid is the CPM bid of the ad
+	Bid float64 `json:"bid" binding:"gte=0" example:"2.5"`
+	// MaxImpressionsPerUserPerDay is the frequency cap of the ad, 0 if the ad is not capped
+	MaxImpressionsPerUserPerDay uint32 `json:"max_impressions_per_user_per_day" example:"3"`
+	// DailyBudget is the impressions of the ad per day, the delivery is paced evenly across the day, 0 if unlimited
+	DailyBudget uint64 `json:"daily_budget" example:"10000"`
+	// LifetimeBudget is the impressions of the ad from StartAt to EndAt, 0 if unlimited
+	LifetimeBudget uint64 `json:"lifetime_budget" example:"100000"`
+	// CampaignID is the campaign of the ad, the window of the ad must be in the flight dates of the campaign
+	CampaignID *uuid.UUID `json:"campaign_id"`
+}
+
+// UpdateAdRequest is the partial update of an ad, nil fields are left unchanged
+type UpdateAdRequest struct {
+	Title                       *string     `json:"title" binding:"omitempty,min=5,max=100"`
+	Content                     *string     `json:"content" binding:"omitempty,min=1"`
+	LandingURL                  *string     `json:"landing_url" binding:"omitempty,url" example:"https://www.dcard.tw"`
+	StartAt                     *CustomTime `json:"start_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	EndAt                       *CustomTime `json:"end_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	AgeStart                    *uint8      `json:"age_start" binding:"omitempty,lte=100" example:"18"`
+	AgeEnd                      *uint8      `json:"age_end" binding:"omitempty,lte=100" example:"65"`
+	Gender                      []string    `json:"gender" binding:"omitempty,dive,oneof=M F" example:"F"`
+	Country                     []string    `json:"country" binding:"omitempty,dive,iso3166_1_alpha2" example:"TW"`
+	Platform                    []string    `json:"platform" binding:"omitempty,dive,oneof=android ios web" example:"ios"`
+	ExcludeGender               []string    `json:"exclude_gender" binding:"omitempty,dive,oneof=M F" example:"M"`
+	ExcludeCountry              []string    `json:"exclude_country" binding:"omitempty,dive,iso3166_1_alpha2" example:"JP"`
+	ExcludePlatform             []string    `json:"exclude_platform" binding:"omitempty,dive,oneof=android ios web" example:"web"`
+	Language                    []string    `json:"language" binding:"omitempty,dive,bcp47_language_tag" example:"zh-TW"`
+	Region                      []string    `json:"region" binding:"omitempty,dive,iso3166_2" example:"TW-TPE"`
+	AppVersionMin               *AppVersion `json:"app_version_min" swaggertype:"string" example:"5.12.0"`
+	AppVersionMax               *AppVersion `json:"app_version_max" swaggertype:"string" example:"6.0.0"`
+	Targeting                   *string     `json:"targeting" binding:"omitempty,max=1024,targeting" example:"country IN (TW, JP) AND (platform = ios OR age >= 30)"`
+	Schedule                    Schedule    `json:"schedule" binding:"omitempty,max=32,dive"`
+	Geo                         GeoCircles  `json:"geo" binding:"omitempty,max=16,dive"`
+	Tags                        []string    `json:"tags" binding:"omitempty,max=20,uniquefold,dive,min=1,max=32" example:"gaming"`
+	Bid                         *float64    `json:"bid" binding:"omitempty,gte=0" example:"2.5"`
+	MaxImpressionsPerUserPerDay *uint32     `json:"max_impressions_per_user_per_day" example:"3"`
+	DailyBudget                 *uint64     `json:"daily_budget" example:"10000"`
+	LifetimeBudget              *uint64     `json:"lifetime_budget" example:"100000"`
+}
+
+// Apply applies the non-nil fields of the request to the ad
+func (r *UpdateAdRequest) Apply(ad *Ad) {
+	if r.Title != nil {
+		ad.Title = *r.Title
+	}
+	if r.Content != nil {
+		ad.Content = *r.Content
+	}
+	if r.LandingURL != nil {
+		ad.LandingURL = *r.LandingURL
+	}
+	if r.StartAt != nil {
+		ad.StartAt = *r.StartAt
+	}
+	if r.EndAt != nil {
+		ad.EndAt = *r.EndAt
+	}
+	if r.AgeStart != nil {
+		ad.AgeStart = *r.AgeStart
+	}
+	if r.AgeEnd != nil {
+		ad.AgeEnd = *r.AgeEnd
+	}
+	if r.Gender != nil {
+		ad.Gender = r.Gender
+	}
+	if r.Country != nil {
+		ad.Country = r.Country
+	}
+	if r.Platform != nil {
+		ad.Platform = r.Platform
+	}
+	if r.ExcludeGender != nil {
+		ad.ExcludeGender = r.ExcludeGender
+	}
+	if r.ExcludeCountry != nil {
+		ad.ExcludeCountry = r.ExcludeCountry
+	}
+	if r.ExcludePlatform != nil {
+		ad.ExcludePlatform = r.ExcludePlatform
+	}
+	if r.Language != nil {
+		ad.Language = r.Language
+	}
+	if r.Region != nil {
+		ad.Region = r.Region
+	}
+	if r.AppVersionMin != nil {
+		ad.AppVersionStart = *r.AppVersionMin
+	}
+	if r.AppVersionMax != nil {
+		ad.AppVersionEnd = *r.AppVersionMax
+	}
+	if r.Targeting != nil {
+		ad.Targeting = *r.Targeting
+	}
+	if r.Schedule != nil {
+		ad.Schedule = r.Schedule
+	}
+	if r.Geo != nil {
+		ad.Geo = r.Geo
+	}
+	if r.Tags != nil {
+		ad.Tags = r.Tags
+	}
+	if r.Bid != nil {
+		ad.Bid = *r.Bid
+	}
+	if r.MaxImpressionsPerUserPerDay != nil {
+		ad.MaxImpressionsPerUserPerDay = *r.MaxImpressionsPerUserPerDay
+	}
+	if r.DailyBudget != nil {
+		ad.DailyBudget = *r.DailyBudget
+	}
+	if r.LifetimeBudget != nil {
+		ad.LifetimeBudget = *r.LifetimeBudget
+	}
+}
+
+// ToUpdateAdRequest converts the create request into an update request replacing every field
+func (r *CreateAdRequest) ToUpdateAdRequest() *UpdateAdRequest {
+	return &UpdateAdRequest{
+		Title:                       &r.Title,
+		Content:                     &r.Content,
+		LandingURL:                  &r.LandingURL,
+		StartAt:                     &r.StartAt,
+		EndAt:                       &r.EndAt,
+		AgeStart:                    &r.AgeStart,
+		AgeEnd:                      &r.AgeEnd,
+		Gender:                      nonNil(r.Gender),
+		Country:                     nonNil(r.Country),
+		Platform:                    nonNil(r.Platform),
+		ExcludeGender:               nonNil(r.ExcludeGender),
+		ExcludeCountry:              nonNil(r.ExcludeCountry),
+		ExcludePlatform:             nonNil(r.ExcludePlatform),
+		Language:                    nonNil(r.Language),
+		Region:                      nonNil(r.Region),
+		AppVersionMin:               &r.AppVersionMin,
+		AppVersionMax:               &r.AppVersionMax,
+		Targeting:                   &r.Targeting,
+		Schedule:                    nonNilSchedule(r.Schedule),
+		Geo:                         nonNilGeo(r.Geo),
+		Tags:                        nonNil(r.Tags),
+		Bid:                         &r.Bid,
+		MaxImpressionsPerUserPerDay: &r.MaxImpressionsPerUserPerDay,
+		DailyBudget:                 &r.DailyBudget,
+		LifetimeBudget:              &r.LifetimeBudget,
+	}
+}
+
+// ToCreateAdRequest converts the ad into the create request of its fields, so the patched ad is validated as a created one.
+// The empty inclusion and exclusion lists are omitted, so the lists cleared by a patch do not satisfy the required lists.
+func (a *Ad) ToCreateAdRequest() *CreateAdRequest {
+	return &CreateAdRequest{
+		Title:                       a.Title,
+		Content:                     a.Content,
+		LandingURL:                  a.LandingURL,
+		StartAt:                     a.StartAt,
+		EndAt:                       a.EndAt,
+		AgeStart:                    a.AgeStart,
+		AgeEnd:                      a.AgeEnd,
+		Gender:                      nilIfEmpty(a.Gender),
+		Country:                     nilIfEmpty(a.Country),
+		Platform:                    nilIfEmpty(a.Platform),
+		ExcludeGender:               nilIfEmpty(a.ExcludeGender),
+		ExcludeCountry:              nilIfEmpty(a.ExcludeCountry),
+		ExcludePlatform:             nilIfEmpty(a.ExcludePlatform),
+		Language:                    a.Language,
+		Region:                      a.Region,
+		AppVersionMin:               a.AppVersionStart,
+		AppVersionMax:               a.AppVersionEnd,
+		Targeting:                   a.Targeting,
+		Schedule:                    a.Schedule,
+		Geo:                         a.Geo,
+		Tags:                        a.Tags,
+		Bid:                         a.Bid,
+		MaxImpressionsPerUserPerDay: a.MaxImpressionsPerUserPerDay,
+		DailyBudget:                 a.DailyBudget,
+		LifetimeBudget:              a.LifetimeBudget,
+		CampaignID:                  a.CampaignID,
+	}
+}
+
+// nonNil replaces the omitted list by an empty one, so the replacement clears the field
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// nilIfEmpty omits the empty list, the binding counts the empty lists as present
+func nilIfEmpty(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+// nonNilSchedule replaces the omitted schedule by an empty one, so the replacement clears the schedule
+func nonNilSchedule(s Schedule) Schedule {
+	if s == nil {
+		return Schedule{}
+	}
+	return s
+}
+
+// nonNilGeo replaces the omitted circles by an empty list, so the replacement clears the circles
+func nonNilGeo(g GeoCircles) GeoCircles {
+	if g == nil {
+		return GeoCircles{}
+	}
+	return g
 }
 
 type CreateAdResponse struct {
@@ -177,12 +543,20 @@ type CreateAdResponse struct {
 
 type AdService interface {
 	CreateAd(ctx context.Context, ad *Ad) (adID string, er error)
-	GetAds(ctx context.Context, req *GetAdRequest) ([]*Ad, int, error)
+	GetAds(ctx context.Context, req *GetAdRequest) (*GetAdsPageResponse, error)
+	// GetAd returns the active ad with the given ID
+	GetAd(ctx context.Context, adID string) (*Ad, error)
+	// UpdateAd applies the update to the active ad and returns the updated ad
+	UpdateAd(ctx context.Context, adID string, req *UpdateAdRequest) (*Ad, error)
 	DeleteAd(ctx context.Context, adID string) error
-	// Subscribe to the redis stream
+	// Subscribe to the replicated log
 	Subscribe() error
 	Restore() error
 	Run() error
+	// SetCampaignStatus changes the status of the campaign and cascades it to the ads of the campaign through the replicated log
+	SetCampaignStatus(ctx context.Context, campaignID string, status CampaignStatus) (*Campaign, error)
+	// Ready returns nil if the store is restored and the subscriber is within maxLag versions of the replicated log
+	Ready(ctx context.Context, maxLag int64) error
 	Shutdown(ctx context.Context) error
 }
 
@@ -194,7 +568,13 @@ type TaskService interface {
 type InMemoryStore interface {
 	CreateAd(ad *Ad) (string, error)
 	GetAds(req *GetAdRequest) ([]*Ad, int, error)
+	// GetAdByID returns the ad with the given ID, or ErrNoAdsFound if the ad is not served
+	GetAdByID(adID string) (*Ad, error)
+	// UpdateAd replaces the ad with the same ID and re-indexes it
+	UpdateAd(ad *Ad) error
 	DeleteAd(adID string) error
+	// ListAds returns all the ads in the store, it is used to take the snapshot
+	ListAds() []*Ad
 	// Restore the ads from the db, and return the highest version in the store
 	CreateBatchAds(ads []*Ad) (err error)
 }
@@ -0,0 +1,67 @@
+package model
+
+import "context"
+
+// Role is the role of the authenticated principal
+type Role string
+
+const (
+	// RoleAdmin can create, modify and delete every ad
+	RoleAdmin Role = "admin"
+	// RoleAdvertiser can create ads, and modify or delete the ads it owns
+	RoleAdvertiser Role = "advertiser"
+	// RoleReader can only read the ads
+	RoleReader Role = "reader"
+)
+
+// Valid reports whether r is one of the known roles
+func (r Role) Valid() bool {
+	switch r {
+	case RoleAdmin, RoleAdvertiser, RoleReader:
+		return true
+	default:
+		return false
+	}
+}
+
+// Principal is the authenticated caller, ID is the subject of the token
+type Principal struct {
+	ID   string `json:"id"`
+	Role Role   `json:"role"`
+}
+
+// CanWrite reports whether the principal can create ads
+func (p *Principal) CanWrite() bool {
+	return p.Role == RoleAdmin || p.Role == RoleAdvertiser
+}
+
+// CanModify reports whether the principal can update or delete the ad
+func (p *Principal) CanModify(ad *Ad) bool {
+	return p.Owns(ad.OwnerID)
+}
+
+// Owns reports whether the principal can manage the resources owned by ownerID, e.g. the ads and the advertisers
+func (p *Principal) Owns(ownerID string) bool {
+	switch p.Role {
+	case RoleAdmin:
+		return true
+	case RoleAdvertiser:
+		return ownerID == p.ID
+	default:
+		return false
+	}
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal carried by ctx.
+// It returns false for the internal callers, e.g. the scheduled delete task, which are not subject to the ownership checks.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
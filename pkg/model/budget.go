@@ -0,0 +1,15 @@
+package model
+
+import "context"
+
+// BudgetPacer enforces the impression budgets of the ads, see Ad.DailyBudget and Ad.LifetimeBudget
+type BudgetPacer interface {
+	// Filter returns the ads which are within their budgets and not throttled by the pacing, in the same order
+	Filter(ctx context.Context, ads []*Ad) []*Ad
+	// Record counts an impression of every budgeted ad served
+	Record(ctx context.Context, ads []*Ad)
+	// Run syncs the counts with the other replicas until Close is called
+	Run()
+	// Close syncs the pending counts and stops Run
+	Close(ctx context.Context) error
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CampaignStatus is the state of a campaign, the status of a campaign cascades to all of its ads
+type CampaignStatus string
+
+const (
+	// CampaignStatusActive serves the ads of the campaign
+	CampaignStatusActive CampaignStatus = "active"
+	// CampaignStatusPaused keeps the ads of the campaign but stops serving them until the campaign is resumed
+	CampaignStatusPaused CampaignStatus = "paused"
+	// CampaignStatusEnded takes down all the ads of the campaign, an ended campaign can not be resumed
+	CampaignStatusEnded CampaignStatus = "ended"
+)
+
+// Advertiser owns the campaigns, OwnerID is the ID of the principal who manages the advertiser
+type Advertiser struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	Name      string     `gorm:"type:text" json:"name"`
+	OwnerID   string     `gorm:"type:text;index" json:"owner_id"`
+	CreatedAt CustomTime `gorm:"type:timestamptz" json:"created_at"`
+}
+
+func (a *Advertiser) BeforeCreate(*gorm.DB) (err error) {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return
+}
+
+// Campaign groups the ads of an advertiser, the ads of the campaign must be in its flight dates [StartAt, EndAt]
+type Campaign struct {
+	ID           uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
+	AdvertiserID uuid.UUID      `gorm:"type:uuid;index" json:"advertiser_id"`
+	Name         string         `gorm:"type:text" json:"name"`
+	StartAt      CustomTime     `gorm:"type:timestamptz" json:"start_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	EndAt        CustomTime     `gorm:"type:timestamptz" json:"end_at" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	Status       CampaignStatus `gorm:"type:text" json:"status"`
+	CreatedAt    CustomTime     `gorm:"type:timestamptz" json:"created_at"`
+}
+
+func (c *Campaign) BeforeCreate(*gorm.DB) (err error) {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return
+}
+
+// Contains reports whether the window of the ad is in the flight dates of the campaign
+func (c *Campaign) Contains(ad *Ad) bool {
+	return !ad.StartAt.T().Before(c.StartAt.T()) && !ad.EndAt.T().After(c.EndAt.T())
+}
+
+type CreateAdvertiserRequest struct {
+	Name string `json:"name" binding:"required,min=1,max=100"`
+	// OwnerID is the principal managing the advertiser, only the admins can set it, it defaults to the caller
+	OwnerID string `json:"owner_id"`
+}
+
+type CreateCampaignRequest struct {
+	AdvertiserID uuid.UUID  `json:"advertiser_id" binding:"required"`
+	Name         string     `json:"name" binding:"required,min=1,max=100"`
+	StartAt      CustomTime `json:"start_at" binding:"required" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+	EndAt        CustomTime `json:"end_at" binding:"required,gtfield=StartAt" swaggertype:"string" format:"date" example:"2006-01-02 15:04:05 +0800 CST"`
+}
+
+type CampaignService interface {
+	CreateAdvertiser(ctx context.Context, req *CreateAdvertiserRequest) (*Advertiser, error)
+	CreateCampaign(ctx context.Context, req *CreateCampaignRequest) (*Campaign, error)
+	GetCampaign(ctx context.Context, campaignID string) (*Campaign, error)
+	// SetCampaignStatus pauses, resumes or ends the campaign, the status cascades to all of its ads
+	SetCampaignStatus(ctx context.Context, campaignID string, status CampaignStatus) (*Campaign, error)
+}
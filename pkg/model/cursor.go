@@ -0,0 +1,41 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	// ErrInvalidCursor is returned when the cursor can not be decoded, 400
+	ErrInvalidCursor = fmt.Errorf("invalid cursor")
+)
+
+// AdCursor is the position of the last ad of a page.
+// Ads are ordered by (Score, ID) in the index, so the next page starts right after the cursor
+// no matter how many ads are inserted or expired between the page fetches.
+type AdCursor struct {
+	Score int64  `json:"s"`
+	AdID  string `json:"id"`
+	// Version is the stream version of the replica that issued the cursor
+	Version int64 `json:"v"`
+}
+
+// Encode encodes the cursor into an opaque url-safe string
+func (c *AdCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeAdCursor decodes the cursor encoded by AdCursor.Encode
+func DecodeAdCursor(s string) (*AdCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c AdCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.AdID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
@@ -0,0 +1,16 @@
+package model
+
+import "context"
+
+// FrequencyCapper caps the impressions of the ads served to a user per day,
+// see Ad.MaxImpressionsPerUserPerDay
+type FrequencyCapper interface {
+	// Filter returns the ads which the user has not reached the caps of, in the same order
+	Filter(ctx context.Context, userID string, ads []*Ad) []*Ad
+	// Record counts an impression of every capped ad served to the user
+	Record(ctx context.Context, userID string, ads []*Ad)
+	// Run syncs the counts with the other replicas until Close is called
+	Run()
+	// Close syncs the pending counts and stops Run
+	Close(ctx context.Context) error
+}
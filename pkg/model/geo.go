@@ -0,0 +1,153 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// GeoCellDegrees is the size of the grid cells the stores index the circles by in degrees, about 28km of latitude
+	GeoCellDegrees = 0.25
+	// MaxGeoRadiusKm bounds the radius of the circles, so a circle is covered by a few cells
+	MaxGeoRadiusKm = 50
+
+	earthRadiusKm = 6371.0
+	kmPerDegree   = math.Pi * earthRadiusKm / 180
+	geoLatCells   = int32(180 / GeoCellDegrees)
+	geoLongCells  = int32(360 / GeoCellDegrees)
+)
+
+// GeoPoint is the coordinates of the viewer in degrees
+type GeoPoint struct {
+	Lat  float64
+	Long float64
+}
+
+// Cell returns the grid cell containing the point
+func (p GeoPoint) Cell() GeoCell {
+	return GeoCell{Lat: latCell(p.Lat), Long: longCell(p.Long)}
+}
+
+// GeoCircle is the area within RadiusKm of the center (Lat, Long) the ad is served in
+type GeoCircle struct {
+	Lat      float64 `json:"lat" binding:"gte=-90,lte=90" example:"25.0330"`
+	Long     float64 `json:"long" binding:"gte=-180,lte=180" example:"121.5654"`
+	RadiusKm float64 `json:"radius_km" binding:"gt=0,lte=50" example:"3"`
+}
+
+// Contains reports whether the great-circle distance from the center to the point is within the radius
+func (c GeoCircle) Contains(p GeoPoint) bool {
+	return distanceKm(c.Lat, c.Long, p.Lat, p.Long) <= c.RadiusKm
+}
+
+// Cells returns the grid cells covering the bounding box of the circle,
+// every longitude is covered if the box reaches a pole
+func (c GeoCircle) Cells() []GeoCell {
+	latDelta := c.RadiusKm / kmPerDegree
+	south, north := c.Lat-latDelta, c.Lat+latDelta
+	latFrom, latTo := latCell(south), latCell(north)
+	if south <= -90 || north >= 90 {
+		return cellsOf(latFrom, latTo, 0, geoLongCells-1)
+	}
+	longDelta := latDelta / math.Cos(max(math.Abs(south), math.Abs(north))*math.Pi/180)
+	if longDelta >= 180 {
+		return cellsOf(latFrom, latTo, 0, geoLongCells-1)
+	}
+	longFrom, longTo := longCell(c.Long-longDelta), longCell(c.Long+longDelta)
+	if longFrom > longTo {
+		// across the antimeridian
+		return append(cellsOf(latFrom, latTo, longFrom, geoLongCells-1), cellsOf(latFrom, latTo, 0, longTo)...)
+	}
+	return cellsOf(latFrom, latTo, longFrom, longTo)
+}
+
+// GeoCircles is the areas an ad is served in, the empty list serves every location
+type GeoCircles []GeoCircle
+
+// Contains reports whether any of the circles contains the point
+func (g GeoCircles) Contains(p GeoPoint) bool {
+	for _, c := range g {
+		if c.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cells returns the distinct grid cells covering the circles
+func (g GeoCircles) Cells() []GeoCell {
+	seen := make(map[GeoCell]struct{})
+	cells := make([]GeoCell, 0)
+	for _, c := range g {
+		for _, cell := range c.Cells() {
+			if _, ok := seen[cell]; !ok {
+				seen[cell] = struct{}{}
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
+
+// Value stores the circles as JSON, NULL if there are none
+func (g GeoCircles) Value() (driver.Value, error) {
+	if len(g) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(g)
+}
+
+func (g *GeoCircles) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*g = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, g)
+	case string:
+		return json.Unmarshal([]byte(v), g)
+	default:
+		return errors.New("type conversion to GeoCircles failed")
+	}
+}
+
+// GeoCell is the cell of the grid of GeoCellDegrees the stores index the circles by
+// at the Lat-th row from the south pole and the Long-th column from the antimeridian
+type GeoCell struct {
+	Lat  int32
+	Long int32
+}
+
+func (c GeoCell) String() string {
+	return fmt.Sprintf("geo:%d:%d", c.Lat, c.Long)
+}
+
+func latCell(lat float64) int32 {
+	return min(max(int32(math.Floor((lat+90)/GeoCellDegrees)), 0), geoLatCells-1)
+}
+
+func longCell(long float64) int32 {
+	cell := int32(math.Floor((long + 180) / GeoCellDegrees))
+	return (cell%geoLongCells + geoLongCells) % geoLongCells
+}
+
+func cellsOf(latFrom, latTo, longFrom, longTo int32) []GeoCell {
+	cells := make([]GeoCell, 0, (latTo-latFrom+1)*(longTo-longFrom+1))
+	for lat := latFrom; lat <= latTo; lat++ {
+		for long := longFrom; long <= longTo; long++ {
+			cells = append(cells, GeoCell{Lat: lat, Long: long})
+		}
+	}
+	return cells
+}
+
+// distanceKm returns the great-circle distance between the coordinates by the haversine formula
+func distanceKm(lat1, long1, lat2, long2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat, dLong := (lat2-lat1)*rad, (long2-long1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoCircle_Contains(t *testing.T) {
+	// Taipei 101 to Taipei Main Station is about 5km
+	taipei101 := GeoCircle{Lat: 25.0340, Long: 121.5645, RadiusKm: 5.5}
+	station := GeoPoint{Lat: 25.0478, Long: 121.5170}
+	assert.True(t, taipei101.Contains(station))
+	taipei101.RadiusKm = 4.5
+	assert.False(t, taipei101.Contains(station))
+
+	// the distance is across the antimeridian
+	assert.True(t, GeoCircle{Lat: 0, Long: 179.99, RadiusKm: 3}.Contains(GeoPoint{Lat: 0, Long: -179.99}))
+}
+
+func TestGeoCircle_Cells(t *testing.T) {
+	c := GeoCircle{Lat: 25.0340, Long: 121.5645, RadiusKm: 5}
+	cells := c.Cells()
+	assert.Contains(t, cells, GeoPoint{Lat: c.Lat, Long: c.Long}.Cell())
+	assert.LessOrEqual(t, len(cells), 4)
+
+	// the cells across the antimeridian wrap around
+	cells = GeoCircle{Lat: 0, Long: 179.99, RadiusKm: 3}.Cells()
+	assert.Contains(t, cells, GeoPoint{Lat: 0, Long: 179.99}.Cell())
+	assert.Contains(t, cells, GeoPoint{Lat: 0, Long: -179.99}.Cell())
+
+	// the circle around a pole covers every longitude
+	cells = GeoCircle{Lat: 89.9, Long: 0, RadiusKm: 30}.Cells()
+	assert.Contains(t, cells, GeoPoint{Lat: 89.9, Long: 180}.Cell())
+	assert.Contains(t, cells, GeoPoint{Lat: 90, Long: -90}.Cell())
+
+	// every point in the circle is in a covering cell
+	for i := 0; i < 1000; i++ {
+		c := GeoCircle{Lat: rand.Float64()*178 - 89, Long: rand.Float64()*360 - 180, RadiusKm: 1 + rand.Float64()*(MaxGeoRadiusKm-1)}
+		cells := GeoCircles{c}.Cells()
+		for j := 0; j < 20; j++ {
+			p := GeoPoint{Lat: c.Lat + (rand.Float64()*2-1)*0.5, Long: c.Long + (rand.Float64()*2-1)*0.5}
+			if c.Contains(p) {
+				assert.Contains(t, cells, p.Cell(), "%+v in %+v", p, c)
+			}
+		}
+	}
+}
+
+func TestGeoCircles_Value(t *testing.T) {
+	v, err := GeoCircles(nil).Value()
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+
+	g := GeoCircles{{Lat: 25.033, Long: 121.5654, RadiusKm: 3}}
+	v, err = g.Value()
+	assert.Nil(t, err)
+	var scanned GeoCircles
+	assert.Nil(t, scanned.Scan(v))
+	assert.Equal(t, g, scanned)
+}
@@ -0,0 +1,11 @@
+package model
+
+import "context"
+
+type HealthService interface {
+	// Live returns nil if the process is able to serve
+	Live(ctx context.Context) error
+	// Ready returns nil if the instance is ready to receive the traffic,
+	// i.e. the dependencies are reachable and the in-memory store is up to date
+	Ready(ctx context.Context) error
+}
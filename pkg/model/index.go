@@ -0,0 +1,459 @@
+package model
+
+import (
+	"fmt"
+	"math/bits"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IndexStrategy is how the value of an ad field is expanded into the index keys
+type IndexStrategy string
+
+const (
+	// IndexStrategyRange indexes every integer in [<Key>Start, <Key>End] of the ad
+	IndexStrategyRange IndexStrategy = "range"
+	// IndexStrategyInterval indexes the aligned power-of-two blocks covering [<Key>Start, <Key>End] of the ad,
+	// see IndexInterval
+	IndexStrategyInterval IndexStrategy = "interval"
+	// IndexStrategyMulti indexes every element of the slice field <Key> of the ad
+	IndexStrategyMulti IndexStrategy = "multi"
+	// IndexStrategyScalar indexes the single value field <Key> of the ad
+	IndexStrategyScalar IndexStrategy = "scalar"
+	// IndexStrategyPrefix indexes every element of the hierarchical string slice field <Key> of the ad,
+	// or IndexAnyValue if the slice is empty, and the request matches the elements which are its prefixes, see prefixes
+	IndexStrategyPrefix IndexStrategy = "prefix"
+	// IndexStrategyTags indexes the ads without the string slice field <Key> by IndexAnyValue, and the others by the zero value.
+	// The requests with the field only look up IndexAnyValue, the tagged ads matching them are found by the tag index of the store.
+	IndexStrategyTags IndexStrategy = "tags"
+
+	defaultIndexLayout = "Country:multi,Platform:multi,Gender:multi,Language:prefix,Region:prefix,Tags:tags,Age:interval"
+
+	// maxIntervalLevel bounds the block size of the interval strategy to 2^maxIntervalLevel
+	maxIntervalLevel = 62
+
+	// excludePrefix is the prefix of the exclusion list of a multi field, e.g. ExcludeCountry of Country
+	excludePrefix = "Exclude"
+)
+
+var (
+	// ErrInvalidIndexLayout is returned when the index layout does not match the fields of Ad and GetAdRequest
+	ErrInvalidIndexLayout = fmt.Errorf("invalid index layout")
+
+	adType       = reflect.TypeOf(Ad{})
+	getAdReqType = reflect.TypeOf(GetAdRequest{})
+
+	// IndexAnyValue is the index key of the ads serving every value of a multi field except their excluded ones,
+	// so the exclusions are not expanded to the full complement of the values.
+	// The requests with a value of the field match the ads under this key too.
+	IndexAnyValue interface{} = anyValue{}
+
+	// fieldIndexes caches the indexes of the fields of Ad and GetAdRequest by fieldKey, see fieldByName
+	fieldIndexes sync.Map
+)
+
+type fieldKey struct {
+	t    reflect.Type
+	name string
+}
+
+type anyValue struct{}
+
+func (anyValue) String() string {
+	return "*"
+}
+
+// upperBounded is implemented by the types of the range fields whose zero end is unbounded, e.g. AppVersion
+type upperBounded interface {
+	UpperBound() int64
+}
+
+// IndexInterval is an index key of the interval strategy, the block [Start, End] of 2^n integers aligned to its size.
+// A range is covered by at most 2 blocks of every size (the canonical segments of a segment tree),
+// e.g. [18, 65] is covered by [18, 19], [20, 23], [24, 31], [32, 63] and [64, 65] instead of 48 keys,
+// and a value is contained by one block of every size, so the request looks up one key per size.
+// The blocks covering a range are disjoint, so an ad is found under exactly one of the keys of a request.
+type IndexInterval struct {
+	Start int64
+	End   int64
+}
+
+func (i IndexInterval) String() string {
+	return "[" + strconv.FormatInt(i.Start, 10) + "," + strconv.FormatInt(i.End, 10) + "]"
+}
+
+// coveringIntervals returns the largest aligned blocks covering [from, to] in ascending order,
+// the size of the blocks is at most 2^maxLevel
+func coveringIntervals(from, to int64, maxLevel int) []IndexInterval {
+	intervals := make([]IndexInterval, 0)
+	for from <= to {
+		level := 0
+		for level < maxLevel {
+			size := int64(1) << (level + 1)
+			if from&(size-1) != 0 || to-from < size-1 {
+				break
+			}
+			level++
+		}
+		end := from + int64(1)<<level - 1
+		intervals = append(intervals, IndexInterval{Start: from, End: end})
+		if end == to {
+			break
+		}
+		from = end + 1
+	}
+	return intervals
+}
+
+// containingIntervals returns the aligned blocks containing v from the smallest one, up to the size of 2^maxLevel
+func containingIntervals(v int64, maxLevel int) []IndexInterval {
+	intervals := make([]IndexInterval, 0, maxLevel+1)
+	for level := 0; level <= maxLevel; level++ {
+		size := int64(1) << level
+		start := v &^ (size - 1)
+		intervals = append(intervals, IndexInterval{Start: start, End: start + size - 1})
+	}
+	return intervals
+}
+
+// IndexField is a level of the index tree.
+// Key is the field name of GetAdRequest, and the field name (or the prefix of the range fields) of Ad.
+type IndexField struct {
+	Key      string
+	Strategy IndexStrategy
+}
+
+// IndexLayout is the ordered index fields from the root of the index tree to the leaves.
+// The more selective fields should come first.
+type IndexLayout []IndexField
+
+// DefaultIndexLayout returns Country -> Platform -> Gender -> Language -> Region -> Tags -> Age.
+// The interval level is the last since a request looks up a block of every size on it,
+// and the subtrees of the blocks are merged.
+// The app versions are not indexed, since the tree keeps a leaf entry per combination of the keys of an ad
+// and an open-ended version range is covered by tens of blocks, the store checks them at query time instead.
+// The circles of the ads are not indexed in the tree either, the geo index of the store checks them.
+func DefaultIndexLayout() IndexLayout {
+	layout, _ := ParseIndexLayout(defaultIndexLayout)
+	return layout
+}
+
+// ParseIndexLayout parses the layout in the form of `Key:strategy,Key:strategy,...`,
+// e.g. `Country:multi,Platform:multi,Gender:multi,Age:interval`
+func ParseIndexLayout(s string) (IndexLayout, error) {
+	layout := IndexLayout{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, strategy, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing strategy of %s", ErrInvalidIndexLayout, part)
+		}
+		layout = append(layout, IndexField{
+			Key:      strings.TrimSpace(key),
+			Strategy: IndexStrategy(strings.TrimSpace(strategy)),
+		})
+	}
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// Validate checks the fields of the layout exist in Ad and GetAdRequest with the kinds of their strategies
+func (l IndexLayout) Validate() error {
+	seen := map[string]struct{}{}
+	for _, f := range l {
+		if _, ok := seen[f.Key]; ok {
+			return fmt.Errorf("%w: duplicated key %s", ErrInvalidIndexLayout, f.Key)
+		}
+		seen[f.Key] = struct{}{}
+		if _, ok := getAdReqType.FieldByName(f.Key); !ok {
+			return fmt.Errorf("%w: GetAdRequest has no field %s", ErrInvalidIndexLayout, f.Key)
+		}
+		switch f.Strategy {
+		case IndexStrategyRange, IndexStrategyInterval:
+			for _, name := range []string{f.Key + "Start", f.Key + "End"} {
+				field, ok := adType.FieldByName(name)
+				if !ok || !isInteger(field.Type.Kind()) {
+					return fmt.Errorf("%w: Ad has no integer field %s", ErrInvalidIndexLayout, name)
+				}
+				if _, unbounded := reflect.Zero(field.Type).Interface().(upperBounded); unbounded && f.Strategy == IndexStrategyRange {
+					return fmt.Errorf("%w: the unbounded range %s can not be expanded by the range strategy", ErrInvalidIndexLayout, f.Key)
+				}
+			}
+		case IndexStrategyMulti:
+			field, ok := adType.FieldByName(f.Key)
+			if !ok || field.Type.Kind() != reflect.Slice {
+				return fmt.Errorf("%w: Ad has no slice field %s", ErrInvalidIndexLayout, f.Key)
+			}
+		case IndexStrategyPrefix:
+			field, ok := adType.FieldByName(f.Key)
+			if !ok || field.Type.Kind() != reflect.Slice || field.Type.Elem().Kind() != reflect.String {
+				return fmt.Errorf("%w: Ad has no string slice field %s", ErrInvalidIndexLayout, f.Key)
+			}
+			if field, _ := getAdReqType.FieldByName(f.Key); field.Type.Kind() != reflect.String {
+				return fmt.Errorf("%w: GetAdRequest has no string field %s", ErrInvalidIndexLayout, f.Key)
+			}
+		case IndexStrategyTags:
+			field, ok := adType.FieldByName(f.Key)
+			if !ok || field.Type.Kind() != reflect.Slice || field.Type.Elem().Kind() != reflect.String {
+				return fmt.Errorf("%w: Ad has no string slice field %s", ErrInvalidIndexLayout, f.Key)
+			}
+			if field, _ := getAdReqType.FieldByName(f.Key); field.Type.Kind() != reflect.Slice || field.Type.Elem().Kind() != reflect.String {
+				return fmt.Errorf("%w: GetAdRequest has no string slice field %s", ErrInvalidIndexLayout, f.Key)
+			}
+		case IndexStrategyScalar:
+			field, ok := adType.FieldByName(f.Key)
+			if !ok || field.Type.Kind() == reflect.Slice {
+				return fmt.Errorf("%w: Ad has no scalar field %s", ErrInvalidIndexLayout, f.Key)
+			}
+		default:
+			return fmt.Errorf("%w: unknown strategy %s of %s", ErrInvalidIndexLayout, f.Strategy, f.Key)
+		}
+	}
+	return nil
+}
+
+func (l IndexLayout) String() string {
+	parts := make([]string, len(l))
+	for i, f := range l {
+		parts[i] = fmt.Sprintf("%s:%s", f.Key, f.Strategy)
+	}
+	return strings.Join(parts, ",")
+}
+
+// AdValues returns the index keys of the ad on this field.
+// The zero value is appended, so the request without this field matches the ad,
+// except for the keys the request without this field looks up anyway (see RequestValues),
+// the whole range of the interval strategy and IndexAnyValue of the prefix strategy.
+// The ad with tags is only indexed by the zero value of the tags strategy.
+// The ad with an empty inclusion list is indexed by IndexAnyValue if it has a non-empty exclusion list
+// or a targeting expression, which constrain the field instead.
+// The zero end of an unbounded range (see upperBounded) is its upper bound.
+func (f IndexField) AdValues(ad *Ad) ([]interface{}, error) {
+	switch f.Strategy {
+	case IndexStrategyPrefix:
+		return prefixAdValues(ad, f.Key)
+	case IndexStrategyTags:
+		fieldVal := fieldByName(reflect.ValueOf(ad).Elem(), f.Key)
+		if !fieldVal.IsValid() || fieldVal.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("no such slice field: %s in obj", f.Key)
+		}
+		if fieldVal.Len() == 0 {
+			return []interface{}{IndexAnyValue}, nil
+		}
+		return []interface{}{""}, nil
+	}
+	if f.Strategy != IndexStrategyRange && f.Strategy != IndexStrategyInterval {
+		values, err := ad.GetValueByKey(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		if f.Excludable() && len(values) == 1 && (len(ad.ExcludedValues(f.Key)) > 0 || ad.Targeting != "") {
+			values = append([]interface{}{IndexAnyValue}, values...)
+		}
+		return values, nil
+	}
+	v := reflect.ValueOf(ad).Elem()
+	start, end := fieldByName(v, f.Key+"Start"), fieldByName(v, f.Key+"End")
+	if !start.IsValid() || !end.IsValid() {
+		return nil, fmt.Errorf("no such range field: %s in obj", f.Key)
+	}
+	from, to := toInt64(start), toInt64(end)
+	if b, ok := end.Interface().(upperBounded); ok && to == 0 {
+		to = b.UpperBound()
+	}
+	if f.Strategy == IndexStrategyInterval {
+		slice := make([]interface{}, 0)
+		if from <= to {
+			for _, i := range coveringIntervals(from, to, intervalLevels(start.Type())) {
+				slice = append(slice, i)
+			}
+		}
+		if len(slice) == 1 && slice[0] == wholeInterval(start.Type()) {
+			return slice, nil
+		}
+		slice = append(slice, reflect.Zero(start.Type()).Interface())
+		return slice, nil
+	}
+	slice := make([]interface{}, 0, max(to-from+2, 1))
+	for i := from; i <= to; i++ {
+		slice = append(slice, reflect.ValueOf(i).Convert(start.Type()).Interface())
+	}
+	slice = append(slice, reflect.Zero(start.Type()).Interface())
+	return slice, nil
+}
+
+// Excludable reports whether Ad has the exclusion list of this field, only the multi fields can be excluded
+func (f IndexField) Excludable() bool {
+	if f.Strategy != IndexStrategyMulti {
+		return false
+	}
+	field, ok := adType.FieldByName(excludePrefix + f.Key)
+	return ok && field.Type.Kind() == reflect.Slice
+}
+
+// RequestValues returns the index keys the request looks up on this field, the ads under any of the keys match the request.
+// The request without this field looks up the zero value, and the keys of the ads serving every value of the field,
+// the whole range of the interval strategy and IndexAnyValue of the prefix and tags strategies, which are not indexed by the zero value.
+// The request with tags only looks up IndexAnyValue of the tags strategy.
+func (f IndexField) RequestValues(req *GetAdRequest) ([]interface{}, error) {
+	value, err := req.GetValueByKey(f.Key)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(value)
+	if f.Strategy == IndexStrategyTags {
+		if rv.Len() == 0 {
+			return []interface{}{"", IndexAnyValue}, nil
+		}
+		return []interface{}{IndexAnyValue}, nil
+	}
+	if rv.IsZero() {
+		switch {
+		case f.Strategy == IndexStrategyInterval && isInteger(rv.Kind()):
+			return []interface{}{value, wholeInterval(rv.Type())}, nil
+		case f.Strategy == IndexStrategyPrefix:
+			return []interface{}{value, IndexAnyValue}, nil
+		default:
+			return []interface{}{value}, nil
+		}
+	}
+	switch {
+	case f.Strategy == IndexStrategyInterval && isInteger(rv.Kind()):
+		intervals := containingIntervals(toInt64(rv), intervalLevels(rv.Type()))
+		values := make([]interface{}, len(intervals))
+		for i, interval := range intervals {
+			values[i] = interval
+		}
+		return values, nil
+	case f.Strategy == IndexStrategyPrefix:
+		values := make([]interface{}, 0)
+		for _, p := range prefixes(strings.ToLower(rv.String())) {
+			values = append(values, p)
+		}
+		return append(values, IndexAnyValue), nil
+	case f.Excludable():
+		return []interface{}{value, IndexAnyValue}, nil
+	default:
+		return []interface{}{value}, nil
+	}
+}
+
+// Match reports whether the ad is indexed under any of the keys of RequestValues of a request on this field,
+// the keys are passed in so they are computed once for the ads matched against the same request
+func (f IndexField) Match(ad *Ad, reqValues []interface{}) (bool, error) {
+	adValues, err := f.AdValues(ad)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range reqValues {
+		for _, w := range adValues {
+			if v == w {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// intervalLevels returns the level of the largest block of the interval strategy for the integer type
+func intervalLevels(t reflect.Type) int {
+	if b, ok := reflect.Zero(t).Interface().(upperBounded); ok {
+		return bits.Len64(uint64(b.UpperBound()))
+	}
+	return min(t.Bits(), maxIntervalLevel)
+}
+
+// wholeInterval returns the block of the interval strategy containing every value of the integer type
+func wholeInterval(t reflect.Type) IndexInterval {
+	return IndexInterval{Start: 0, End: int64(1)<<intervalLevels(t) - 1}
+}
+
+// prefixAdValues returns the index keys of the prefix strategy, the lower-cased elements of the field,
+// without the ones under another element (e.g. zh-tw under zh), so the ad is found under at most one of the keys of a request.
+func prefixAdValues(ad *Ad, key string) ([]interface{}, error) {
+	fieldVal := fieldByName(reflect.ValueOf(ad).Elem(), key)
+	if !fieldVal.IsValid() || fieldVal.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("no such slice field: %s in obj", key)
+	}
+	elements := make(map[string]struct{}, fieldVal.Len())
+	for i := 0; i < fieldVal.Len(); i++ {
+		elements[strings.ToLower(fieldVal.Index(i).String())] = struct{}{}
+	}
+	values := make([]interface{}, 0, len(elements)+1)
+	seen := make(map[string]struct{}, len(elements))
+	for i := 0; i < fieldVal.Len(); i++ {
+		v := strings.ToLower(fieldVal.Index(i).String())
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		covered := false
+		for _, p := range prefixes(v)[1:] {
+			if _, ok := elements[p]; ok {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return []interface{}{IndexAnyValue}, nil
+	}
+	return append(values, ""), nil
+}
+
+// prefixes returns the value and its prefixes ending before a '-' from the longest one,
+// e.g. zh-hant-tw, zh-hant and zh of the language tag zh-hant-tw, or tw-tpe and tw of the region tw-tpe.
+func prefixes(v string) []string {
+	ret := []string{v}
+	for i := len(v) - 1; i > 0; i-- {
+		if v[i] == '-' {
+			ret = append(ret, v[:i])
+		}
+	}
+	return ret
+}
+
+func isInteger(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	default:
+		return false
+	}
+}
+
+func toInt64(v reflect.Value) int64 {
+	if v.CanUint() {
+		return int64(v.Uint())
+	}
+	return v.Int()
+}
+
+// fieldByName returns the field of the struct value with the given name as reflect.Value.FieldByName does,
+// the index of the field is resolved once per type and name since the fields are looked up per ad and per request
+func fieldByName(v reflect.Value, name string) reflect.Value {
+	key := fieldKey{t: v.Type(), name: name}
+	index, ok := fieldIndexes.Load(key)
+	if !ok {
+		var resolved []int
+		if field, found := v.Type().FieldByName(name); found {
+			resolved = field.Index
+		}
+		index, _ = fieldIndexes.LoadOrStore(key, resolved)
+	}
+	if index.([]int) == nil {
+		return reflect.Value{}
+	}
+	return v.FieldByIndex(index.([]int))
+}
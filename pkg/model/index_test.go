@@ -0,0 +1,182 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIndexLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		want    IndexLayout
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			layout: defaultIndexLayout,
+			want: IndexLayout{
+				{Key: "Country", Strategy: IndexStrategyMulti},
+				{Key: "Platform", Strategy: IndexStrategyMulti},
+				{Key: "Gender", Strategy: IndexStrategyMulti},
+				{Key: "Language", Strategy: IndexStrategyPrefix},
+				{Key: "Region", Strategy: IndexStrategyPrefix},
+				{Key: "Tags", Strategy: IndexStrategyTags},
+				{Key: "Age", Strategy: IndexStrategyInterval},
+			},
+		},
+		{
+			name:   "reordered with spaces",
+			layout: " Country:multi , Age:range ",
+			want: IndexLayout{
+				{Key: "Country", Strategy: IndexStrategyMulti},
+				{Key: "Age", Strategy: IndexStrategyRange},
+			},
+		},
+		{name: "missing strategy", layout: "Age", wantErr: true},
+		{name: "unknown strategy", layout: "Age:tree", wantErr: true},
+		{name: "unknown field", layout: "City:multi", wantErr: true},
+		{name: "not a range", layout: "Country:range", wantErr: true},
+		{name: "not an interval", layout: "Country:interval", wantErr: true},
+		{name: "not a slice", layout: "Age:multi", wantErr: true},
+		{name: "not a scalar", layout: "Country:scalar", wantErr: true},
+		{name: "not a prefix", layout: "Age:prefix", wantErr: true},
+		{name: "unbounded range", layout: "AppVersion:range", wantErr: true},
+		{name: "geo strategy", layout: "Geo:geo", wantErr: true},
+		{name: "not tags", layout: "Age:tags", wantErr: true},
+		{name: "duplicated", layout: "Country:multi,Country:multi", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIndexLayout(tt.layout)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidIndexLayout)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestIndexField_AdValues(t *testing.T) {
+	ad := &Ad{AgeStart: 18, AgeEnd: 20, Country: []string{"TW", "JP"}}
+
+	values, err := IndexField{Key: "Age", Strategy: IndexStrategyRange}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{uint8(18), uint8(19), uint8(20), uint8(0)}, values)
+
+	values, err = IndexField{Key: "Country", Strategy: IndexStrategyMulti}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"TW", "JP", ""}, values)
+
+	ad.AgeStart, ad.AgeEnd = 18, 65
+	values, err = IndexField{Key: "Age", Strategy: IndexStrategyInterval}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		IndexInterval{Start: 18, End: 19},
+		IndexInterval{Start: 20, End: 23},
+		IndexInterval{Start: 24, End: 31},
+		IndexInterval{Start: 32, End: 63},
+		IndexInterval{Start: 64, End: 65},
+		uint8(0),
+	}, values)
+
+	// the exclusions are not expanded, the ad is indexed by IndexAnyValue
+	ad = &Ad{ExcludeCountry: []string{"JP"}, Platform: []string{"ios"}, ExcludePlatform: []string{"web"}}
+	values, err = IndexField{Key: "Country", Strategy: IndexStrategyMulti}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{IndexAnyValue, ""}, values)
+	values, err = IndexField{Key: "Platform", Strategy: IndexStrategyMulti}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"ios", ""}, values)
+	assert.True(t, ad.Excludes("Country", "JP"))
+	assert.False(t, ad.Excludes("Country", "TW"))
+	assert.Nil(t, ad.CheckExclusions())
+
+	ad.Platform = []string{"ios", "web"}
+	assert.NotNil(t, ad.CheckExclusions())
+
+	// the tags under another tag of the ad are not indexed, so the ad is found under one key of a request
+	ad = &Ad{Language: []string{"zh-TW", "en", "ZH", "en"}}
+	values, err = IndexField{Key: "Language", Strategy: IndexStrategyPrefix}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"en", "zh", ""}, values)
+	values, err = IndexField{Key: "Region", Strategy: IndexStrategyPrefix}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{IndexAnyValue}, values)
+
+	// the zero end of the app versions is unbounded
+	ad = &Ad{AppVersionStart: MaxAppVersion - 2}
+	values, err = IndexField{Key: "AppVersion", Strategy: IndexStrategyInterval}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		IndexInterval{Start: int64(MaxAppVersion - 2), End: int64(MaxAppVersion - 2)},
+		IndexInterval{Start: int64(MaxAppVersion - 1), End: int64(MaxAppVersion)},
+		AppVersion(0),
+	}, values)
+	ad.AppVersionStart = 0
+	values, err = IndexField{Key: "AppVersion", Strategy: IndexStrategyInterval}.AdValues(ad)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{IndexInterval{Start: 0, End: int64(MaxAppVersion)}}, values)
+}
+
+func TestIndexField_RequestValues(t *testing.T) {
+	interval := IndexField{Key: "Age", Strategy: IndexStrategyInterval}
+	values, err := interval.RequestValues(&GetAdRequest{Age: 25})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		IndexInterval{Start: 25, End: 25},
+		IndexInterval{Start: 24, End: 25},
+		IndexInterval{Start: 24, End: 27},
+		IndexInterval{Start: 24, End: 31},
+		IndexInterval{Start: 16, End: 31},
+		IndexInterval{Start: 0, End: 31},
+		IndexInterval{Start: 0, End: 63},
+		IndexInterval{Start: 0, End: 127},
+		IndexInterval{Start: 0, End: 255},
+	}, values)
+
+	// the ads of the whole range are not indexed by the zero value
+	values, err = interval.RequestValues(&GetAdRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{uint8(0), IndexInterval{Start: 0, End: 255}}, values)
+
+	values, err = IndexField{Key: "Country", Strategy: IndexStrategyMulti}.RequestValues(&GetAdRequest{Country: "TW"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"TW", IndexAnyValue}, values)
+
+	values, err = IndexField{Key: "Language", Strategy: IndexStrategyPrefix}.RequestValues(&GetAdRequest{Language: "zh-Hant-TW"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"zh-hant-tw", "zh-hant", "zh", IndexAnyValue}, values)
+
+	values, err = IndexField{Key: "AppVersion", Strategy: IndexStrategyInterval}.RequestValues(&GetAdRequest{AppVersion: 1})
+	assert.Nil(t, err)
+	assert.Len(t, values, 49)
+	assert.Equal(t, IndexInterval{Start: 0, End: int64(MaxAppVersion)}, values[48])
+}
+
+func TestCoveringIntervals(t *testing.T) {
+	// every value of the range is contained by exactly one of the covering blocks
+	for from := int64(0); from < 70; from++ {
+		for to := from; to < 70; to++ {
+			covering := coveringIntervals(from, to, 8)
+			for v := int64(0); v < 80; v++ {
+				found := 0
+				for _, c := range containingIntervals(v, 8) {
+					for _, i := range covering {
+						if c == i {
+							found++
+						}
+					}
+				}
+				if v >= from && v <= to {
+					assert.Equal(t, 1, found, "[%d, %d] contains %d", from, to, v)
+				} else {
+					assert.Equal(t, 0, found, "[%d, %d] does not contain %d", from, to, v)
+				}
+			}
+		}
+	}
+}
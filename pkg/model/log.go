@@ -0,0 +1,43 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	LogTypeCreate = "create"
+	LogTypeUpdate = "update"
+	LogTypeDelete = "delete"
+	// LogTypeCampaign cascades the status of a campaign to its ads
+	LogTypeCampaign = "campaign"
+)
+
+var (
+	// ErrVersionConflict is returned when the appended version is not greater than the latest version of the log
+	ErrVersionConflict = fmt.Errorf("version conflict")
+)
+
+// LogEntry is an operation in the replicated log
+type LogEntry struct {
+	// Version is the sequence number of the entry, it is the same as the version of the ad
+	Version int64 `json:"version"`
+	// Type is one of LogTypeCreate, LogTypeUpdate, LogTypeDelete
+	Type string `json:"type"`
+	// Payload is the json encoded dispatcher request
+	Payload []byte `json:"payload"`
+}
+
+// ReplicatedLog orders the write operations and replicates them to every instance
+type ReplicatedLog interface {
+	// Append appends the entry to the log, the version of the entry must be greater than the latest version
+	Append(ctx context.Context, entry *LogEntry) error
+	// ReadFrom returns at most count entries whose version is greater than the given version,
+	// it blocks up to block duration if there is no such entry
+	ReadFrom(ctx context.Context, version int64, count int, block time.Duration) ([]*LogEntry, error)
+	// Trim removes the entries whose version is less than the given version, it is called once a snapshot of the version is saved
+	Trim(ctx context.Context, version int64) error
+	// LatestVersion returns the version of the last entry, or 0 if the log is empty
+	LatestVersion(ctx context.Context) (int64, error)
+}
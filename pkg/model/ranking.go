@@ -0,0 +1,54 @@
+package model
+
+import (
+	"math"
+	"time"
+)
+
+// rankScale keeps 6 decimal places of the ranking value in the integer rank
+const rankScale = 1e6
+
+// Ranking is the linear ranking function of the ads,
+// the value of an ad is BidWeight * Bid + RecencyWeight * hours since the epoch of CreatedAt + CTRWeight * CTR.
+// The recency term only depends on CreatedAt, so the order of the ads does not drift as time goes by.
+type Ranking struct {
+	BidWeight float64
+	// RecencyWeight is the value of an ad created an hour later, in the unit of the bid
+	RecencyWeight float64
+	// CTRWeight is the value of a click-through rate of 1, 0 disables the CTR term
+	CTRWeight float64
+	// CTRMinImpressions is the number of the impressions below which the CTR of the ad is not trusted and counted as 0
+	CTRMinImpressions int64
+	// TagWeight is the value of every tag of an ad matching an interest of the request, see GetAdRequest.Score
+	TagWeight float64
+}
+
+// DefaultRanking ranks the ads by the bid, an ad an hour newer is worth 0.01 more bid
+func DefaultRanking() *Ranking {
+	return &Ranking{
+		BidWeight:         1,
+		RecencyWeight:     0.01,
+		CTRMinImpressions: 1000,
+		TagWeight:         0.5,
+	}
+}
+
+// CTR returns the click-through rate counted by the ranking
+func (r *Ranking) CTR(impressions, clicks int64) float64 {
+	if impressions <= 0 || impressions < r.CTRMinImpressions {
+		return 0
+	}
+	return float64(clicks) / float64(impressions)
+}
+
+// TagBoost returns the score of a matched tag in the unit of the rank
+func (r *Ranking) TagBoost() int64 {
+	return int64(math.Round(r.TagWeight * rankScale))
+}
+
+// Rank returns the rank of the ad, the ads of higher ranks are served first
+func (r *Ranking) Rank(ad *Ad, ctr float64) int64 {
+	hours := float64(ad.CreatedAt.T().Unix()) / float64(time.Hour/time.Second)
+	value := r.BidWeight*ad.Bid + r.RecencyWeight*hours + r.CTRWeight*ctr
+	return int64(math.Round(value * rankScale))
+}
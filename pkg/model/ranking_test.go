@@ -0,0 +1,42 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRanking_Rank(t *testing.T) {
+	ranking := &Ranking{BidWeight: 1, RecencyWeight: 0.01, CTRWeight: 10, CTRMinImpressions: 100}
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ad := &Ad{Bid: 2, CreatedAt: CustomTime(createdAt)}
+	newer := &Ad{Bid: 2, CreatedAt: CustomTime(createdAt.Add(time.Hour))}
+	higher := &Ad{Bid: 2.02, CreatedAt: CustomTime(createdAt)}
+
+	assert.Greater(t, ranking.Rank(newer, 0), ranking.Rank(ad, 0))
+	// an hour newer is worth 0.01 more bid
+	assert.Equal(t, ranking.Rank(newer, 0)-ranking.Rank(ad, 0), int64(0.01*rankScale))
+	assert.Greater(t, ranking.Rank(higher, 0), ranking.Rank(newer, 0))
+	assert.Greater(t, ranking.Rank(ad, 0.05), ranking.Rank(higher, 0))
+}
+
+func TestRanking_CTR(t *testing.T) {
+	ranking := &Ranking{CTRMinImpressions: 100}
+	assert.Equal(t, 0.0, ranking.CTR(0, 0))
+	// too few impressions
+	assert.Equal(t, 0.0, ranking.CTR(99, 50))
+	assert.Equal(t, 0.25, ranking.CTR(100, 25))
+}
+
+func TestGetAdRequest_Score(t *testing.T) {
+	ranking := &Ranking{BidWeight: 1, TagWeight: 0.5}
+	ad := &Ad{Bid: 2, Tags: []string{"Gaming", "makeup", "travel"}}
+	ad.Rank = ranking.Rank(ad, 0)
+	req := &GetAdRequest{Tags: []string{"gaming", "travel", "food"}, TagBoost: ranking.TagBoost()}
+
+	assert.Equal(t, 2, req.MatchedTags(ad))
+	// every matched tag is worth 0.5 more bid
+	assert.Equal(t, ad.Score()-int64(2*0.5*rankScale), req.Score(ad))
+	assert.Equal(t, ad.Score(), (&GetAdRequest{}).Score(ad))
+}
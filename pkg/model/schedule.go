@@ -0,0 +1,82 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Weekdays are the names of the weekdays in the schedules, in the order of time.Weekday
+var Weekdays = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ScheduleWindow is the hours [StartHour, EndHour) of the weekdays the ad is served in,
+// e.g. the weekdays 18:00-23:00 are mon to fri from 18 to 23.
+// A window can not cross midnight, the client sends 22:00-02:00 as two windows, [22, 24) and [0, 2) of the next weekdays.
+type ScheduleWindow struct {
+	Weekdays  []string `json:"weekdays" binding:"required,dive,oneof=sun mon tue wed thu fri sat" example:"mon"`
+	StartHour uint8    `json:"start_hour" binding:"lte=23" example:"18"`
+	EndHour   uint8    `json:"end_hour" binding:"gtfield=StartHour,lte=24" example:"23"`
+}
+
+// Schedule is the weekly schedule of an ad in the local time of the viewer,
+// the ad is served in the hours of any of the windows. The empty schedule serves every hour.
+type Schedule []ScheduleWindow
+
+// Hours returns the hours of every weekday the ad is served in, from Sunday as time.Weekday,
+// bit h of the weekday is set if the ad is served from h:00 to h+1:00
+func (s Schedule) Hours() [7]uint32 {
+	var hours [7]uint32
+	if len(s) == 0 {
+		for d := range hours {
+			hours[d] = 1<<24 - 1
+		}
+		return hours
+	}
+	for _, w := range s {
+		if w.EndHour <= w.StartHour {
+			continue
+		}
+		mask := uint32(1)<<min(w.EndHour, 24) - uint32(1)<<w.StartHour
+		for _, name := range w.Weekdays {
+			for d, weekday := range Weekdays {
+				if name == weekday {
+					hours[d] |= mask
+				}
+			}
+		}
+	}
+	return hours
+}
+
+// Active reports whether the ad is served at t, in the location of t.
+// The wall clock of t is used, so an hour skipped by a DST transition never happens
+// and a repeated one happens twice.
+func (s Schedule) Active(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	return s.Hours()[t.Weekday()]&(1<<t.Hour()) != 0
+}
+
+// Value stores the schedule as JSON, NULL if it is empty
+func (s Schedule) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *Schedule) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	default:
+		return errors.New("type conversion to Schedule failed")
+	}
+}
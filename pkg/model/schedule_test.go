@@ -0,0 +1,71 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule_Hours(t *testing.T) {
+	s := Schedule{
+		{Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}, StartHour: 18, EndHour: 23},
+		{Weekdays: []string{"sat"}, StartHour: 22, EndHour: 24},
+		{Weekdays: []string{"sun"}, StartHour: 0, EndHour: 2},
+	}
+	hours := s.Hours()
+	assert.Equal(t, uint32(0b11), hours[time.Sunday])
+	assert.Equal(t, uint32(0b11111)<<18, hours[time.Monday])
+	assert.Equal(t, hours[time.Monday], hours[time.Friday])
+	assert.Equal(t, uint32(0b11)<<22, hours[time.Saturday])
+
+	// the empty schedule serves every hour
+	for _, h := range Schedule(nil).Hours() {
+		assert.Equal(t, uint32(1<<24-1), h)
+	}
+}
+
+func TestSchedule_Active(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.Nil(t, err)
+	weekdays := Schedule{{Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}, StartHour: 18, EndHour: 23}}
+	// 2026-10-16 is a Friday
+	assert.True(t, weekdays.Active(time.Date(2026, 10, 16, 18, 0, 0, 0, newYork)))
+	assert.True(t, weekdays.Active(time.Date(2026, 10, 16, 22, 59, 59, 0, newYork)))
+	assert.False(t, weekdays.Active(time.Date(2026, 10, 16, 23, 0, 0, 0, newYork)))
+	assert.False(t, weekdays.Active(time.Date(2026, 10, 17, 19, 0, 0, 0, newYork)))
+	// the same instant is evaluated in the location of the time
+	assert.False(t, weekdays.Active(time.Date(2026, 10, 16, 20, 30, 0, 0, newYork).In(time.UTC)))
+	assert.True(t, Schedule(nil).Active(time.Date(2026, 10, 17, 19, 0, 0, 0, newYork)))
+
+	night := Schedule{{Weekdays: []string{"sun"}, StartHour: 1, EndHour: 3}}
+	// 2026-03-08 02:00 EST is skipped to 03:00 EDT, so the window is an hour shorter
+	assert.True(t, night.Active(time.Date(2026, 3, 8, 6, 30, 0, 0, time.UTC).In(newYork)))
+	assert.False(t, night.Active(time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC).In(newYork)))
+	// 2026-11-01 01:00-02:00 is repeated in EDT and EST, so the window is an hour longer
+	for _, utcHour := range []int{5, 6, 7} {
+		assert.True(t, night.Active(time.Date(2026, 11, 1, utcHour, 30, 0, 0, time.UTC).In(newYork)), "%d:30 UTC", utcHour)
+	}
+	assert.False(t, night.Active(time.Date(2026, 11, 1, 8, 30, 0, 0, time.UTC).In(newYork)))
+}
+
+func TestSchedule_Value(t *testing.T) {
+	v, err := Schedule(nil).Value()
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+
+	s := Schedule{{Weekdays: []string{"mon"}, StartHour: 18, EndHour: 23}}
+	v, err = s.Value()
+	assert.Nil(t, err)
+	var scanned Schedule
+	assert.Nil(t, scanned.Scan(v))
+	assert.Equal(t, s, scanned)
+
+	b, err := json.Marshal(&Ad{Schedule: s})
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"schedule":[{"weekdays":["mon"],"start_hour":18,"end_hour":23}]`)
+	b, err = json.Marshal(&Ad{})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), `schedule`)
+}
@@ -0,0 +1,24 @@
+package model
+
+import "fmt"
+
+var (
+	// ErrNoSnapshot is returned when there is no valid snapshot to load
+	ErrNoSnapshot = fmt.Errorf("no snapshot")
+)
+
+// Snapshot is the state of the in-memory store at the given version of the replicated log
+type Snapshot struct {
+	// Version is the version of the last log entry applied to the store
+	Version int64
+	// Ads are the active ads, including the ads that are scheduled to start
+	Ads []*Ad
+}
+
+// Snapshotter persists the snapshots of the in-memory store
+type Snapshotter interface {
+	// Save writes the snapshot, the older snapshots may be removed
+	Save(snapshot *Snapshot) error
+	// Load returns the newest valid snapshot, or ErrNoSnapshot if there is none
+	Load() (*Snapshot, error)
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType is the type of the tracking event
+type EventType string
+
+const (
+	EventTypeImpression EventType = "impression"
+	EventTypeClick      EventType = "click"
+)
+
+// TrackingEvent is an impression or a click of an ad
+type TrackingEvent struct {
+	AdID uuid.UUID
+	Type EventType
+	At   time.Time
+}
+
+// AdStatsHourly is the number of the events of an ad in the hour starting at Hour
+type AdStatsHourly struct {
+	AdID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"-"`
+	Hour        CustomTime `gorm:"type:timestamptz;primaryKey" json:"hour" swaggertype:"string" format:"date" example:"2006-01-02 15:00:00 +0800 CST"`
+	Impressions int64      `gorm:"type:bigint" json:"impressions"`
+	Clicks      int64      `gorm:"type:bigint" json:"clicks"`
+}
+
+func (AdStatsHourly) TableName() string {
+	return "ad_stats_hourly"
+}
+
+// GetAdStatsRequest is the time range of the stats, the hours are truncated
+type GetAdStatsRequest struct {
+	// From defaults to 24 hours before To
+	From time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	// To defaults to now
+	To time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+type AdStats struct {
+	AdID        string     `json:"ad_id"`
+	From        CustomTime `json:"from" swaggertype:"string" format:"date" example:"2006-01-02 15:00:00 +0800 CST"`
+	To          CustomTime `json:"to" swaggertype:"string" format:"date" example:"2006-01-02 15:00:00 +0800 CST"`
+	Impressions int64      `json:"impressions"`
+	Clicks      int64      `json:"clicks"`
+	// CTR is Clicks / Impressions, 0 if there is no impression
+	CTR    float64          `json:"ctr"`
+	Hourly []*AdStatsHourly `json:"hourly"`
+}
+
+// EventWriter buffers the tracking events and writes them in batches
+type EventWriter interface {
+	// Write enqueues the event without blocking, the event is dropped if the buffer is full
+	Write(event *TrackingEvent) error
+	// Run aggregates and flushes the events until Close is called
+	Run()
+	// Close flushes the buffered events and stops Run
+	Close(ctx context.Context) error
+}
+
+type TrackingService interface {
+	TrackImpression(ctx context.Context, adID string) error
+	// TrackClick records the click and returns the landing URL of the ad
+	TrackClick(ctx context.Context, adID string) (string, error)
+	GetAdStats(ctx context.Context, adID string, req *GetAdStatsRequest) (*AdStats, error)
+	Run()
+	Shutdown(ctx context.Context) error
+}
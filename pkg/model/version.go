@@ -0,0 +1,89 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// appVersionBits is the bits of every part of AppVersion
+	appVersionBits = 16
+	appVersionMask = 1<<appVersionBits - 1
+)
+
+var (
+	// ErrInvalidAppVersion is returned when the app version is not a semantic version, 400
+	ErrInvalidAppVersion = fmt.Errorf("invalid app version")
+)
+
+// AppVersion is the semantic version of the client app packed into an integer,
+// 16 bits for each of MAJOR, MINOR and PATCH, so the versions are ordered as integers.
+// The version ranges of the ads are checked by the store at query time, see Ad.ServesAppVersion.
+// The pre-release and the build metadata are ignored, e.g. 2.0.0-beta+1 is 2.0.0.
+// The zero value is the missing version.
+type AppVersion uint64
+
+// MaxAppVersion is the upper bound of the app versions, the ads without a maximum app version are served up to it
+const MaxAppVersion AppVersion = 1<<(3*appVersionBits) - 1
+
+// ParseAppVersion parses the semantic version MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]
+func ParseAppVersion(s string) (AppVersion, error) {
+	core, _, _ := strings.Cut(s, "+")
+	core, _, _ = strings.Cut(core, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAppVersion, s)
+	}
+	var v AppVersion
+	for _, part := range parts {
+		n, err := strconv.ParseUint(part, 10, appVersionBits)
+		if err != nil || (len(part) > 1 && part[0] == '0') {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidAppVersion, s)
+		}
+		v = v<<appVersionBits | AppVersion(n)
+	}
+	return v, nil
+}
+
+// ServesAppVersion reports whether the app version range of the ad contains the version,
+// the ads without a range and the requests without a version are always served
+func (a *Ad) ServesAppVersion(v AppVersion) bool {
+	if v == 0 {
+		return true
+	}
+	return a.AppVersionStart <= v && (a.AppVersionEnd == 0 || v <= a.AppVersionEnd)
+}
+
+// UpperBound is the end of the app version ranges without a maximum
+func (v AppVersion) UpperBound() int64 {
+	return int64(MaxAppVersion)
+}
+
+func (v AppVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v>>(2*appVersionBits), v>>appVersionBits&appVersionMask, v&appVersionMask)
+}
+
+// MarshalJSON encodes the version as the MAJOR.MINOR.PATCH string
+func (v AppVersion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+// UnmarshalJSON decodes the semantic version string, the empty string is the zero value
+func (v *AppVersion) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAppVersion, b)
+	}
+	if s == "" {
+		*v = 0
+		return nil
+	}
+	parsed, err := ParseAppVersion(s)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
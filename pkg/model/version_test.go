@@ -0,0 +1,77 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAppVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "5.12.0", want: "5.12.0"},
+		{version: "0.0.1", want: "0.0.1"},
+		{version: "65535.65535.65535", want: "65535.65535.65535"},
+		{version: "2.0.0-beta.1+build.7", want: "2.0.0"},
+		{version: "1.2", wantErr: true},
+		{version: "1.2.3.4", wantErr: true},
+		{version: "01.2.3", wantErr: true},
+		{version: "1.65536.0", wantErr: true},
+		{version: "v1.2.3", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			v, err := ParseAppVersion(tt.version)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidAppVersion)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, v.String())
+		})
+	}
+}
+
+func TestAppVersion_Order(t *testing.T) {
+	versions := []string{"0.0.1", "0.1.0", "0.1.9", "0.1.10", "1.0.0", "1.9.0", "1.10.0", "10.0.0"}
+	for i := 1; i < len(versions); i++ {
+		prev, _ := ParseAppVersion(versions[i-1])
+		next, _ := ParseAppVersion(versions[i])
+		assert.Less(t, prev, next, "%s < %s", versions[i-1], versions[i])
+	}
+	assert.Equal(t, "65535.65535.65535", MaxAppVersion.String())
+}
+
+func TestAppVersion_JSON(t *testing.T) {
+	var req CreateAdRequest
+	assert.Nil(t, json.Unmarshal([]byte(`{"app_version_min": "5.12.0", "app_version_max": ""}`), &req))
+	assert.Equal(t, "5.12.0", req.AppVersionMin.String())
+	assert.Equal(t, AppVersion(0), req.AppVersionMax)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"app_version_min": "5.12"}`), &req), ErrInvalidAppVersion)
+
+	b, err := json.Marshal(&Ad{AppVersionStart: req.AppVersionMin})
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"app_version_min":"5.12.0"`)
+	assert.NotContains(t, string(b), `app_version_max`)
+}
+
+func TestAd_ServesAppVersion(t *testing.T) {
+	v := func(s string) AppVersion {
+		version, err := ParseAppVersion(s)
+		assert.Nil(t, err)
+		return version
+	}
+	ad := &Ad{AppVersionStart: v("2.1.0")}
+	assert.True(t, ad.ServesAppVersion(0))
+	assert.False(t, ad.ServesAppVersion(v("2.0.9")))
+	assert.True(t, ad.ServesAppVersion(v("2.1.0")))
+	assert.True(t, ad.ServesAppVersion(MaxAppVersion))
+	ad.AppVersionEnd = v("3.0.0")
+	assert.True(t, ad.ServesAppVersion(v("3.0.0")))
+	assert.False(t, ad.ServesAppVersion(v("3.0.1")))
+}
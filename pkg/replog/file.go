@@ -0,0 +1,217 @@
+package replog
+
+import (
+	"bufio"
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileLog is an in-process replicated log for single node deployments and tests.
+// If the path is set, every entry is also appended to the file as a json line,
+// and the entries are loaded from the file when the log is opened.
+type FileLog struct {
+	mu      sync.Mutex
+	entries []*model.LogEntry
+	path    string
+	file    *os.File
+	// notify is closed and replaced on every append to wake up the blocking readers
+	notify chan struct{}
+}
+
+// NewFileLog opens the file log, the log is kept in memory only if the path is empty
+func NewFileLog(path string) (*FileLog, error) {
+	l := &FileLog{
+		entries: make([]*model.LogEntry, 0),
+		path:    path,
+		notify:  make(chan struct{}),
+	}
+	if path == "" {
+		return l, nil
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// load reads the entries from the file, a broken tail (e.g. a partial write before crash) is dropped
+func (l *FileLog) load() error {
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("file log %s: dropping incomplete entry", l.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := &model.LogEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			log.Printf("file log %s: dropping corrupted entries: %v", l.path, err)
+			return nil
+		}
+		l.entries = append(l.entries, entry)
+	}
+}
+
+// Append implements model.ReplicatedLog.
+func (l *FileLog) Append(ctx context.Context, entry *model.LogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n := len(l.entries); n > 0 && entry.Version <= l.entries[n-1].Version {
+		return model.ErrVersionConflict
+	}
+	if l.file != nil {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	l.entries = append(l.entries, entry)
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return nil
+}
+
+// ReadFrom implements model.ReplicatedLog.
+func (l *FileLog) ReadFrom(ctx context.Context, version int64, count int, block time.Duration) ([]*model.LogEntry, error) {
+	timer := time.NewTimer(block)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		entries := l.after(version, count)
+		notify := l.notify
+		l.mu.Unlock()
+
+		if len(entries) > 0 || block <= 0 {
+			return entries, nil
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// after returns at most count entries whose version is greater than the given version
+func (l *FileLog) after(version int64, count int) []*model.LogEntry {
+	i := sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].Version > version
+	})
+	end := len(l.entries)
+	if count > 0 && i+count < end {
+		end = i + count
+	}
+	entries := make([]*model.LogEntry, end-i)
+	copy(entries, l.entries[i:end])
+	return entries
+}
+
+// Trim implements model.ReplicatedLog.
+// The file is rewritten with the remaining entries.
+func (l *FileLog) Trim(ctx context.Context, version int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].Version >= version
+	})
+	if i == 0 {
+		return nil
+	}
+	entries := make([]*model.LogEntry, len(l.entries)-i)
+	copy(entries, l.entries[i:])
+
+	if l.file != nil {
+		if err := l.rewrite(entries); err != nil {
+			return err
+		}
+	}
+	l.entries = entries
+	return nil
+}
+
+// rewrite replaces the file with the given entries
+func (l *FileLog) rewrite(entries []*model.LogEntry) error {
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return err
+	}
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// LatestVersion implements model.ReplicatedLog.
+func (l *FileLog) LatestVersion(ctx context.Context) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == 0 {
+		return 0, nil
+	}
+	return l.entries[len(l.entries)-1].Version, nil
+}
+
+// Close closes the underlying file
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
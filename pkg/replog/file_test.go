@@ -0,0 +1,108 @@
+package replog
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLog_Append(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []int64
+		wantErr  []error
+	}{
+		{
+			name:     "increasing versions",
+			versions: []int64{1, 2, 3},
+			wantErr:  []error{nil, nil, nil},
+		},
+		{
+			name:     "duplicated version",
+			versions: []int64{1, 1},
+			wantErr:  []error{nil, model.ErrVersionConflict},
+		},
+		{
+			name:     "smaller version",
+			versions: []int64{2, 1},
+			wantErr:  []error{nil, model.ErrVersionConflict},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewFileLog("")
+			assert.Nil(t, err)
+			for i, version := range tt.versions {
+				err := l.Append(context.Background(), &model.LogEntry{Version: version, Type: model.LogTypeCreate})
+				assert.Equal(t, tt.wantErr[i], err)
+			}
+		})
+	}
+}
+
+func TestFileLog_ReadFrom(t *testing.T) {
+	l, err := NewFileLog("")
+	assert.Nil(t, err)
+	ctx := context.Background()
+	for i := int64(1); i <= 5; i++ {
+		assert.Nil(t, l.Append(ctx, &model.LogEntry{Version: i, Type: model.LogTypeCreate}))
+	}
+
+	entries, err := l.ReadFrom(ctx, 2, 2, 0)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(3), entries[0].Version)
+	assert.Equal(t, int64(4), entries[1].Version)
+
+	entries, err = l.ReadFrom(ctx, 5, 10, 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	// a blocking reader is woken up by the append
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Append(ctx, &model.LogEntry{Version: 6, Type: model.LogTypeDelete})
+	}()
+	entries, err = l.ReadFrom(ctx, 5, 10, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, model.LogTypeDelete, entries[0].Type)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = l.ReadFrom(cancelCtx, 6, 10, time.Second)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFileLog_TrimAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ad.log")
+	l, err := NewFileLog(path)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	for i := int64(1); i <= 5; i++ {
+		assert.Nil(t, l.Append(ctx, &model.LogEntry{Version: i, Type: model.LogTypeUpdate, Payload: []byte(`{"ad":{}}`)}))
+	}
+	assert.Nil(t, l.Trim(ctx, 3))
+	entries, err := l.ReadFrom(ctx, 0, 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, int64(3), entries[0].Version)
+	assert.Nil(t, l.Append(ctx, &model.LogEntry{Version: 6, Type: model.LogTypeDelete}))
+	assert.Nil(t, l.Close())
+
+	reloaded, err := NewFileLog(path)
+	assert.Nil(t, err)
+	defer reloaded.Close()
+	entries, err = reloaded.ReadFrom(ctx, 0, 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, []byte(`{"ad":{}}`), entries[0].Payload)
+	latest, err := reloaded.LatestVersion(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), latest)
+	assert.Equal(t, model.ErrVersionConflict, reloaded.Append(ctx, &model.LogEntry{Version: 6}))
+}
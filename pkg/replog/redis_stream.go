@@ -0,0 +1,122 @@
+package replog
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStreamLog is the replicated log backed by redis stream,
+// the ID of the message is `0-<version>` so the stream is ordered by the version
+type RedisStreamLog struct {
+	redis  *redis.Client
+	stream string
+	maxLen int64
+}
+
+func NewRedisStreamLog(redis *redis.Client, stream string) model.ReplicatedLog {
+	return &RedisStreamLog{
+		redis:  redis,
+		stream: stream,
+		maxLen: 100000,
+	}
+}
+
+// Append implements model.ReplicatedLog.
+// XADD ad 0-<version> ad <payload> type <type>
+func (l *RedisStreamLog) Append(ctx context.Context, entry *model.LogEntry) error {
+	_, err := l.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream:     l.stream,
+		NoMkStream: false,
+		Approx:     false,
+		MaxLen:     l.maxLen,
+		Values: []interface{}{
+			"ad", string(entry.Payload),
+			"type", entry.Type,
+		},
+		ID: streamID(entry.Version),
+	}).Result()
+	if err != nil && strings.Contains(err.Error(), "equal or smaller than the target stream top item") {
+		return model.ErrVersionConflict
+	}
+	return err
+}
+
+// ReadFrom implements model.ReplicatedLog.
+func (l *RedisStreamLog) ReadFrom(ctx context.Context, version int64, count int, block time.Duration) ([]*model.LogEntry, error) {
+	// BLOCK 0 waits forever, a negative block omits the option so XREAD returns immediately
+	if block <= 0 {
+		block = -1
+	}
+	streams, err := l.redis.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{l.stream, streamID(version)},
+		Block:   block,
+		Count:   int64(count),
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*model.LogEntry
+	for _, stream := range streams {
+		for _, m := range stream.Messages {
+			entry, err := toLogEntry(m)
+			if err != nil {
+				return entries, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Trim implements model.ReplicatedLog.
+func (l *RedisStreamLog) Trim(ctx context.Context, version int64) error {
+	return l.redis.XTrimMinID(ctx, l.stream, streamID(version)).Err()
+}
+
+// LatestVersion implements model.ReplicatedLog.
+func (l *RedisStreamLog) LatestVersion(ctx context.Context) (int64, error) {
+	msgs, err := l.redis.XRevRangeN(ctx, l.stream, "+", "-", 1).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	return parseStreamID(msgs[0].ID)
+}
+
+func streamID(version int64) string {
+	return fmt.Sprintf("0-%d", version)
+}
+
+func parseStreamID(id string) (int64, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid stream id: %s", id)
+	}
+	return strconv.ParseInt(parts[1], 10, 64)
+}
+
+func toLogEntry(m redis.XMessage) (*model.LogEntry, error) {
+	version, err := parseStreamID(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	msgType, _ := m.Values["type"].(string)
+	payload, _ := m.Values["ad"].(string)
+	return &model.LogEntry{
+		Version: version,
+		Type:    msgType,
+		Payload: []byte(payload),
+	}, nil
+}
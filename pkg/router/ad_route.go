@@ -3,11 +3,24 @@ package router
 import (
 	"dcard-backend-2024/pkg/bootstrap"
 	"dcard-backend-2024/pkg/controller"
+	"dcard-backend-2024/pkg/middleware"
+	"dcard-backend-2024/pkg/model"
 )
 
 func RegisterAdRouter(app *bootstrap.Application, controller *controller.AdController) {
 	r := app.Engine.Group("/api/v1/ad")
 
-	r.POST("", controller.CreateAd)
 	r.GET("", controller.GetAd)
+	r.GET("/:id", controller.GetAdByID)
+
+	// the writes are restricted to the advertisers and the admins,
+	// the advertisers can only modify their own ads, which is checked by the service
+	w := r.Group("",
+		middleware.AuthMiddleware(app.Env.JWT.AccessTokenSecret),
+		middleware.RequireRoles(model.RoleAdvertiser, model.RoleAdmin),
+	)
+	w.POST("", controller.CreateAd)
+	w.PUT("/:id", controller.ReplaceAd)
+	w.PATCH("/:id", controller.UpdateAd)
+	w.DELETE("/:id", controller.DeleteAd)
 }
@@ -0,0 +1,25 @@
+package router
+
+import (
+	"dcard-backend-2024/pkg/bootstrap"
+	"dcard-backend-2024/pkg/controller"
+	"dcard-backend-2024/pkg/middleware"
+	"dcard-backend-2024/pkg/model"
+)
+
+func RegisterCampaignRouter(app *bootstrap.Application, controller *controller.CampaignController) {
+	auth := middleware.AuthMiddleware(app.Env.JWT.AccessTokenSecret)
+	writer := middleware.RequireRoles(model.RoleAdvertiser, model.RoleAdmin)
+
+	app.Engine.POST("/api/v1/advertiser", auth, writer, controller.CreateAdvertiser)
+
+	r := app.Engine.Group("/api/v1/campaign", auth)
+	r.GET("/:id", controller.GetCampaign)
+
+	// the advertisers can only manage the campaigns of their own advertisers, which is checked by the service
+	w := r.Group("", writer)
+	w.POST("", controller.CreateCampaign)
+	w.POST("/:id/pause", controller.PauseCampaign)
+	w.POST("/:id/resume", controller.ResumeCampaign)
+	w.POST("/:id/end", controller.EndCampaign)
+}
@@ -0,0 +1,11 @@
+package router
+
+import (
+	"dcard-backend-2024/pkg/bootstrap"
+	"dcard-backend-2024/pkg/controller"
+)
+
+func RegisterHealthRouter(app *bootstrap.Application, controller *controller.HealthController) {
+	app.Engine.GET("/healthz", controller.Healthz)
+	app.Engine.GET("/readyz", controller.Readyz)
+}
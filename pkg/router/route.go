@@ -4,6 +4,9 @@ import (
 	"dcard-backend-2024/pkg/bootstrap"
 	"dcard-backend-2024/pkg/controller"
 	"dcard-backend-2024/pkg/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 
@@ -11,6 +14,14 @@ func RegisterRoutes(app *bootstrap.Application, services *bootstrap.Services) {
 	// Register Global Middleware
 	cors := middleware.CORSMiddleware()
 	app.Engine.Use(cors)
+	app.Engine.Use(middleware.MetricsMiddleware())
+
+	// Register Metrics Route
+	app.Engine.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// Register Health Routes
+	healthController := controller.NewHealthController(services.HealthService)
+	RegisterHealthRouter(app, healthController)
 
 	// // Register Event Routes
 	// eventController := controller.NewEventController(services.EventService, services.AsynqService)
@@ -19,4 +30,12 @@ func RegisterRoutes(app *bootstrap.Application, services *bootstrap.Services) {
 	// Register Ad Routes
 	adController := controller.NewAdController(services.AdService)
 	RegisterAdRouter(app, adController)
+
+	// Register Tracking Routes
+	trackingController := controller.NewTrackingController(services.TrackingService)
+	RegisterTrackingRouter(app, trackingController)
+
+	// Register Campaign Routes
+	campaignController := controller.NewCampaignController(services.CampaignService)
+	RegisterCampaignRouter(app, campaignController)
 }
@@ -0,0 +1,17 @@
+package router
+
+import (
+	"dcard-backend-2024/pkg/bootstrap"
+	"dcard-backend-2024/pkg/controller"
+	"dcard-backend-2024/pkg/middleware"
+)
+
+func RegisterTrackingRouter(app *bootstrap.Application, controller *controller.TrackingController) {
+	r := app.Engine.Group("/api/v1/ad")
+
+	// the beacons are sent by the clients showing the ads, they are not authenticated
+	r.GET("/:id/impression", controller.Impression)
+	r.GET("/:id/click", controller.Click)
+
+	r.GET("/:id/stats", middleware.AuthMiddleware(app.Env.JWT.AccessTokenSecret), controller.GetAdStats)
+}
@@ -4,52 +4,94 @@ import (
 	"context"
 	"database/sql"
 	"dcard-backend-2024/pkg/dispatcher"
+	"dcard-backend-2024/pkg/metrics"
 	"dcard-backend-2024/pkg/model"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/bsm/redislock"
 	"github.com/cenkalti/backoff/v4"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
-	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
 var (
 	ErrTimeout = fmt.Errorf("timeout")
 	ErrUnknown = fmt.Errorf("unknown error")
+	// ErrAdNotFound is returned when the ad does not exist or is already inactive, 404
+	ErrAdNotFound = fmt.Errorf("ad not found")
+	// ErrInvalidAd is returned when the updated ad violates the ad constraints, 400
+	ErrInvalidAd = fmt.Errorf("invalid ad")
+	// ErrReplicaBehind is returned when the cursor version is newer than the replica, 503
+	ErrReplicaBehind = fmt.Errorf("replica is behind the cursor version")
+	// ErrForbidden is returned when the principal is not allowed to write the ad, 403
+	ErrForbidden = fmt.Errorf("not allowed to modify the ad")
+	// ErrCampaignNotFound is returned when the campaign does not exist, 404
+	ErrCampaignNotFound = fmt.Errorf("campaign not found")
+	// ErrAdvertiserNotFound is returned when the advertiser does not exist, 404
+	ErrAdvertiserNotFound = fmt.Errorf("advertiser not found")
+	// ErrInvalidCampaign is returned when the campaign or its status change violates the campaign constraints, 400
+	ErrInvalidCampaign = fmt.Errorf("invalid campaign")
+	// ErrNotRestored is returned by Ready before the initial restore completes, 503
+	ErrNotRestored = fmt.Errorf("store is not restored")
+	// ErrReplicaLagging is returned by Ready when the subscriber falls too far behind the replicated log, 503
+	ErrReplicaLagging = fmt.Errorf("replica is lagging behind the replicated log")
+	// ErrDeleteTaskNotRescheduled is returned with the updated ad when its delete task is still at the old EndAt, 500
+	ErrDeleteTaskNotRescheduled = fmt.Errorf("ad is updated but its delete task is not rescheduled")
 )
 
+// maxBackfillRounds is the number of the store queries of a page, when the candidates are skipped by the budgets or the caps
+const maxBackfillRounds = 3
+
 type AdService struct {
 	shutdown    atomic.Bool
+	restored    atomic.Bool // restored is true once the store is restored, until the restore is retried
 	dispatcher  *dispatcher.Dispatcher
 	db          *gorm.DB
-	redis       *redis.Client
 	locker      *redislock.Client
 	asynqClient *asynq.Client
-	lockKey     string
-	// adStream is the redis stream name for the ad
-	adStream   string
-	mu         sync.Mutex
-	wg         sync.WaitGroup
-	onShutdown []func()
-	Version    int // Version is the latest version of the ad
+	// asynqInspector is used to cancel the scheduled delete task of the ad
+	asynqInspector *asynq.Inspector
+	lockKey        string
+	// replicatedLog orders and replicates the write operations to every instance
+	replicatedLog model.ReplicatedLog
+	// snapshotter persists the in-memory store every snapshotInterval, it is disabled if nil
+	snapshotter      model.Snapshotter
+	snapshotInterval time.Duration
+	// ranking ranks the ads when they are created or updated, the default ranking is used if nil
+	ranking *model.Ranking
+	// capper enforces the frequency caps of the ads served to the users, the caps are ignored if nil
+	capper model.FrequencyCapper
+	// pacer enforces the impression budgets of the ads, the budgets are ignored if nil
+	pacer model.BudgetPacer
+	// snapshotVersion is the version of the latest saved snapshot
+	snapshotVersion atomic.Int64
+	snapshotting    atomic.Bool
+	mu              sync.Mutex
+	wg              sync.WaitGroup
+	onShutdown      []func()
+	Version         atomic.Int64 // Version is the latest version of the ad
 }
 
 // DeleteAd implements model.AdService.
+// It returns ErrAdNotFound if the ad does not exist or is already inactive.
 func (a *AdService) DeleteAd(ctx context.Context, adID string) error {
+	// the task id is set if the delete is triggered by the scheduled delete task
+	taskID, _ := asynq.GetTaskID(ctx)
+	principal, authenticated := model.PrincipalFromContext(ctx)
+	if authenticated && !principal.CanWrite() {
+		return ErrForbidden
+	}
 	ctx = context.Background()
 	// RedisLock Lock Key: lock:ad
-	lock, err := a.locker.Obtain(ctx, a.lockKey, 100*time.Millisecond, &redislock.Options{
-		RetryStrategy: redislock.LimitRetry(redislock.ExponentialBackoff(1*time.Millisecond, 5*time.Millisecond), 10),
-	})
+	lock, err := a.obtainLock(ctx)
 	if err != nil {
 		log.Printf("error obtaining lock: %v", err)
 		return err
@@ -75,12 +117,22 @@ func (a *AdService) DeleteAd(ctx context.Context, adID string) error {
 		return err
 	}
 	maxVersion++
-	if err = txn.Model(&model.Ad{}).Where("id = ?", adID).
-		Update("is_active", false).
-		Update("version", maxVersion).Error; err != nil {
+	query := txn.Model(&model.Ad{}).Where("id = ? AND is_active = ?", adID, true)
+	if authenticated && principal.Role != model.RoleAdmin {
+		query = query.Where("owner_id = ?", principal.ID)
+	}
+	result := query.Updates(map[string]interface{}{"is_active": false, "version": maxVersion})
+	if err = result.Error; err != nil {
 		txn.Rollback()
 		return err
 	}
+	if result.RowsAffected == 0 {
+		txn.Rollback()
+		if authenticated && principal.Role != model.RoleAdmin {
+			return a.ownershipError(adID)
+		}
+		return ErrAdNotFound
+	}
 	if err = txn.Delete(&model.Ad{}, "version < ? AND is_active = false", maxVersion).Error; err != nil {
 		txn.Rollback()
 		return err
@@ -89,26 +141,77 @@ func (a *AdService) DeleteAd(ctx context.Context, adID string) error {
 	if err != nil {
 		return err
 	}
-	adReqMapStr, err := json.Marshal(dispatcher.DeleteAdRequest{AdID: adID})
+	// Publish to the replicated log with version `SELECT MAX(version) FROM ads`
+	err = a.publish(ctx, model.LogTypeDelete, maxVersion, dispatcher.DeleteAdRequest{AdID: adID})
+	if err != nil {
+		return err
+	}
+	// the ad is taken down before its EndAt, cancel the pending delete task.
+	// it is best effort, a leftover task gets ErrAdNotFound and is discarded by the task handler
+	if taskID != fmt.Sprintf("%s-%s", model.AsynqDeletePayload{}.TypeName(), adID) {
+		if err := a.cancelAdDeleteTask(adID); err != nil {
+			log.Printf("error cancelling delete task of ad %s: %v", adID, err)
+		}
+	}
+	return nil
+}
+
+// GetAd implements model.AdService.
+func (a *AdService) GetAd(ctx context.Context, adID string) (*model.Ad, error) {
+	a.wg.Add(1)
+	defer a.wg.Done()
+
+	requestID := uuid.New().String()
+
+	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
+	defer a.dispatcher.ResponseChan.Delete(requestID)
+
+	a.dispatcher.Send(&dispatcher.GetAdByIDRequest{
+		Request: dispatcher.Request{RequestID: requestID},
+		AdID:    adID,
+	})
+
+	select {
+	case resp := <-a.dispatcher.ResponseChan.Load(requestID):
+		if resp, ok := resp.(*dispatcher.GetAdByIDResponse); ok {
+			return resp.Ad, resp.Err
+		}
+	case <-time.After(3 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("get_ad").Inc()
+		return nil, ErrTimeout
+	}
+
+	return nil, ErrUnknown
+}
+
+// obtainLock obtains the lock of the write operations, and records the latency and the failures
+func (a *AdService) obtainLock(ctx context.Context) (*redislock.Lock, error) {
+	start := time.Now()
+	lock, err := a.locker.Obtain(ctx, a.lockKey, 100*time.Millisecond, &redislock.Options{
+		RetryStrategy: redislock.LimitRetry(redislock.ExponentialBackoff(1*time.Millisecond, 5*time.Millisecond), 10),
+	})
+	metrics.LockObtainDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.LockObtainFailures.Inc()
+	}
+	return lock, err
+}
+
+// publish marshals the request and appends it into the replicated log,
+// the sequence number of the entry is the version of the operation
+func (a *AdService) publish(ctx context.Context, msgType string, version int, req interface{}) error {
+	adReqMapStr, err := json.Marshal(req)
 	if err != nil {
 		log.Printf("error marshalling ad request: %v", err)
 		return err
 	}
-	// Publish to Redis Stream
-	// XADD ad 0-`SELECT MAX(version) FROM ads` {"ad": "adReqJsonStr"}
-	_, err = a.redis.XAdd(ctx, &redis.XAddArgs{
-		Stream:     a.adStream,
-		NoMkStream: false,
-		Approx:     false,
-		MaxLen:     100000,
-		Values: []interface{}{
-			"ad", string(adReqMapStr),
-			"type", "delete",
-		},
-		ID: fmt.Sprintf("0-%d", maxVersion),
-	}).Result()
+	err = a.replicatedLog.Append(ctx, &model.LogEntry{
+		Version: int64(version),
+		Type:    msgType,
+		Payload: adReqMapStr,
+	})
 	if err != nil {
-		log.Printf("error publishing to redis: %v", err)
+		log.Printf("error publishing to replicated log: %v", err)
 		return err
 	}
 	return nil
@@ -129,15 +232,30 @@ func (a *AdService) Shutdown(ctx context.Context) error {
 	}()
 	select {
 	case <-done:
-		return nil
 	case <-ctx.Done():
 		return ctx.Err()
 	}
+	// sync the impressions served before the shutdown
+	if a.capper != nil {
+		if err := a.capper.Close(ctx); err != nil {
+			return err
+		}
+	}
+	if a.pacer != nil {
+		return a.pacer.Close(ctx)
+	}
+	return nil
 }
 
 // Run implements model.AdService.
 func (a *AdService) Run() error {
 	go a.dispatcher.Start() // Start the dispatcher
+	if a.capper != nil {
+		go a.capper.Run()
+	}
+	if a.pacer != nil {
+		go a.pacer.Run()
+	}
 	stopCh := make(chan struct{}, 1)
 
 	a.wg.Add(1)
@@ -148,11 +266,13 @@ func (a *AdService) Run() error {
 	})
 
 	operation := func() error {
+		a.restored.Store(false)
 		err := a.Restore()
 		if err != nil {
 			log.Printf("error restoring: %v", err)
 			return err
 		}
+		a.restored.Store(true)
 		err = a.Subscribe()
 		if err != nil {
 			log.Printf("error subscribing: %v", err)
@@ -179,15 +299,65 @@ func (a *AdService) Run() error {
 	return nil
 }
 
-// Restore restores the latest version of an ad from the database.
-// It returns the version number of the restored ad and any error encountered.
-// The error could be ErrRecordNotFound if no ad is found or a DB connection error.
+// Restore restores the in-memory store from the newest snapshot on disk,
+// the entries after the snapshot are caught up by Subscribe.
+// It falls back to the database if the snapshot is missing, corrupted or can not be caught up from the replicated log.
 func (a *AdService) Restore() (err error) {
+	err = a.restoreFromSnapshot()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, model.ErrNoSnapshot) {
+		log.Printf("error restoring from snapshot, fallback to database: %v", err)
+	}
+	return a.restoreFromDB()
+}
+
+// restoreFromSnapshot loads the newest snapshot and checks the replicated log still holds every entry after it
+func (a *AdService) restoreFromSnapshot() error {
+	if a.snapshotter == nil {
+		return model.ErrNoSnapshot
+	}
+	snapshot, err := a.snapshotter.Load()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	latest, err := a.replicatedLog.LatestVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if latest < snapshot.Version {
+		return fmt.Errorf("snapshot version %d is ahead of the replicated log %d", snapshot.Version, latest)
+	}
+	if latest > snapshot.Version {
+		entries, err := a.replicatedLog.ReadFrom(ctx, snapshot.Version, 1, 0)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 || entries[0].Version != snapshot.Version+1 {
+			return fmt.Errorf("replicated log is trimmed after snapshot version %d", snapshot.Version)
+		}
+	}
+	if err := a.restoreAds(snapshot.Ads); err != nil {
+		return err
+	}
+	a.Version.Store(snapshot.Version)
+	a.snapshotVersion.Store(snapshot.Version)
+	log.Printf("Restored snapshot version: %d successfully\n", snapshot.Version)
+	return nil
+}
+
+// restoreFromDB restores the latest version of an ad from the database.
+// The error could be ErrRecordNotFound if no ad is found or a DB connection error.
+func (a *AdService) restoreFromDB() (err error) {
 	txn := a.db.Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead})
-	err = txn.Raw("SELECT COALESCE(MAX(version), 0) FROM ads").Scan(&a.Version).Error
+	var version int64
+	err = txn.Raw("SELECT COALESCE(MAX(version), 0) FROM ads").Scan(&version).Error
 	if err != nil {
 		return err
 	}
+	a.Version.Store(version)
 	var ads []*model.Ad
 	err = txn.Where("is_active = ?", true).Find(&ads).Error
 	if err != nil {
@@ -197,33 +367,81 @@ func (a *AdService) Restore() (err error) {
 	if err != nil {
 		return err
 	}
+	if err = a.restoreAds(ads); err != nil {
+		return err
+	}
+	log.Printf("Restored version: %d successfully\n", a.Version.Load())
+	return nil
+}
+
+// restoreAds sends the ads to the dispatcher in a batch
+func (a *AdService) restoreAds(ads []*model.Ad) error {
 	requestID := uuid.New().String()
 	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
 	defer a.dispatcher.ResponseChan.Delete(requestID)
-	a.dispatcher.RequestChan <- &dispatcher.CreateBatchAdRequest{
+	a.dispatcher.Send(&dispatcher.CreateBatchAdRequest{
 		Request: dispatcher.Request{RequestID: requestID},
 		Ads:     ads,
-	}
+	})
 
 	select {
 	case resp := <-a.dispatcher.ResponseChan.Load(requestID):
 		if resp, ok := resp.(*dispatcher.CreateAdResponse); ok {
-			if resp.Err == nil {
-				log.Printf("Restored version: %d successfully\n", a.Version)
-			}
 			return resp.Err
 		}
 	case <-time.After(10 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("restore").Inc()
 		return ErrTimeout
 	}
 	return ErrUnknown
 }
 
+// takeSnapshot collects the ads from the dispatcher and saves them in the background.
+// It must be called from the Subscribe loop, so the dispatcher has applied every entry up to the version.
+// The log is trimmed before the saved version, the instances whose snapshot or offset is older restore from the database.
+func (a *AdService) takeSnapshot() {
+	version := a.Version.Load()
+	if version == a.snapshotVersion.Load() || !a.snapshotting.CompareAndSwap(false, true) {
+		return
+	}
+	requestID := uuid.New().String()
+	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
+	defer a.dispatcher.ResponseChan.Delete(requestID)
+	a.dispatcher.Send(&dispatcher.SnapshotRequest{
+		Request: dispatcher.Request{RequestID: requestID},
+	})
+
+	select {
+	case resp := <-a.dispatcher.ResponseChan.Load(requestID):
+		if resp, ok := resp.(*dispatcher.SnapshotResponse); ok {
+			a.wg.Add(1)
+			go func() {
+				defer a.wg.Done()
+				defer a.snapshotting.Store(false)
+				err := a.snapshotter.Save(&model.Snapshot{Version: version, Ads: resp.Ads})
+				if err != nil {
+					log.Printf("error saving snapshot: %v", err)
+					return
+				}
+				a.snapshotVersion.Store(version)
+				log.Printf("saved snapshot version: %d with %d ads", version, len(resp.Ads))
+				if err := a.replicatedLog.Trim(context.Background(), version); err != nil {
+					log.Printf("error trimming replicated log before version %d: %v", version, err)
+				}
+			}()
+			return
+		}
+	case <-time.After(10 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("snapshot").Inc()
+		log.Printf("error taking snapshot: %v", ErrTimeout)
+	}
+	a.snapshotting.Store(false)
+}
+
 // Subscribe implements model.AdService.
 func (a *AdService) Subscribe() error {
-	log.Printf("subscribing to redis stream with offset: %d", a.Version)
+	log.Printf("subscribing to replicated log with offset: %d", a.Version.Load())
 	ctx := context.Background()
-	lastID := fmt.Sprintf("0-%d", a.Version) // Assuming offset can be mapped directly to Redis Stream IDs
 	stopCh := make(chan struct{}, 1)
 
 	a.wg.Add(1)
@@ -233,52 +451,92 @@ func (a *AdService) Subscribe() error {
 		close(stopCh)
 	})
 
+	// the snapshot is taken in this loop, a nil channel disables it
+	var snapshotTick <-chan time.Time
+	if a.snapshotter != nil {
+		ticker := time.NewTicker(a.snapshotInterval)
+		defer ticker.Stop()
+		snapshotTick = ticker.C
+	}
+	lagTicker := time.NewTicker(5 * time.Second)
+	defer lagTicker.Stop()
+
 	for a.shutdown.Load() == false {
 		select {
 		case <-stopCh:
 			return nil
+		case <-snapshotTick:
+			a.takeSnapshot()
+		case <-lagTicker.C:
+			a.recordLag(ctx)
 		default:
-			// Reading from the stream
-			xReadArgs := &redis.XReadArgs{
-				Streams: []string{a.adStream, lastID},
-				Block:   3 * time.Second,
-				Count:   10,
-			}
-			msgs, err := a.redis.XRead(ctx, xReadArgs).Result()
+			// Reading from the replicated log
+			entries, err := a.replicatedLog.ReadFrom(ctx, a.Version.Load(), 10, 3*time.Second)
 			if err != nil {
-				// log.Printf("error reading from redis: %v", err)
+				// log.Printf("error reading from replicated log: %v", err)
 				continue
 			}
-			for _, msg := range msgs {
-				for _, m := range msg.Messages {
-					log.Printf("received message: %v\n", m)
-					streamVersion, _ := strconv.ParseInt(strings.Split(m.ID, "-")[1], 10, 64)
-					if a.Version < int(streamVersion) {
-						a.Version = int(streamVersion)
-						lastID = m.ID
-					} else {
-						// our version is the same or higher than the stream version
-						continue
-					}
-					switch m.Values["type"].(string) {
-					case "create":
-						payload := &dispatcher.CreateAdRequest{}
-						json.Unmarshal([]byte(m.Values["ad"].(string)), payload)
-						a.dispatcher.RequestChan <- payload
-					case "delete":
-						payload := &dispatcher.DeleteAdRequest{}
-						json.Unmarshal([]byte(m.Values["ad"].(string)), payload)
-						a.dispatcher.RequestChan <- payload
-					default:
-						log.Printf("unknown message type: %s", m.Values["type"].(string))
-					}
+			for _, entry := range entries {
+				log.Printf("received entry: %d %s\n", entry.Version, entry.Type)
+				if a.Version.Load() < entry.Version {
+					a.Version.Store(entry.Version)
+				} else {
+					// our version is the same or higher than the log version
+					continue
+				}
+				var payload interface{}
+				switch entry.Type {
+				case model.LogTypeCreate:
+					payload = &dispatcher.CreateAdRequest{}
+				case model.LogTypeUpdate:
+					payload = &dispatcher.UpdateAdRequest{}
+				case model.LogTypeDelete:
+					payload = &dispatcher.DeleteAdRequest{}
+				case model.LogTypeCampaign:
+					payload = &dispatcher.CampaignRequest{}
+				default:
+					log.Printf("unknown entry type: %s", entry.Type)
+					continue
 				}
+				// a malformed entry is skipped, applying its zero value would corrupt the store
+				if err := json.Unmarshal(entry.Payload, payload); err != nil {
+					log.Printf("error decoding entry %d %s: %v", entry.Version, entry.Type, err)
+					continue
+				}
+				a.dispatcher.Send(payload)
 			}
 		}
 	}
 	return nil
 }
 
+// Ready implements model.AdService.
+func (a *AdService) Ready(ctx context.Context, maxLag int64) error {
+	if !a.restored.Load() {
+		return ErrNotRestored
+	}
+	latest, err := a.replicatedLog.LatestVersion(ctx)
+	if err != nil {
+		return err
+	}
+	lag := max(latest-a.Version.Load(), 0)
+	metrics.ReplicatedLogLag.Set(float64(lag))
+	if lag > maxLag {
+		return fmt.Errorf("%w: %d versions behind", ErrReplicaLagging, lag)
+	}
+	return nil
+}
+
+// recordLag records the versions between the head of the replicated log and the applied version
+func (a *AdService) recordLag(ctx context.Context) {
+	latest, err := a.replicatedLog.LatestVersion(ctx)
+	if err != nil {
+		log.Printf("error getting the latest version of replicated log: %v", err)
+		return
+	}
+	metrics.ReplicatedLogLag.Set(float64(max(latest-a.Version.Load(), 0)))
+}
+
 func (a *AdService) registerOnShutdown(f func()) {
 	a.mu.Lock()
 	a.onShutdown = append(a.onShutdown, f)
@@ -297,14 +555,13 @@ func (a *AdService) onShutdownNum() int {
 //
 // 2. stores the ad in the database, and set the version of the new ad to `SELECT MAX(version) FROM ad“ + 1
 //
-// 3. publishes the ad into redis stream. (ensure the message sequence number is the same as the ad's version)
+// 3. publishes the ad into the replicated log. (ensure the entry version is the same as the ad's version)
 //
 // 4. releases the lock
 func (a *AdService) storeAndPublishWithLock(ctx context.Context, ad *model.Ad, requestID string) (err error) {
+	principal, _ := model.PrincipalFromContext(ctx)
 	ctx = context.Background()
-	lock, err := a.locker.Obtain(ctx, a.lockKey, 100*time.Millisecond, &redislock.Options{
-		RetryStrategy: redislock.LimitRetry(redislock.ExponentialBackoff(1*time.Millisecond, 5*time.Millisecond), 10),
-	})
+	lock, err := a.obtainLock(ctx)
 	if err != nil {
 		log.Printf("error obtaining lock: %v", err)
 		return
@@ -324,7 +581,16 @@ func (a *AdService) storeAndPublishWithLock(ctx context.Context, ad *model.Ad, r
 		txn.Rollback()
 		return
 	}
+	if err = a.checkCampaign(txn, ad, principal); err != nil {
+		txn.Rollback()
+		return
+	}
 	ad.Version = maxVersion + 1
+	if ad.CreatedAt.T().IsZero() {
+		ad.CreatedAt = model.CustomTime(time.Now())
+	}
+	// the new ad has no impression yet
+	ad.Rank = a.getRanking().Rank(ad, 0)
 	if err = txn.Create(ad).Error; err != nil {
 		txn.Rollback()
 		return
@@ -337,36 +603,356 @@ func (a *AdService) storeAndPublishWithLock(ctx context.Context, ad *model.Ad, r
 		Request: dispatcher.Request{RequestID: requestID},
 		Ad:      ad,
 	}
-	// adReqMap, err := adReq.ToMap()
-	adReqMapStr, err := json.Marshal(adReq)
-	// return requestID, nil
-	// log.Printf("adReqJsonStr: %s", adReqJsonStr)
+	return a.publish(ctx, model.LogTypeCreate, ad.Version, adReq)
+}
+
+// updateAndPublishWithLock
+//
+// 1. locks the lockKey
+//
+// 2. applies the update to the active ad in the database, and set the version of the ad to `SELECT MAX(version) FROM ad“ + 1
+//
+// 3. publishes the updated ad into the replicated log.
+//
+// 4. releases the lock
+//
+// It returns the updated ad and the EndAt before the update
+func (a *AdService) updateAndPublishWithLock(ctx context.Context, adID string, req *model.UpdateAdRequest, requestID string) (ad *model.Ad, oldEndAt model.CustomTime, err error) {
+	principal, authenticated := model.PrincipalFromContext(ctx)
+	ctx = context.Background()
+	lock, err := a.obtainLock(ctx)
 	if err != nil {
-		log.Printf("error marshalling ad request: %v", err)
+		log.Printf("error obtaining lock: %v", err)
 		return
 	}
-	_, err = a.redis.XAdd(ctx, &redis.XAddArgs{
-		Stream:     a.adStream,
-		NoMkStream: false,
-		Approx:     false,
-		MaxLen:     100000,
-		Values: []interface{}{
-			"ad", string(adReqMapStr),
-			"type", "create",
-		},
-		ID: fmt.Sprintf("0-%d", ad.Version),
-	}).Result()
-	if err != nil {
-		log.Printf("error publishing to redis: %v", err)
+	defer func() {
+		err := lock.Release(ctx)
+		if err != nil {
+			log.Printf("error releasing lock: %v", err)
+		}
+	}()
+	txn := a.db.Begin()
+	if err = txn.Error; err != nil {
 		return
 	}
+	ad = &model.Ad{}
+	if err = txn.Where("id = ? AND is_active = ?", adID, true).First(ad).Error; err != nil {
+		txn.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = ErrAdNotFound
+		}
+		return nil, oldEndAt, err
+	}
+	if authenticated && !principal.CanModify(ad) {
+		txn.Rollback()
+		return nil, oldEndAt, ErrForbidden
+	}
+	oldEndAt = ad.EndAt
+	req.Apply(ad)
+	if err = validateAd(ad); err != nil {
+		txn.Rollback()
+		return nil, oldEndAt, err
+	}
+	// the ownership of the ad is checked above, only the flight dates of the campaign are checked
+	if err = a.checkCampaign(txn, ad, nil); err != nil {
+		txn.Rollback()
+		return nil, oldEndAt, err
+	}
+	if err = a.rankAd(txn, ad); err != nil {
+		txn.Rollback()
+		return nil, oldEndAt, err
+	}
+	var maxVersion int
+	if err = txn.Raw("SELECT COALESCE(MAX(version), 0) FROM ads").Scan(&maxVersion).Error; err != nil {
+		txn.Rollback()
+		return nil, oldEndAt, err
+	}
+	ad.Version = maxVersion + 1
+	if err = txn.Save(ad).Error; err != nil {
+		txn.Rollback()
+		return nil, oldEndAt, err
+	}
+	if err = txn.Commit().Error; err != nil {
+		return nil, oldEndAt, err
+	}
+	adReq := &dispatcher.UpdateAdRequest{
+		Request: dispatcher.Request{RequestID: requestID},
+		Ad:      ad,
+	}
+	if err = a.publish(ctx, model.LogTypeUpdate, ad.Version, adReq); err != nil {
+		return nil, oldEndAt, err
+	}
+	return ad, oldEndAt, nil
+}
+
+// validateAd validates the ad by the binding of model.CreateAdRequest and its exclusion lists,
+// so the patched ads are validated as the created ones, e.g. a patch can not clear every inclusion list
+// of a field without an exclusion list or a targeting expression, or leave the app versions reversed
+func validateAd(ad *model.Ad) error {
+	if err := binding.Validator.ValidateStruct(ad.ToCreateAdRequest()); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAd, err)
+	}
+	if err := ad.CheckExclusions(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAd, err)
+	}
+	return nil
+}
+
+func (a *AdService) getRanking() *model.Ranking {
+	if a.ranking == nil {
+		return model.DefaultRanking()
+	}
+	return a.ranking
+}
+
+// rankAd re-ranks the updated ad, the CTR of the ad is only queried if the ranking counts it.
+// The rank is persisted and replicated with the ad, so every instance serves the ads in the same order.
+func (a *AdService) rankAd(txn *gorm.DB, ad *model.Ad) error {
+	ranking := a.getRanking()
+	var ctr float64
+	if ranking.CTRWeight != 0 {
+		var stats struct {
+			Impressions int64
+			Clicks      int64
+		}
+		err := txn.Model(&model.AdStatsHourly{}).
+			Select("COALESCE(SUM(impressions), 0) AS impressions, COALESCE(SUM(clicks), 0) AS clicks").
+			Where("ad_id = ?", ad.ID).
+			Scan(&stats).Error
+		if err != nil {
+			return err
+		}
+		ctr = ranking.CTR(stats.Impressions, stats.Clicks)
+	}
+	ad.Rank = ranking.Rank(ad, ctr)
+	return nil
+}
+
+// ownershipError tells apart the ad owned by another principal from the missing ad,
+// after the delete restricted to the owner affects no row
+func (a *AdService) ownershipError(adID string) error {
+	var count int64
+	if err := a.db.Model(&model.Ad{}).Where("id = ? AND is_active = ?", adID, true).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrForbidden
+	}
+	return ErrAdNotFound
+}
+
+// checkCampaign checks the ad can be served in its campaign, and cascades the status of the campaign to the ad.
+// The principal must own the campaign if it is not nil.
+func (a *AdService) checkCampaign(txn *gorm.DB, ad *model.Ad, principal *model.Principal) error {
+	if ad.CampaignID == nil {
+		return nil
+	}
+	campaign := &model.Campaign{}
+	if err := txn.Where("id = ?", ad.CampaignID).First(campaign).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: campaign %s not found", ErrInvalidAd, ad.CampaignID)
+		}
+		return err
+	}
+	if principal != nil {
+		owner, err := advertiserOwner(txn, campaign.AdvertiserID)
+		if err != nil {
+			return err
+		}
+		if !principal.Owns(owner) {
+			return ErrForbidden
+		}
+	}
+	if campaign.Status == model.CampaignStatusEnded {
+		return fmt.Errorf("%w: campaign %s is ended", ErrInvalidAd, campaign.ID)
+	}
+	if !campaign.Contains(ad) {
+		return fmt.Errorf("%w: ad is out of the flight dates of campaign %s", ErrInvalidAd, campaign.ID)
+	}
+	ad.CampaignPaused = campaign.Status == model.CampaignStatusPaused
 	return nil
 }
 
+// advertiserOwner returns the owner of the advertiser, or ErrAdvertiserNotFound
+func advertiserOwner(txn *gorm.DB, advertiserID uuid.UUID) (string, error) {
+	advertiser := &model.Advertiser{}
+	if err := txn.Where("id = ?", advertiserID).First(advertiser).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrAdvertiserNotFound
+		}
+		return "", err
+	}
+	return advertiser.OwnerID, nil
+}
+
+// cascadeAndPublishWithLock
+//
+// 1. locks the lockKey
+//
+// 2. changes the status of the campaign, and applies it to the active ads of the campaign in the database,
+// the ads share the version `SELECT MAX(version) FROM ad“ + 1
+//
+// 3. publishes the cascade into the replicated log if the campaign has any active ad.
+//
+// 4. releases the lock
+//
+// It returns the updated campaign and the IDs of its active ads
+func (a *AdService) cascadeAndPublishWithLock(ctx context.Context, campaignID string, status model.CampaignStatus, requestID string) (campaign *model.Campaign, adIDs []string, err error) {
+	principal, authenticated := model.PrincipalFromContext(ctx)
+	ctx = context.Background()
+	lock, err := a.obtainLock(ctx)
+	if err != nil {
+		log.Printf("error obtaining lock: %v", err)
+		return
+	}
+	defer func() {
+		err := lock.Release(ctx)
+		if err != nil {
+			log.Printf("error releasing lock: %v", err)
+		}
+	}()
+	txn := a.db.Begin()
+	if err = txn.Error; err != nil {
+		return
+	}
+	campaign = &model.Campaign{}
+	if err = txn.Where("id = ?", campaignID).First(campaign).Error; err != nil {
+		txn.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = ErrCampaignNotFound
+		}
+		return nil, nil, err
+	}
+	if authenticated {
+		owner, err := advertiserOwner(txn, campaign.AdvertiserID)
+		if err != nil {
+			txn.Rollback()
+			return nil, nil, err
+		}
+		if !principal.Owns(owner) {
+			txn.Rollback()
+			return nil, nil, ErrForbidden
+		}
+	}
+	if campaign.Status == model.CampaignStatusEnded {
+		txn.Rollback()
+		return nil, nil, fmt.Errorf("%w: campaign %s is ended", ErrInvalidCampaign, campaign.ID)
+	}
+	if campaign.Status == status {
+		txn.Rollback()
+		return campaign, nil, nil
+	}
+	// the session makes the query reusable by the pluck and the update below
+	active := txn.Model(&model.Ad{}).Where("campaign_id = ? AND is_active = ?", campaignID, true).Session(&gorm.Session{})
+	if err = active.Pluck("id", &adIDs).Error; err != nil {
+		txn.Rollback()
+		return nil, nil, err
+	}
+	var maxVersion int
+	if len(adIDs) > 0 {
+		if err = txn.Raw("SELECT COALESCE(MAX(version), 0) FROM ads").Scan(&maxVersion).Error; err != nil {
+			txn.Rollback()
+			return nil, nil, err
+		}
+		maxVersion++
+		updates := map[string]interface{}{"version": maxVersion}
+		switch status {
+		case model.CampaignStatusEnded:
+			updates["is_active"] = false
+		default:
+			updates["campaign_paused"] = status == model.CampaignStatusPaused
+		}
+		if err = active.Updates(updates).Error; err != nil {
+			txn.Rollback()
+			return nil, nil, err
+		}
+		if status == model.CampaignStatusEnded {
+			if err = txn.Delete(&model.Ad{}, "version < ? AND is_active = false", maxVersion).Error; err != nil {
+				txn.Rollback()
+				return nil, nil, err
+			}
+		}
+	}
+	campaign.Status = status
+	if err = txn.Model(campaign).Update("status", status).Error; err != nil {
+		txn.Rollback()
+		return nil, nil, err
+	}
+	if err = txn.Commit().Error; err != nil {
+		return nil, nil, err
+	}
+	if len(adIDs) == 0 {
+		return campaign, nil, nil
+	}
+	err = a.publish(ctx, model.LogTypeCampaign, maxVersion, &dispatcher.CampaignRequest{
+		Request:    dispatcher.Request{RequestID: requestID},
+		CampaignID: campaignID,
+		Status:     status,
+		Version:    maxVersion,
+		AdIDs:      adIDs,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return campaign, adIDs, nil
+}
+
+// SetCampaignStatus implements model.AdService.
+func (a *AdService) SetCampaignStatus(ctx context.Context, campaignID string, status model.CampaignStatus) (*model.Campaign, error) {
+	switch status {
+	case model.CampaignStatusActive, model.CampaignStatusPaused, model.CampaignStatusEnded:
+	default:
+		return nil, fmt.Errorf("%w: unknown status %s", ErrInvalidCampaign, status)
+	}
+	a.wg.Add(1)
+	defer a.wg.Done()
+	requestID := uuid.New().String()
+	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
+	defer a.dispatcher.ResponseChan.Delete(requestID)
+	campaign, adIDs, err := a.cascadeAndPublishWithLock(ctx, campaignID, status, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if len(adIDs) == 0 {
+		// nothing is published, there is no response from the dispatcher
+		return campaign, nil
+	}
+
+	if status == model.CampaignStatusEnded {
+		// it is best effort, a leftover task gets ErrAdNotFound and is discarded by the task handler
+		for _, adID := range adIDs {
+			if err := a.cancelAdDeleteTask(adID); err != nil {
+				log.Printf("error cancelling delete task of ad %s: %v", adID, err)
+			}
+		}
+	}
+
+	select {
+	case resp := <-a.dispatcher.ResponseChan.Load(requestID):
+		if resp, ok := resp.(*dispatcher.CampaignResponse); ok {
+			return campaign, resp.Err
+		}
+	case <-time.After(3 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("set_campaign_status").Inc()
+		return nil, ErrTimeout
+	}
+
+	return nil, ErrUnknown
+}
+
 // CreateAd implements model.AdService.
 func (a *AdService) CreateAd(ctx context.Context, ad *model.Ad) (adID string, err error) {
 	a.wg.Add(1)
 	defer a.wg.Done()
+	if principal, ok := model.PrincipalFromContext(ctx); ok {
+		if !principal.CanWrite() {
+			return "", ErrForbidden
+		}
+		ad.OwnerID = principal.ID
+	}
+	if err := validateAd(ad); err != nil {
+		return "", err
+	}
 	requestID := uuid.New().String()
 	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
 	defer a.dispatcher.ResponseChan.Delete(requestID)
@@ -386,12 +972,76 @@ func (a *AdService) CreateAd(ctx context.Context, ad *model.Ad) (adID string, er
 			return resp.AdID, resp.Err
 		}
 	case <-time.After(3 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("create_ad").Inc()
 		return "", ErrTimeout
 	}
 
 	return "", ErrUnknown
 }
 
+// UpdateAd implements model.AdService.
+// The updated ad is returned with ErrDeleteTaskNotRescheduled if the update is applied but its delete task is not moved to the new EndAt.
+func (a *AdService) UpdateAd(ctx context.Context, adID string, req *model.UpdateAdRequest) (*model.Ad, error) {
+	a.wg.Add(1)
+	defer a.wg.Done()
+	requestID := uuid.New().String()
+	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
+	defer a.dispatcher.ResponseChan.Delete(requestID)
+	ad, oldEndAt, err := a.updateAndPublishWithLock(ctx, adID, req, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rescheduleErr error
+	if !ad.EndAt.T().Equal(oldEndAt.T()) {
+		// the update is committed and published, so the failed reschedule is reported with the updated ad,
+		// the ad would otherwise be deleted at its old EndAt or kept in the database until then
+		rescheduleBackoff := backoff.NewExponentialBackOff()
+		rescheduleBackoff.InitialInterval = 100 * time.Millisecond
+		rescheduleErr = backoff.Retry(func() error {
+			return a.rescheduleAdDeleteTask(ad)
+		}, backoff.WithMaxRetries(rescheduleBackoff, 3))
+		if rescheduleErr != nil {
+			log.Printf("error rescheduling delete task of ad %s: %v", ad.ID, rescheduleErr)
+			rescheduleErr = fmt.Errorf("%w: %v", ErrDeleteTaskNotRescheduled, rescheduleErr)
+		}
+	}
+
+	select {
+	case resp := <-a.dispatcher.ResponseChan.Load(requestID):
+		if resp, ok := resp.(*dispatcher.UpdateAdResponse); ok {
+			if resp.Err != nil {
+				return ad, resp.Err
+			}
+			return ad, rescheduleErr
+		}
+	case <-time.After(3 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("update_ad").Inc()
+		return nil, ErrTimeout
+	}
+
+	return nil, ErrUnknown
+}
+
+// rescheduleAdDeleteTask cancels the pending delete task of the ad and registers a new one at the new EndAt
+func (a *AdService) rescheduleAdDeleteTask(ad *model.Ad) error {
+	err := a.cancelAdDeleteTask(ad.ID.String())
+	if err != nil {
+		return err
+	}
+	return a.registerAdDeleteTask(ad)
+}
+
+// cancelAdDeleteTask deletes the pending delete task of the ad, it is a no-op if the task does not exist
+func (a *AdService) cancelAdDeleteTask(adID string) error {
+	taskID := fmt.Sprintf("%s-%s", model.AsynqDeletePayload{}.TypeName(), adID)
+	err := a.asynqInspector.DeleteTask("default", taskID)
+	if err != nil && !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound) {
+		return err
+	}
+	return nil
+}
+
 func (a *AdService) registerAdDeleteTask(ad *model.Ad) error {
 	payload := &model.AsynqDeletePayload{AdID: ad.ID.String()}
 	task, err := payload.ToTask()
@@ -409,19 +1059,80 @@ func (a *AdService) registerAdDeleteTask(ad *model.Ad) error {
 }
 
 // GetAds implements model.AdService.
-func (a *AdService) GetAds(ctx context.Context, req *model.GetAdRequest) ([]*model.Ad, int, error) {
+// The ads out of their budgets, and the ads capped for the user if the request has a user ID,
+// are skipped and backfilled by the next ranked ads, and the served ads are counted by the budgets and the caps.
+// The total includes the skipped ads. The ads matching the interests of the request are boosted by the tag weight of the ranking.
+func (a *AdService) GetAds(ctx context.Context, req *model.GetAdRequest) (*model.GetAdsPageResponse, error) {
 	a.wg.Add(1)
 	defer a.wg.Done()
 
+	if req.After != nil && req.After.Version > a.Version.Load() {
+		// the cursor is issued by a replica which has applied more logs than us
+		return nil, ErrReplicaBehind
+	}
+
+	if len(req.Tags) > 0 {
+		req.TagBoost = a.getRanking().TagBoost()
+	}
+	// fetch one more ad to know whether there is a next page
+	storeReq := *req
+	storeReq.Limit++
+	ads, total, err := a.getAdsFromStore(&storeReq)
+	if err != nil {
+		return nil, err
+	}
+	if a.pacer == nil && (req.UserID == "" || a.capper == nil) {
+		return a.newAdsPage(req, ads, total), nil
+	}
+
+	served := a.filterServed(ctx, req, ads)
+	for round := 1; round < maxBackfillRounds && len(served) < storeReq.Limit && len(ads) == storeReq.Limit; round++ {
+		// backfill from the ads ranked after the last candidate
+		last := ads[len(ads)-1]
+		storeReq.Offset = 0
+		storeReq.After = &model.AdCursor{Score: req.Score(last), AdID: last.ID.String()}
+		if ads, _, err = a.getAdsFromStore(&storeReq); err != nil {
+			return nil, err
+		}
+		served = append(served, a.filterServed(ctx, req, ads)...)
+	}
+	page := a.newAdsPage(req, served, total)
+	if !page.HasMore && len(ads) == storeReq.Limit {
+		// the backfill stopped before the candidates ran out, the next page continues after the last scanned candidate
+		page.HasMore = true
+		page.NextCursor = a.nextCursor(req, ads[len(ads)-1])
+	}
+	if a.pacer != nil {
+		a.pacer.Record(ctx, page.Ads)
+	}
+	if req.UserID != "" && a.capper != nil {
+		a.capper.Record(ctx, req.UserID, page.Ads)
+	}
+	return page, nil
+}
+
+// filterServed skips the candidates out of their budgets or capped for the user
+func (a *AdService) filterServed(ctx context.Context, req *model.GetAdRequest, ads []*model.Ad) []*model.Ad {
+	if a.pacer != nil {
+		ads = a.pacer.Filter(ctx, ads)
+	}
+	if req.UserID != "" && a.capper != nil {
+		ads = a.capper.Filter(ctx, req.UserID, ads)
+	}
+	return ads
+}
+
+// getAdsFromStore queries the in-memory store through the dispatcher
+func (a *AdService) getAdsFromStore(req *model.GetAdRequest) ([]*model.Ad, int, error) {
 	requestID := uuid.New().String()
 
 	a.dispatcher.ResponseChan.Store(requestID, make(chan interface{}, 1))
 	defer a.dispatcher.ResponseChan.Delete(requestID)
 
-	a.dispatcher.RequestChan <- &dispatcher.GetAdRequest{
+	a.dispatcher.Send(&dispatcher.GetAdRequest{
 		Request:      dispatcher.Request{RequestID: requestID},
 		GetAdRequest: req,
-	}
+	})
 
 	select {
 	case resp := <-a.dispatcher.ResponseChan.Load(requestID):
@@ -429,23 +1140,51 @@ func (a *AdService) GetAds(ctx context.Context, req *model.GetAdRequest) ([]*mod
 			return resp.Ads, resp.Total, resp.Err
 		}
 	case <-time.After(3 * time.Second):
+		metrics.ResponseTimeouts.WithLabelValues("get_ads").Inc()
 		return nil, 0, ErrTimeout
 	}
 
 	return nil, 0, ErrUnknown
 }
 
-func NewAdService(dispatcher *dispatcher.Dispatcher, db *gorm.DB, redis *redis.Client, locker *redislock.Client, asynqClient *asynq.Client) model.AdService {
+// newAdsPage trims the extra ad fetched by GetAds and sets the cursor of the next page
+func (a *AdService) newAdsPage(req *model.GetAdRequest, ads []*model.Ad, total int) *model.GetAdsPageResponse {
+	page := &model.GetAdsPageResponse{Ads: ads, Total: total}
+	if len(ads) <= req.Limit {
+		return page
+	}
+	page.Ads = ads[:req.Limit]
+	page.HasMore = true
+	page.NextCursor = a.nextCursor(req, page.Ads[len(page.Ads)-1])
+	return page
+}
+
+// nextCursor returns the encoded cursor of the ads ranked after the last ad of a page
+func (a *AdService) nextCursor(req *model.GetAdRequest, last *model.Ad) string {
+	cursor := &model.AdCursor{
+		Score:   req.Score(last),
+		AdID:    last.ID.String(),
+		Version: a.Version.Load(),
+	}
+	return cursor.Encode()
+}
+
+// NewAdService creates the ad service, the snapshot is disabled if the snapshotter is nil
+func NewAdService(dispatcher *dispatcher.Dispatcher, db *gorm.DB, replicatedLog model.ReplicatedLog, snapshotter model.Snapshotter, snapshotInterval time.Duration, ranking *model.Ranking, capper model.FrequencyCapper, pacer model.BudgetPacer, locker *redislock.Client, asynqClient *asynq.Client, asynqInspector *asynq.Inspector) model.AdService {
 	return &AdService{
-		dispatcher:  dispatcher,
-		db:          db,
-		redis:       redis,
-		locker:      locker,
-		lockKey:     "lock:ad",
-		onShutdown:  make([]func(), 0),
-		adStream:    "ad",
-		asynqClient: asynqClient,
-		shutdown:    atomic.Bool{},
-		Version:     0,
+		dispatcher:       dispatcher,
+		db:               db,
+		replicatedLog:    replicatedLog,
+		snapshotter:      snapshotter,
+		snapshotInterval: snapshotInterval,
+		ranking:          ranking,
+		capper:           capper,
+		pacer:            pacer,
+		locker:           locker,
+		lockKey:          "lock:ad",
+		onShutdown:       make([]func(), 0),
+		asynqClient:      asynqClient,
+		asynqInspector:   asynqInspector,
+		shutdown:         atomic.Bool{},
 	}
 }
@@ -7,6 +7,8 @@ import (
 	"dcard-backend-2024/pkg/dispatcher"
 	"dcard-backend-2024/pkg/inmem"
 	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/replog"
+	"dcard-backend-2024/pkg/snapshot"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -52,9 +54,15 @@ func boot() (app *bootstrap.Application, services *bootstrap.Services, mocks *bo
 	adService := NewAdService(
 		app.Dispatcher,
 		app.Conn,
-		app.Cache,
+		app.ReplicatedLog,
+		app.Snapshotter,
+		app.Env.Snapshot.Interval,
+		bootstrap.NewRanking(app.Env),
+		app.FrequencyCapper,
+		app.BudgetPacer,
 		app.RedisLock,
 		app.AsynqClient,
+		app.AsynqInspector,
 	)
 	services = &bootstrap.Services{
 		AdService: adService,
@@ -131,12 +139,11 @@ func TestAdService_storeAndPublishWithLock(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &AdService{
-				dispatcher: tt.fields.dispatcher,
-				db:         tt.fields.db,
-				redis:      tt.fields.redis,
-				locker:     tt.fields.locker,
-				lockKey:    tt.fields.lockKey,
-				adStream:   tt.fields.adStream,
+				dispatcher:    tt.fields.dispatcher,
+				db:            tt.fields.db,
+				replicatedLog: replog.NewRedisStreamLog(tt.fields.redis, tt.fields.adStream),
+				locker:        tt.fields.locker,
+				lockKey:       tt.fields.lockKey,
 			}
 			mocks.CacheMock.Regexp().ExpectEvalSha(".", []string{tt.fields.lockKey}, ".", ".", ".").SetVal(".")
 			mocks.DBMock.ExpectBegin()
@@ -147,6 +154,7 @@ func TestAdService_storeAndPublishWithLock(t *testing.T) {
 					AnyString{},
 					tt.args.ad.Title,
 					tt.args.ad.Content,
+					tt.args.ad.LandingURL,
 					AnyTime{},
 					AnyTime{},
 					tt.args.ad.AgeStart,
@@ -154,6 +162,25 @@ func TestAdService_storeAndPublishWithLock(t *testing.T) {
 					pq.StringArray(tt.args.ad.Gender),
 					pq.StringArray(tt.args.ad.Country),
 					pq.StringArray(tt.args.ad.Platform),
+					pq.StringArray(tt.args.ad.ExcludeGender),
+					pq.StringArray(tt.args.ad.ExcludeCountry),
+					pq.StringArray(tt.args.ad.ExcludePlatform),
+					pq.StringArray(tt.args.ad.Language),
+					pq.StringArray(tt.args.ad.Region),
+					tt.args.ad.AppVersionStart,
+					tt.args.ad.AppVersionEnd,
+					tt.args.ad.Targeting,
+					tt.args.ad.Schedule,
+					tt.args.ad.Geo,
+					pq.StringArray(tt.args.ad.Tags),
+					tt.args.ad.OwnerID,
+					tt.args.ad.CampaignID,
+					tt.args.ad.CampaignPaused,
+					tt.args.ad.Bid,
+					sqlmock.AnyArg(),
+					tt.args.ad.MaxImpressionsPerUserPerDay,
+					tt.args.ad.DailyBudget,
+					tt.args.ad.LifetimeBudget,
 					tt.args.ad.Version,
 					true,
 					AnyTime{},
@@ -238,13 +265,12 @@ func TestAdService_CreateAd(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &AdService{
-				dispatcher:  tt.fields.dispatcher,
-				db:          tt.fields.db,
-				redis:       tt.fields.redis,
-				locker:      tt.fields.locker,
-				lockKey:     tt.fields.lockKey,
-				adStream:    tt.fields.adStream,
-				asynqClient: tt.fields.asynqClient,
+				dispatcher:    tt.fields.dispatcher,
+				db:            tt.fields.db,
+				replicatedLog: replog.NewRedisStreamLog(tt.fields.redis, tt.fields.adStream),
+				locker:        tt.fields.locker,
+				lockKey:       tt.fields.lockKey,
+				asynqClient:   tt.fields.asynqClient,
 			}
 			mocks.DBMock.ExpectBegin()
 			mocks.DBMock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM ads").
@@ -274,6 +300,7 @@ func TestAdService_CreateAd(t *testing.T) {
 					AnyString{},
 					tt.args.ad.Title,
 					tt.args.ad.Content,
+					tt.args.ad.LandingURL,
 					AnyTime{},
 					AnyTime{},
 					tt.args.ad.AgeStart,
@@ -281,6 +308,25 @@ func TestAdService_CreateAd(t *testing.T) {
 					pq.StringArray(tt.args.ad.Gender),
 					pq.StringArray(tt.args.ad.Country),
 					pq.StringArray(tt.args.ad.Platform),
+					pq.StringArray(tt.args.ad.ExcludeGender),
+					pq.StringArray(tt.args.ad.ExcludeCountry),
+					pq.StringArray(tt.args.ad.ExcludePlatform),
+					pq.StringArray(tt.args.ad.Language),
+					pq.StringArray(tt.args.ad.Region),
+					tt.args.ad.AppVersionStart,
+					tt.args.ad.AppVersionEnd,
+					tt.args.ad.Targeting,
+					tt.args.ad.Schedule,
+					tt.args.ad.Geo,
+					pq.StringArray(tt.args.ad.Tags),
+					tt.args.ad.OwnerID,
+					tt.args.ad.CampaignID,
+					tt.args.ad.CampaignPaused,
+					tt.args.ad.Bid,
+					sqlmock.AnyArg(),
+					tt.args.ad.MaxImpressionsPerUserPerDay,
+					tt.args.ad.DailyBudget,
+					tt.args.ad.LifetimeBudget,
 					tt.args.ad.Version,
 					true,
 					AnyTime{},
@@ -316,6 +362,114 @@ func TestAdService_CreateAd(t *testing.T) {
 	}
 }
 
+func TestAdService_DeleteAd(t *testing.T) {
+	a := &AdService{
+		dispatcher:    app.Dispatcher,
+		db:            app.Conn,
+		replicatedLog: replog.NewRedisStreamLog(app.Cache, adStream+uuid.New().String()),
+		locker:        app.RedisLock,
+		lockKey:       lockKey + uuid.New().String(),
+	}
+	adID := uuid.New().String()
+	mocks.CacheMock.Regexp().ExpectEvalSha(".", []string{a.lockKey}, ".", ".", ".").SetVal(".")
+	mocks.DBMock.ExpectBegin()
+	mocks.DBMock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM ads").
+		WillReturnRows(mocks.DBMock.NewRows([]string{"COALESCE"}).AddRow(1))
+	mocks.DBMock.ExpectExec("^UPDATE \"ads\" SET .+ WHERE id = .+ AND is_active = .+$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mocks.DBMock.ExpectRollback()
+	mocks.CacheMock.CustomMatch(func(expected, actual []interface{}) error {
+		return nil
+	}).ExpectEvalSha(".", []string{a.lockKey}, ".").SetVal(".")
+
+	err := a.DeleteAd(context.Background(), adID)
+	assert.ErrorIs(t, err, ErrAdNotFound)
+}
+
+func TestAdService_DeleteAd_NotOwner(t *testing.T) {
+	a := &AdService{
+		dispatcher:    app.Dispatcher,
+		db:            app.Conn,
+		replicatedLog: replog.NewRedisStreamLog(app.Cache, adStream+uuid.New().String()),
+		locker:        app.RedisLock,
+		lockKey:       lockKey + uuid.New().String(),
+	}
+	adID := uuid.New().String()
+	mocks.CacheMock.Regexp().ExpectEvalSha(".", []string{a.lockKey}, ".", ".", ".").SetVal(".")
+	mocks.DBMock.ExpectBegin()
+	mocks.DBMock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM ads").
+		WillReturnRows(mocks.DBMock.NewRows([]string{"COALESCE"}).AddRow(1))
+	mocks.DBMock.ExpectExec("^UPDATE \"ads\" SET .+ WHERE \\(id = .+ AND is_active = .+\\) AND owner_id = .+$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mocks.DBMock.ExpectRollback()
+	mocks.DBMock.ExpectQuery("SELECT count\\(\\*\\) FROM \"ads\" WHERE id = .+ AND is_active = .+").
+		WillReturnRows(mocks.DBMock.NewRows([]string{"count"}).AddRow(1))
+	mocks.CacheMock.CustomMatch(func(expected, actual []interface{}) error {
+		return nil
+	}).ExpectEvalSha(".", []string{a.lockKey}, ".").SetVal(".")
+
+	ctx := model.WithPrincipal(context.Background(), &model.Principal{ID: "advertiser-1", Role: model.RoleAdvertiser})
+	err := a.DeleteAd(ctx, adID)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+func TestAdService_CreateAd_Reader(t *testing.T) {
+	a := &AdService{
+		dispatcher: app.Dispatcher,
+		db:         app.Conn,
+	}
+	ctx := model.WithPrincipal(context.Background(), &model.Principal{ID: "reader-1", Role: model.RoleReader})
+	_, err := a.CreateAd(ctx, &model.Ad{Title: "test"})
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+func TestValidateAd(t *testing.T) {
+	newAd := func() *model.Ad {
+		return &model.Ad{
+			Title:    "test validate",
+			Content:  "test validate",
+			StartAt:  model.CustomTime(time.Now()),
+			EndAt:    model.CustomTime(time.Now().Add(time.Hour)),
+			AgeStart: 18,
+			AgeEnd:   65,
+			Gender:   []string{"M"},
+			Country:  []string{"TW"},
+			Platform: []string{"ios"},
+		}
+	}
+	v1, v2 := model.AppVersion(1<<32), model.AppVersion(2<<32)
+	tests := []struct {
+		name    string
+		patch   model.UpdateAdRequest
+		wantErr bool
+	}{
+		{name: "unchanged"},
+		{name: "inclusion list replaced by an exclusion list", patch: model.UpdateAdRequest{Country: []string{}, ExcludeCountry: []string{"JP"}}},
+		{name: "every inclusion list cleared", patch: model.UpdateAdRequest{Country: []string{}}, wantErr: true},
+		{name: "value included and excluded", patch: model.UpdateAdRequest{ExcludeCountry: []string{"TW"}}, wantErr: true},
+		{name: "EndAt before StartAt", patch: model.UpdateAdRequest{EndAt: &model.CustomTime{}}, wantErr: true},
+		{name: "AgeStart after AgeEnd", patch: model.UpdateAdRequest{AgeStart: &[]uint8{70}[0]}, wantErr: true},
+		{name: "app versions in order", patch: model.UpdateAdRequest{AppVersionMin: &v1, AppVersionMax: &v2}},
+		{name: "app versions reversed", patch: model.UpdateAdRequest{AppVersionMin: &v2, AppVersionMax: &v1}, wantErr: true},
+		{name: "unbounded app version", patch: model.UpdateAdRequest{AppVersionMin: &v2, AppVersionMax: new(model.AppVersion)}},
+		{name: "invalid targeting", patch: model.UpdateAdRequest{Targeting: &[]string{"country IN ("}[0]}, wantErr: true},
+		{name: "distinct tags", patch: model.UpdateAdRequest{Tags: []string{"Gaming", "music"}}},
+		{name: "tags differing in case", patch: model.UpdateAdRequest{Tags: []string{"Gaming", "gaming"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ad := newAd()
+			tt.patch.Apply(ad)
+			err := validateAd(ad)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidAd)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
 func TestAdService_GetAds(t *testing.T) {
 	type fields struct {
 		dispatcher *dispatcher.Dispatcher
@@ -365,13 +519,12 @@ func TestAdService_GetAds(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &AdService{
-				shutdown:   atomic.Bool{},
-				dispatcher: tt.fields.dispatcher,
-				db:         tt.fields.db,
-				redis:      tt.fields.redis,
-				locker:     tt.fields.locker,
-				lockKey:    tt.fields.lockKey,
-				adStream:   tt.fields.adStream,
+				shutdown:      atomic.Bool{},
+				dispatcher:    tt.fields.dispatcher,
+				db:            tt.fields.db,
+				replicatedLog: replog.NewRedisStreamLog(tt.fields.redis, tt.fields.adStream),
+				locker:        tt.fields.locker,
+				lockKey:       tt.fields.lockKey,
 			}
 			mocks.DBMock.ExpectBegin()
 			mocks.DBMock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM ads").
@@ -392,21 +545,311 @@ func TestAdService_GetAds(t *testing.T) {
 				}
 			}
 			cancel()
-			got, got1, err := a.GetAds(tt.args.ctx, tt.args.req)
+			page, err := a.GetAds(tt.args.ctx, tt.args.req)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("AdService.GetAds() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("AdService.GetAds() got = %v, want %v", got, tt.want)
+			if !reflect.DeepEqual(page.Ads, tt.want) {
+				t.Errorf("AdService.GetAds() got = %v, want %v", page.Ads, tt.want)
 			}
-			if got1 != tt.want1 {
-				t.Errorf("AdService.GetAds() got1 = %v, want %v", got1, tt.want1)
+			if page.Total != tt.want1 {
+				t.Errorf("AdService.GetAds() got1 = %v, want %v", page.Total, tt.want1)
 			}
 		})
 	}
 }
 
+// capAds caps the ads in capped, and records the served ads
+type capAds struct {
+	capped map[uuid.UUID]bool
+	served []*model.Ad
+}
+
+func (c *capAds) Filter(ctx context.Context, userID string, ads []*model.Ad) []*model.Ad {
+	ret := []*model.Ad{}
+	for _, ad := range ads {
+		if !c.capped[ad.ID] {
+			ret = append(ret, ad)
+		}
+	}
+	return ret
+}
+
+func (c *capAds) Record(ctx context.Context, userID string, ads []*model.Ad) {
+	c.served = append(c.served, ads...)
+}
+
+func (c *capAds) Run() {}
+
+func (c *capAds) Close(ctx context.Context) error { return nil }
+
+func TestAdService_GetAds_FrequencyCap(t *testing.T) {
+	store := inmem.NewInMemoryStore()
+	ads := make([]*model.Ad, 0, 15)
+	for i := 0; i < 15; i++ {
+		ads = append(ads, &model.Ad{
+			ID:                          uuid.New(),
+			StartAt:                     model.CustomTime(time.Now().Add(-time.Hour)),
+			EndAt:                       model.CustomTime(time.Now().Add(time.Hour)),
+			AgeStart:                    18,
+			AgeEnd:                      65,
+			Country:                     []string{"TW"},
+			Rank:                        int64(100 - i),
+			MaxImpressionsPerUserPerDay: 1,
+			Version:                     i + 1,
+		})
+	}
+	assert.Nil(t, store.CreateBatchAds(ads))
+	d := dispatcher.NewDispatcher(store)
+	go d.Start()
+	for !d.IsRunning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the first page of candidates is capped, and one of the second page
+	capper := &capAds{capped: map[uuid.UUID]bool{ads[7].ID: true}}
+	for _, ad := range ads[:6] {
+		capper.capped[ad.ID] = true
+	}
+	a := &AdService{dispatcher: d, capper: capper}
+	page, err := a.GetAds(context.Background(), &model.GetAdRequest{Age: 30, Country: "TW", Limit: 5, UserID: "user-1"})
+	assert.Nil(t, err)
+	want := []*model.Ad{ads[6], ads[8], ads[9], ads[10], ads[11]}
+	assert.Equal(t, want, page.Ads)
+	assert.Equal(t, 15, page.Total)
+	assert.True(t, page.HasMore)
+	assert.Equal(t, want, capper.served)
+
+	// the caps are not enforced without the user
+	capper.served = nil
+	page, err = a.GetAds(context.Background(), &model.GetAdRequest{Age: 30, Country: "TW", Limit: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, ads[:5], page.Ads)
+	assert.Empty(t, capper.served)
+}
+
+// overBudget throttles the ads in exhausted, and records the served ads
+type overBudget struct {
+	exhausted map[uuid.UUID]bool
+	served    []*model.Ad
+}
+
+func (p *overBudget) Filter(ctx context.Context, ads []*model.Ad) []*model.Ad {
+	ret := []*model.Ad{}
+	for _, ad := range ads {
+		if !p.exhausted[ad.ID] {
+			ret = append(ret, ad)
+		}
+	}
+	return ret
+}
+
+func (p *overBudget) Record(ctx context.Context, ads []*model.Ad) {
+	p.served = append(p.served, ads...)
+}
+
+func (p *overBudget) Run() {}
+
+func (p *overBudget) Close(ctx context.Context) error { return nil }
+
+func TestAdService_GetAds_BackfillExhausted(t *testing.T) {
+	store := inmem.NewInMemoryStore()
+	ads := make([]*model.Ad, 0, 15)
+	for i := 0; i < 15; i++ {
+		ads = append(ads, &model.Ad{
+			ID:       uuid.New(),
+			StartAt:  model.CustomTime(time.Now().Add(-time.Hour)),
+			EndAt:    model.CustomTime(time.Now().Add(time.Hour)),
+			AgeStart: 18,
+			AgeEnd:   65,
+			Country:  []string{"TW"},
+			Rank:     int64(100 - i),
+			Version:  i + 1,
+		})
+	}
+	assert.Nil(t, store.CreateBatchAds(ads))
+	d := dispatcher.NewDispatcher(store)
+	go d.Start()
+	for !d.IsRunning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a page of 2 ads reads 3 candidates per round, every candidate of the backfill rounds is skipped
+	skipped := make(map[uuid.UUID]bool)
+	for _, ad := range ads[:3*maxBackfillRounds] {
+		skipped[ad.ID] = true
+	}
+	tests := []struct {
+		name string
+		a    *AdService
+	}{
+		{name: "frequency caps", a: &AdService{dispatcher: d, capper: &capAds{capped: skipped}}},
+		{name: "budgets", a: &AdService{dispatcher: d, pacer: &overBudget{exhausted: skipped}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &model.GetAdRequest{Age: 30, Country: "TW", Limit: 2, UserID: "user-1"}
+			page, err := tt.a.GetAds(context.Background(), req)
+			assert.Nil(t, err)
+			assert.Empty(t, page.Ads)
+			// the next page continues after the last scanned candidate
+			assert.True(t, page.HasMore)
+			cursor, err := model.DecodeAdCursor(page.NextCursor)
+			assert.Nil(t, err)
+			assert.Equal(t, ads[3*maxBackfillRounds-1].ID.String(), cursor.AdID)
+
+			req.After = cursor
+			page, err = tt.a.GetAds(context.Background(), req)
+			assert.Nil(t, err)
+			assert.Equal(t, ads[3*maxBackfillRounds:3*maxBackfillRounds+2], page.Ads)
+			assert.True(t, page.HasMore)
+		})
+	}
+}
+
+func TestAdService_newAdsPage(t *testing.T) {
+	a := &AdService{}
+	a.Version.Store(7)
+	ads := []*model.Ad{
+		{ID: uuid.New(), Rank: 3},
+		{ID: uuid.New(), Rank: 2},
+		{ID: uuid.New(), Rank: 1},
+	}
+
+	page := a.newAdsPage(&model.GetAdRequest{Limit: 2}, ads, 10)
+	assert.Len(t, page.Ads, 2)
+	assert.Equal(t, 10, page.Total)
+	assert.True(t, page.HasMore)
+	cursor, err := model.DecodeAdCursor(page.NextCursor)
+	assert.Nil(t, err)
+	assert.Equal(t, ads[1].ID.String(), cursor.AdID)
+	assert.Equal(t, int64(-2), cursor.Score)
+	assert.Equal(t, int64(7), cursor.Version)
+
+	page = a.newAdsPage(&model.GetAdRequest{Limit: 3}, ads, 3)
+	assert.Len(t, page.Ads, 3)
+	assert.False(t, page.HasMore)
+	assert.Empty(t, page.NextCursor)
+
+	_, err = a.GetAds(context.Background(), &model.GetAdRequest{Limit: 2, After: &model.AdCursor{AdID: "x", Version: 8}})
+	assert.ErrorIs(t, err, ErrReplicaBehind)
+}
+
+func TestAdService_restoreFromSnapshot(t *testing.T) {
+	ad := &model.Ad{
+		ID:       uuid.New(),
+		Title:    "test",
+		Content:  "test",
+		StartAt:  model.CustomTime(time.Now().Add(-1 * time.Hour * 24)),
+		EndAt:    model.CustomTime(time.Now().Add(1 * time.Hour * 24)),
+		AgeStart: 18,
+		AgeEnd:   65,
+		Gender:   []string{"F", "M"},
+		Country:  []string{"TW"},
+		Platform: []string{"ios"},
+		Version:  5,
+		IsActive: true,
+	}
+	tests := []struct {
+		name            string
+		snapshotVersion int64
+		logVersions     []int64
+		disabled        bool
+		wantErr         bool
+	}{
+		{
+			name:            "catch up from the log",
+			snapshotVersion: 5,
+			logVersions:     []int64{4, 5, 6, 7},
+		},
+		{
+			name:            "log is up to date",
+			snapshotVersion: 5,
+			logVersions:     []int64{5},
+		},
+		{
+			name:            "log is trimmed after the snapshot",
+			snapshotVersion: 5,
+			logVersions:     []int64{7, 8},
+			wantErr:         true,
+		},
+		{
+			name:            "snapshot is ahead of the log",
+			snapshotVersion: 5,
+			logVersions:     []int64{1, 2, 3},
+			wantErr:         true,
+		},
+		{
+			name:     "snapshot is disabled",
+			disabled: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicatedLog, err := replog.NewFileLog("")
+			assert.Nil(t, err)
+			for _, version := range tt.logVersions {
+				assert.Nil(t, replicatedLog.Append(context.Background(), &model.LogEntry{Version: version, Type: model.LogTypeCreate}))
+			}
+			a := &AdService{
+				dispatcher:    dispatcher.NewDispatcher(inmem.NewInMemoryStore()),
+				replicatedLog: replicatedLog,
+			}
+			go a.dispatcher.Start()
+			if !tt.disabled {
+				snapshotter, err := snapshot.NewFileSnapshotter(t.TempDir(), 1)
+				assert.Nil(t, err)
+				assert.Nil(t, snapshotter.Save(&model.Snapshot{Version: tt.snapshotVersion, Ads: []*model.Ad{ad}}))
+				a.snapshotter = snapshotter
+			}
+
+			err = a.restoreFromSnapshot()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AdService.restoreFromSnapshot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				assert.Equal(t, int64(0), a.Version.Load())
+				return
+			}
+			assert.Equal(t, tt.snapshotVersion, a.Version.Load())
+			restored, err := a.dispatcher.Store.GetAdByID(ad.ID.String())
+			assert.Nil(t, err)
+			assert.Equal(t, ad.Title, restored.Title)
+		})
+	}
+}
+
+func TestAdService_takeSnapshot(t *testing.T) {
+	replicatedLog, err := replog.NewFileLog("")
+	assert.Nil(t, err)
+	for _, version := range []int64{4, 5, 6} {
+		assert.Nil(t, replicatedLog.Append(context.Background(), &model.LogEntry{Version: version, Type: model.LogTypeCreate}))
+	}
+	snapshotter, err := snapshot.NewFileSnapshotter(t.TempDir(), 1)
+	assert.Nil(t, err)
+	a := &AdService{
+		dispatcher:    dispatcher.NewDispatcher(inmem.NewInMemoryStore()),
+		replicatedLog: replicatedLog,
+		snapshotter:   snapshotter,
+	}
+	go a.dispatcher.Start()
+	a.Version.Store(5)
+
+	a.takeSnapshot()
+	a.wg.Wait()
+	assert.Equal(t, int64(5), a.snapshotVersion.Load())
+	saved, err := snapshotter.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), saved.Version)
+	// the entries before the snapshot are trimmed, the snapshot can still catch up from the log
+	entries, err := replicatedLog.ReadFrom(context.Background(), 0, 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(5), entries[0].Version)
+}
+
 func TestAdService_Shutdown(t *testing.T) {
 	type fields struct {
 		dispatcher *dispatcher.Dispatcher
@@ -445,13 +888,12 @@ func TestAdService_Shutdown(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &AdService{
-				shutdown:   atomic.Bool{},
-				dispatcher: tt.fields.dispatcher,
-				db:         tt.fields.db,
-				redis:      tt.fields.redis,
-				locker:     tt.fields.locker,
-				lockKey:    tt.fields.lockKey,
-				adStream:   tt.fields.adStream,
+				shutdown:      atomic.Bool{},
+				dispatcher:    tt.fields.dispatcher,
+				db:            tt.fields.db,
+				replicatedLog: replog.NewRedisStreamLog(tt.fields.redis, tt.fields.adStream),
+				locker:        tt.fields.locker,
+				lockKey:       tt.fields.lockKey,
 			}
 			mocks.DBMock.ExpectBegin()
 			mocks.DBMock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) FROM ads").
@@ -484,3 +926,91 @@ func TestAdService_Shutdown(t *testing.T) {
 		})
 	}
 }
+
+func TestAdService_Ready(t *testing.T) {
+	tests := []struct {
+		name     string
+		restored bool
+		latest   int64
+		version  int64
+		maxLag   int64
+		wantErr  error
+	}{
+		{
+			name:     "not restored",
+			restored: false,
+			latest:   0,
+			version:  0,
+			maxLag:   10,
+			wantErr:  ErrNotRestored,
+		},
+		{
+			name:     "caught up",
+			restored: true,
+			latest:   5,
+			version:  5,
+			maxLag:   10,
+			wantErr:  nil,
+		},
+		{
+			name:     "within max lag",
+			restored: true,
+			latest:   15,
+			version:  5,
+			maxLag:   10,
+			wantErr:  nil,
+		},
+		{
+			name:     "lagging",
+			restored: true,
+			latest:   16,
+			version:  5,
+			maxLag:   10,
+			wantErr:  ErrReplicaLagging,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicatedLog, err := replog.NewFileLog("")
+			assert.Nil(t, err)
+			for v := int64(1); v <= tt.latest; v++ {
+				assert.Nil(t, replicatedLog.Append(context.Background(), &model.LogEntry{Version: v, Type: model.LogTypeCreate}))
+			}
+			a := &AdService{replicatedLog: replicatedLog}
+			a.restored.Store(tt.restored)
+			a.Version.Store(tt.version)
+			err = a.Ready(context.Background(), tt.maxLag)
+			if tt.wantErr == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdService_SetCampaignStatus(t *testing.T) {
+	a := &AdService{
+		dispatcher:    app.Dispatcher,
+		db:            app.Conn,
+		replicatedLog: replog.NewRedisStreamLog(app.Cache, adStream+uuid.New().String()),
+		locker:        app.RedisLock,
+		lockKey:       lockKey + uuid.New().String(),
+	}
+	campaignID := uuid.New().String()
+
+	_, err := a.SetCampaignStatus(context.Background(), campaignID, model.CampaignStatus("archived"))
+	assert.ErrorIs(t, err, ErrInvalidCampaign)
+
+	mocks.CacheMock.Regexp().ExpectEvalSha(".", []string{a.lockKey}, ".", ".", ".").SetVal(".")
+	mocks.DBMock.ExpectBegin()
+	mocks.DBMock.ExpectQuery("SELECT (.+) FROM \"campaigns\" WHERE id = .+").
+		WillReturnRows(mocks.DBMock.NewRows([]string{"id", "advertiser_id", "name", "status"}))
+	mocks.DBMock.ExpectRollback()
+	mocks.CacheMock.CustomMatch(func(expected, actual []interface{}) error {
+		return nil
+	}).ExpectEvalSha(".", []string{a.lockKey}, ".").SetVal(".")
+
+	_, err = a.SetCampaignStatus(context.Background(), campaignID, model.CampaignStatusPaused)
+	assert.ErrorIs(t, err, ErrCampaignNotFound)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type CampaignService struct {
+	db        *gorm.DB
+	adService model.AdService
+}
+
+// CreateAdvertiser implements model.CampaignService.
+// The advertiser is owned by the caller, only the admins can create it on behalf of another principal.
+func (svc *CampaignService) CreateAdvertiser(ctx context.Context, req *model.CreateAdvertiserRequest) (*model.Advertiser, error) {
+	advertiser := &model.Advertiser{
+		Name:      req.Name,
+		OwnerID:   req.OwnerID,
+		CreatedAt: model.CustomTime(time.Now()),
+	}
+	if principal, ok := model.PrincipalFromContext(ctx); ok {
+		if !principal.CanWrite() {
+			return nil, ErrForbidden
+		}
+		if principal.Role != model.RoleAdmin || advertiser.OwnerID == "" {
+			advertiser.OwnerID = principal.ID
+		}
+	}
+	if err := svc.db.WithContext(ctx).Create(advertiser).Error; err != nil {
+		return nil, err
+	}
+	return advertiser, nil
+}
+
+// CreateCampaign implements model.CampaignService.
+func (svc *CampaignService) CreateCampaign(ctx context.Context, req *model.CreateCampaignRequest) (*model.Campaign, error) {
+	if !req.EndAt.T().After(req.StartAt.T()) {
+		return nil, fmt.Errorf("%w: end_at must be after start_at", ErrInvalidCampaign)
+	}
+	db := svc.db.WithContext(ctx)
+	owner, err := advertiserOwner(db, req.AdvertiserID)
+	if err != nil {
+		return nil, err
+	}
+	if principal, ok := model.PrincipalFromContext(ctx); ok && !principal.Owns(owner) {
+		return nil, ErrForbidden
+	}
+	campaign := &model.Campaign{
+		AdvertiserID: req.AdvertiserID,
+		Name:         req.Name,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		Status:       model.CampaignStatusActive,
+		CreatedAt:    model.CustomTime(time.Now()),
+	}
+	if err := db.Create(campaign).Error; err != nil {
+		return nil, err
+	}
+	return campaign, nil
+}
+
+// GetCampaign implements model.CampaignService.
+func (svc *CampaignService) GetCampaign(ctx context.Context, campaignID string) (*model.Campaign, error) {
+	campaign := &model.Campaign{}
+	if err := svc.db.WithContext(ctx).Where("id = ?", campaignID).First(campaign).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCampaignNotFound
+		}
+		return nil, err
+	}
+	return campaign, nil
+}
+
+// SetCampaignStatus implements model.CampaignService.
+// The status is cascaded by the ad service, since the ads are only written through the replicated log.
+func (svc *CampaignService) SetCampaignStatus(ctx context.Context, campaignID string, status model.CampaignStatus) (*model.Campaign, error) {
+	return svc.adService.SetCampaignStatus(ctx, campaignID, status)
+}
+
+func NewCampaignService(db *gorm.DB, adService model.AdService) model.CampaignService {
+	return &CampaignService{
+		db:        db,
+		adService: adService,
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrDBUnreachable is returned by Ready when the database does not respond, 503
+	ErrDBUnreachable = fmt.Errorf("database is unreachable")
+	// ErrRedisUnreachable is returned by Ready when redis does not respond, 503
+	ErrRedisUnreachable = fmt.Errorf("redis is unreachable")
+)
+
+type HealthService struct {
+	db        *gorm.DB
+	cache     *redis.Client
+	adService model.AdService
+	// maxLag is the max number of versions the subscriber can fall behind the replicated log while ready
+	maxLag int64
+}
+
+// Live implements model.HealthService.
+// The process is live as long as it can serve the request, the dependencies are not checked
+// so an outage of Redis or Postgres does not restart every instance.
+func (h *HealthService) Live(ctx context.Context) error {
+	return nil
+}
+
+// Ready implements model.HealthService.
+func (h *HealthService) Ready(ctx context.Context) error {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDBUnreachable, err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrDBUnreachable, err)
+	}
+	if err := h.cache.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrRedisUnreachable, err)
+	}
+	return h.adService.Ready(ctx, h.maxLag)
+}
+
+func NewHealthService(db *gorm.DB, cache *redis.Client, adService model.AdService, maxLag int64) model.HealthService {
+	return &HealthService{
+		db:        db,
+		cache:     cache,
+		adService: adService,
+		maxLag:    maxLag,
+	}
+}
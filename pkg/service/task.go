@@ -2,8 +2,10 @@ package service
 
 import (
 	"context"
+	"dcard-backend-2024/pkg/metrics"
 	"dcard-backend-2024/pkg/model"
 	"encoding/json"
+	"errors"
 
 	"github.com/hibiken/asynq"
 )
@@ -16,9 +18,21 @@ type TaskService struct {
 func (svc *TaskService) HandleDeleteAd(ctx context.Context, t *asynq.Task) error {
 	var deletePayload model.AsynqDeletePayload
 	if err := json.Unmarshal(t.Payload(), &deletePayload); err != nil {
+		metrics.DeleteTasks.WithLabelValues("invalid").Inc()
 		return err
 	}
-	return svc.adService.DeleteAd(ctx, deletePayload.AdID)
+	err := svc.adService.DeleteAd(ctx, deletePayload.AdID)
+	if errors.Is(err, ErrAdNotFound) {
+		// the ad is already taken down manually
+		metrics.DeleteTasks.WithLabelValues("not_found").Inc()
+		return nil
+	}
+	if err != nil {
+		metrics.DeleteTasks.WithLabelValues("error").Inc()
+		return err
+	}
+	metrics.DeleteTasks.WithLabelValues("deleted").Inc()
+	return nil
 }
 
 func (svc *TaskService) RegisterTaskHandler(mux *asynq.ServeMux) {
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"dcard-backend-2024/pkg/tracking"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidStatsRange is returned when the from of the stats is not before the to, 400
+	ErrInvalidStatsRange = fmt.Errorf("invalid stats range")
+)
+
+type TrackingService struct {
+	adService model.AdService
+	db        *gorm.DB
+	writer    model.EventWriter
+}
+
+// TrackImpression implements model.TrackingService.
+func (svc *TrackingService) TrackImpression(ctx context.Context, adID string) error {
+	_, err := svc.track(ctx, adID, model.EventTypeImpression)
+	return err
+}
+
+// TrackClick implements model.TrackingService.
+func (svc *TrackingService) TrackClick(ctx context.Context, adID string) (string, error) {
+	ad, err := svc.track(ctx, adID, model.EventTypeClick)
+	if err != nil {
+		return "", err
+	}
+	return ad.LandingURL, nil
+}
+
+// track records the event of the served ad.
+// The event dropped by a full buffer is not an error of the request, it is counted by the metrics.
+func (svc *TrackingService) track(ctx context.Context, adID string, eventType model.EventType) (*model.Ad, error) {
+	ad, err := svc.adService.GetAd(ctx, adID)
+	if err != nil {
+		return nil, err
+	}
+	err = svc.writer.Write(&model.TrackingEvent{AdID: ad.ID, Type: eventType, At: time.Now()})
+	if err != nil && !errors.Is(err, tracking.ErrBufferFull) {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// GetAdStats implements model.TrackingService.
+// The stats only include the flushed events, they lag behind by the flush interval of the writer.
+// The stats are the business data of the owner, so only the admins and the owning advertisers may read them, not the readers.
+func (svc *TrackingService) GetAdStats(ctx context.Context, adID string, req *model.GetAdStatsRequest) (*model.AdStats, error) {
+	to := req.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from := req.From
+	if from.IsZero() {
+		from = to.Add(-24 * time.Hour)
+	}
+	from = from.Truncate(time.Hour)
+	if !from.Before(to) {
+		return nil, ErrInvalidStatsRange
+	}
+	db := svc.db.WithContext(ctx)
+	if principal, ok := model.PrincipalFromContext(ctx); ok && principal.Role != model.RoleAdmin {
+		// the ad may be taken down, its row is kept until a newer version is deleted
+		ad := &model.Ad{}
+		if err := db.Select("id", "owner_id").Where("id = ?", adID).First(ad).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrAdNotFound
+			}
+			return nil, err
+		}
+		if !principal.Owns(ad.OwnerID) {
+			return nil, ErrForbidden
+		}
+	}
+	var rows []*model.AdStatsHourly
+	err := db.Where("ad_id = ? AND hour >= ? AND hour < ?", adID, from, to).Order("hour").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	stats := &model.AdStats{
+		AdID:   adID,
+		From:   model.CustomTime(from),
+		To:     model.CustomTime(to),
+		Hourly: rows,
+	}
+	for _, row := range rows {
+		stats.Impressions += row.Impressions
+		stats.Clicks += row.Clicks
+	}
+	if stats.Impressions > 0 {
+		stats.CTR = float64(stats.Clicks) / float64(stats.Impressions)
+	}
+	return stats, nil
+}
+
+// Run implements model.TrackingService.
+func (svc *TrackingService) Run() {
+	svc.writer.Run()
+}
+
+// Shutdown implements model.TrackingService.
+func (svc *TrackingService) Shutdown(ctx context.Context) error {
+	return svc.writer.Close(ctx)
+}
+
+func NewTrackingService(adService model.AdService, db *gorm.DB, writer model.EventWriter) model.TrackingService {
+	return &TrackingService{
+		adService: adService,
+		db:        db,
+		writer:    writer,
+	}
+}
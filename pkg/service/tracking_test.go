@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"dcard-backend-2024/pkg/model"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackingService_GetAdStats(t *testing.T) {
+	hour := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		principal       *model.Principal
+		ownerID         string
+		req             *model.GetAdStatsRequest
+		rows            [][]driver.Value
+		wantImpressions int64
+		wantClicks      int64
+		wantCTR         float64
+		wantErr         error
+	}{
+		{
+			name: "Test GetAdStats",
+			req:  &model.GetAdStatsRequest{From: hour.Add(30 * time.Minute), To: hour.Add(3 * time.Hour)},
+			rows: [][]driver.Value{
+				{hour, 100, 3},
+				{hour.Add(time.Hour), 300, 1},
+			},
+			wantImpressions: 400,
+			wantClicks:      4,
+			wantCTR:         0.01,
+		},
+		{
+			name: "Test GetAdStats without impressions",
+			req:  &model.GetAdStatsRequest{From: hour, To: hour.Add(time.Hour)},
+		},
+		{
+			name:            "Test GetAdStats owner",
+			principal:       &model.Principal{ID: "advertiser-1", Role: model.RoleAdvertiser},
+			ownerID:         "advertiser-1",
+			req:             &model.GetAdStatsRequest{From: hour, To: hour.Add(time.Hour)},
+			rows:            [][]driver.Value{{hour, 10, 5}},
+			wantImpressions: 10,
+			wantClicks:      5,
+			wantCTR:         0.5,
+		},
+		{
+			name:      "Test GetAdStats Forbidden",
+			principal: &model.Principal{ID: "advertiser-2", Role: model.RoleAdvertiser},
+			ownerID:   "advertiser-1",
+			req:       &model.GetAdStatsRequest{From: hour, To: hour.Add(time.Hour)},
+			wantErr:   ErrForbidden,
+		},
+		{
+			name:      "Test GetAdStats Reader Forbidden",
+			principal: &model.Principal{ID: "reader-1", Role: model.RoleReader},
+			ownerID:   "advertiser-1",
+			req:       &model.GetAdStatsRequest{From: hour, To: hour.Add(time.Hour)},
+			wantErr:   ErrForbidden,
+		},
+		{
+			name:    "Test GetAdStats InvalidRange",
+			req:     &model.GetAdStatsRequest{From: hour.Add(10 * time.Minute), To: hour},
+			wantErr: ErrInvalidStatsRange,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &TrackingService{db: app.Conn}
+			adID := uuid.NewString()
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = model.WithPrincipal(ctx, tt.principal)
+				mocks.DBMock.ExpectQuery("SELECT \"id\",\"owner_id\" FROM \"ads\" WHERE id = .+").
+					WithArgs(adID).
+					WillReturnRows(mocks.DBMock.NewRows([]string{"id", "owner_id"}).AddRow(adID, tt.ownerID))
+			}
+			if tt.wantErr == nil {
+				rows := mocks.DBMock.NewRows([]string{"ad_id", "hour", "impressions", "clicks"})
+				for _, row := range tt.rows {
+					rows.AddRow(append([]driver.Value{adID}, row...)...)
+				}
+				mocks.DBMock.ExpectQuery("SELECT \\* FROM \"ad_stats_hourly\" WHERE ad_id = .+ AND hour >= .+ AND hour < .+ ORDER BY hour").
+					WithArgs(adID, AnyTime{}, AnyTime{}).
+					WillReturnRows(rows)
+			}
+
+			stats, err := svc.GetAdStats(ctx, adID, tt.req)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, adID, stats.AdID)
+			assert.True(t, tt.req.From.Truncate(time.Hour).Equal(stats.From.T()))
+			assert.Len(t, stats.Hourly, len(tt.rows))
+			assert.Equal(t, tt.wantImpressions, stats.Impressions)
+			assert.Equal(t, tt.wantClicks, stats.Clicks)
+			assert.InDelta(t, tt.wantCTR, stats.CTR, 1e-9)
+		})
+	}
+}
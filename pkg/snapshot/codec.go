@@ -0,0 +1,358 @@
+package snapshot
+
+import (
+	"bytes"
+	"dcard-backend-2024/pkg/model"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The snapshot file layout:
+//
+//	magic "ADSS" | format uint8 | version varint | count uvarint | ads... | crc32 uint32 (big endian)
+//
+// Every ad is encoded field by field in the declaration order of model.Ad,
+// strings are prefixed by their uvarint length, times are encoded by time.Time.MarshalBinary
+// and floats by their IEEE 754 bits in big endian.
+const (
+	magic = "ADSS"
+	// formatVersion is bumped whenever the fields of the ad change,
+	// the snapshots of the other formats are rejected and the store is restored from the database.
+	// 1: the initial format, 2: Ad.OwnerID, 3: Ad.CampaignID and Ad.CampaignPaused, 4: Ad.LandingURL, 5: Ad.Bid and Ad.Rank,
+	// 6: Ad.MaxImpressionsPerUserPerDay, 7: Ad.DailyBudget and Ad.LifetimeBudget,
+	// 8: Ad.ExcludeGender, Ad.ExcludeCountry and Ad.ExcludePlatform, 9: Ad.Targeting,
+	// 10: Ad.Language, Ad.Region, Ad.AppVersionStart and Ad.AppVersionEnd, 11: Ad.Schedule, 12: Ad.Geo,
+	// 13: Ad.Tags
+	formatVersion = 13
+	checksumSize  = 4
+)
+
+var (
+	// ErrCorrupted is returned when the snapshot can not be decoded or the checksum does not match
+	ErrCorrupted = fmt.Errorf("corrupted snapshot")
+)
+
+// Encode encodes the snapshot into the binary format
+func Encode(snapshot *model.Snapshot) ([]byte, error) {
+	e := &encoder{}
+	e.buf.WriteString(magic)
+	e.buf.WriteByte(formatVersion)
+	e.varint(snapshot.Version)
+	e.uvarint(uint64(len(snapshot.Ads)))
+	for _, ad := range snapshot.Ads {
+		if err := e.ad(ad); err != nil {
+			return nil, err
+		}
+	}
+	e.buf.Write(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(e.buf.Bytes())))
+	return e.buf.Bytes(), nil
+}
+
+// Decode decodes the snapshot, it returns ErrCorrupted if the data is not a valid snapshot
+func Decode(data []byte) (*model.Snapshot, error) {
+	if len(data) < len(magic)+1+checksumSize || string(data[:len(magic)]) != magic {
+		return nil, ErrCorrupted
+	}
+	body, sum := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, ErrCorrupted
+	}
+	if body[len(magic)] != formatVersion {
+		return nil, fmt.Errorf("%w: unsupported format %d", ErrCorrupted, body[len(magic)])
+	}
+	d := &decoder{data: body[len(magic)+1:]}
+	snapshot := &model.Snapshot{Version: d.varint()}
+	count := d.uvarint()
+	// every ad takes far more than one byte, it guards the allocation against a bogus count
+	if count > uint64(len(d.data)) {
+		return nil, ErrCorrupted
+	}
+	snapshot.Ads = make([]*model.Ad, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		snapshot.Ads = append(snapshot.Ads, d.ad())
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return nil, ErrCorrupted
+	}
+	return snapshot, nil
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) strings(s []string) {
+	e.uvarint(uint64(len(s)))
+	for _, v := range s {
+		e.bytes([]byte(v))
+	}
+}
+
+func (e *encoder) schedule(s model.Schedule) {
+	e.uvarint(uint64(len(s)))
+	for _, w := range s {
+		e.strings(w.Weekdays)
+		e.buf.WriteByte(w.StartHour)
+		e.buf.WriteByte(w.EndHour)
+	}
+}
+
+func (e *encoder) geo(g model.GeoCircles) {
+	e.uvarint(uint64(len(g)))
+	for _, c := range g {
+		e.float(c.Lat)
+		e.float(c.Long)
+		e.float(c.RadiusKm)
+	}
+}
+
+func (e *encoder) float(f float64) {
+	e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func (e *encoder) time(t model.CustomTime) error {
+	b, err := t.T().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	e.bytes(b)
+	return nil
+}
+
+func (e *encoder) ad(ad *model.Ad) error {
+	e.buf.Write(ad.ID[:])
+	e.bytes([]byte(ad.Title))
+	e.bytes([]byte(ad.Content))
+	e.bytes([]byte(ad.LandingURL))
+	if err := e.time(ad.StartAt); err != nil {
+		return err
+	}
+	if err := e.time(ad.EndAt); err != nil {
+		return err
+	}
+	e.buf.WriteByte(ad.AgeStart)
+	e.buf.WriteByte(ad.AgeEnd)
+	e.strings(ad.Gender)
+	e.strings(ad.Country)
+	e.strings(ad.Platform)
+	e.strings(ad.ExcludeGender)
+	e.strings(ad.ExcludeCountry)
+	e.strings(ad.ExcludePlatform)
+	e.strings(ad.Language)
+	e.strings(ad.Region)
+	e.uvarint(uint64(ad.AppVersionStart))
+	e.uvarint(uint64(ad.AppVersionEnd))
+	e.bytes([]byte(ad.Targeting))
+	e.schedule(ad.Schedule)
+	e.geo(ad.Geo)
+	e.strings(ad.Tags)
+	e.bytes([]byte(ad.OwnerID))
+	if ad.CampaignID != nil {
+		e.buf.WriteByte(1)
+		e.buf.Write(ad.CampaignID[:])
+	} else {
+		e.buf.WriteByte(0)
+	}
+	e.bool(ad.CampaignPaused)
+	e.float(ad.Bid)
+	e.varint(ad.Rank)
+	e.uvarint(uint64(ad.MaxImpressionsPerUserPerDay))
+	e.uvarint(ad.DailyBudget)
+	e.uvarint(ad.LifetimeBudget)
+	e.varint(int64(ad.Version))
+	e.bool(ad.IsActive)
+	return e.time(ad.CreatedAt)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+// decoder reads the fields in order, the first error is kept and the following reads are no-op
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.err = ErrCorrupted
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	return d.next(d.uvarint())
+}
+
+func (d *decoder) strings() []string {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = ErrCorrupted
+		return nil
+	}
+	s := make([]string, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		s = append(s, string(d.bytes()))
+	}
+	return s
+}
+
+func (d *decoder) geo() model.GeoCircles {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = ErrCorrupted
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	g := make(model.GeoCircles, n)
+	for i := range g {
+		g[i].Lat = d.float()
+		g[i].Long = d.float()
+		g[i].RadiusKm = d.float()
+	}
+	return g
+}
+
+func (d *decoder) float() float64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) schedule() model.Schedule {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = ErrCorrupted
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	s := make(model.Schedule, n)
+	for i := range s {
+		s[i].Weekdays = d.strings()
+		s[i].StartHour = d.byte()
+		s[i].EndHour = d.byte()
+	}
+	return s
+}
+
+func (d *decoder) time() model.CustomTime {
+	var t time.Time
+	b := d.bytes()
+	if d.err != nil {
+		return model.CustomTime(t)
+	}
+	if err := t.UnmarshalBinary(b); err != nil {
+		d.err = ErrCorrupted
+	}
+	return model.CustomTime(t)
+}
+
+func (d *decoder) ad() *model.Ad {
+	ad := &model.Ad{}
+	ad.ID, _ = uuid.FromBytes(d.next(16))
+	ad.Title = string(d.bytes())
+	ad.Content = string(d.bytes())
+	ad.LandingURL = string(d.bytes())
+	ad.StartAt = d.time()
+	ad.EndAt = d.time()
+	ad.AgeStart = d.byte()
+	ad.AgeEnd = d.byte()
+	ad.Gender = d.strings()
+	ad.Country = d.strings()
+	ad.Platform = d.strings()
+	ad.ExcludeGender = d.strings()
+	ad.ExcludeCountry = d.strings()
+	ad.ExcludePlatform = d.strings()
+	ad.Language = d.strings()
+	ad.Region = d.strings()
+	ad.AppVersionStart = model.AppVersion(d.uvarint())
+	ad.AppVersionEnd = model.AppVersion(d.uvarint())
+	ad.Targeting = string(d.bytes())
+	ad.Schedule = d.schedule()
+	ad.Geo = d.geo()
+	ad.Tags = d.strings()
+	ad.OwnerID = string(d.bytes())
+	if d.byte() == 1 {
+		campaignID, _ := uuid.FromBytes(d.next(16))
+		ad.CampaignID = &campaignID
+	}
+	ad.CampaignPaused = d.byte() == 1
+	ad.Bid = d.float()
+	ad.Rank = d.varint()
+	ad.MaxImpressionsPerUserPerDay = uint32(d.uvarint())
+	ad.DailyBudget = d.uvarint()
+	ad.LifetimeBudget = d.uvarint()
+	ad.Version = int(d.varint())
+	ad.IsActive = d.byte() == 1
+	ad.CreatedAt = d.time()
+	return ad
+}
@@ -0,0 +1,134 @@
+package snapshot
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	filePrefix = "snapshot-"
+	fileSuffix = ".bin"
+)
+
+// FileSnapshotter keeps the snapshots in a local directory,
+// the snapshot of version v is stored in `snapshot-<v>.bin`
+type FileSnapshotter struct {
+	dir string
+	// keep is the number of the newest snapshots kept on disk
+	keep int
+}
+
+func NewFileSnapshotter(dir string, keep int) (model.Snapshotter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	return &FileSnapshotter{dir: dir, keep: keep}, nil
+}
+
+// Save implements model.Snapshotter.
+// The snapshot is written to a temporary file and renamed, so a crash never leaves a partial snapshot behind.
+func (s *FileSnapshotter) Save(snapshot *model.Snapshot) error {
+	data, err := Encode(snapshot)
+	if err != nil {
+		return err
+	}
+	path := s.path(snapshot.Version)
+	tmp, err := os.CreateTemp(s.dir, filePrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	s.prune()
+	return nil
+}
+
+// Load implements model.Snapshotter.
+// The snapshots are tried from the newest one, the corrupted ones are skipped.
+func (s *FileSnapshotter) Load() (*model.Snapshot, error) {
+	versions, err := s.versions()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		path := s.path(versions[i])
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("error reading snapshot %s: %v", path, err)
+			continue
+		}
+		snapshot, err := Decode(data)
+		if err != nil {
+			log.Printf("error decoding snapshot %s: %v", path, err)
+			continue
+		}
+		if snapshot.Version != versions[i] {
+			log.Printf("snapshot %s has version %d", path, snapshot.Version)
+			continue
+		}
+		return snapshot, nil
+	}
+	return nil, model.ErrNoSnapshot
+}
+
+// prune removes the snapshots except the newest `keep` ones
+func (s *FileSnapshotter) prune() {
+	versions, err := s.versions()
+	if err != nil {
+		log.Printf("error listing snapshots: %v", err)
+		return
+	}
+	for i := 0; i < len(versions)-s.keep; i++ {
+		if err := os.Remove(s.path(versions[i])); err != nil {
+			log.Printf("error removing snapshot: %v", err)
+		}
+	}
+}
+
+// versions returns the versions of the snapshots on disk in ascending order
+func (s *FileSnapshotter) versions() ([]int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		version, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+func (s *FileSnapshotter) path(version int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", filePrefix, version, fileSuffix))
+}
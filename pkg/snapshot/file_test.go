@@ -0,0 +1,157 @@
+package snapshot
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSnapshot(version int64, n int) *model.Snapshot {
+	loc := time.FixedZone("CST", 8*60*60)
+	campaignID := uuid.New()
+	ads := make([]*model.Ad, 0, n)
+	for i := 0; i < n; i++ {
+		ad := &model.Ad{
+			ID:                          uuid.New(),
+			Title:                       "test",
+			Content:                     "測試",
+			LandingURL:                  "https://www.dcard.tw",
+			StartAt:                     model.CustomTime(time.Date(2024, 1, 1, 0, 0, 0, 0, loc)),
+			EndAt:                       model.CustomTime(time.Date(2024, 12, 31, 0, 0, 0, 0, loc)),
+			AgeStart:                    18,
+			AgeEnd:                      65,
+			Gender:                      []string{"F", "M"},
+			Country:                     []string{"TW", "JP"},
+			Platform:                    []string{},
+			ExcludePlatform:             []string{"web"},
+			Language:                    []string{"zh-TW", "en"},
+			Region:                      []string{"TW-TPE"},
+			AppVersionStart:             5 << 32,
+			AppVersionEnd:               6<<32 | 1,
+			Targeting:                   "age >= 30 OR platform = ios",
+			Schedule:                    model.Schedule{{Weekdays: []string{"mon", "fri"}, StartHour: 18, EndHour: 23}},
+			Geo:                         model.GeoCircles{{Lat: 25.033, Long: 121.5654, RadiusKm: 3}},
+			Tags:                        []string{"gaming", "makeup"},
+			OwnerID:                     "advertiser-1",
+			Bid:                         2.5 * float64(i),
+			Rank:                        -int64(i),
+			MaxImpressionsPerUserPerDay: uint32(i),
+			DailyBudget:                 uint64(1000 * i),
+			LifetimeBudget:              uint64(10000 * i),
+			Version:                     i + 1,
+			IsActive:                    true,
+			CreatedAt:                   model.CustomTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+		}
+		// every other ad belongs to a paused campaign
+		if i%2 == 1 {
+			ad.CampaignID = &campaignID
+			ad.CampaignPaused = true
+		}
+		ads = append(ads, ad)
+	}
+	return &model.Snapshot{Version: version, Ads: ads}
+}
+
+func TestCodec(t *testing.T) {
+	snapshot := newSnapshot(42, 3)
+	data, err := Encode(snapshot)
+	assert.Nil(t, err)
+
+	decoded, err := Decode(data)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot.Version, decoded.Version)
+	assert.Len(t, decoded.Ads, 3)
+	for i, ad := range snapshot.Ads {
+		got := decoded.Ads[i]
+		assert.Equal(t, ad.ID, got.ID)
+		assert.Equal(t, ad.Content, got.Content)
+		assert.Equal(t, ad.LandingURL, got.LandingURL)
+		assert.True(t, ad.StartAt.T().Equal(got.StartAt.T()))
+		assert.Equal(t, ad.StartAt.T().Format(time.RFC3339), got.StartAt.T().Format(time.RFC3339))
+		assert.Equal(t, ad.Gender, got.Gender)
+		assert.Equal(t, ad.Country, got.Country)
+		assert.Empty(t, got.Platform)
+		assert.Empty(t, got.ExcludeCountry)
+		assert.Equal(t, ad.ExcludePlatform, got.ExcludePlatform)
+		assert.Equal(t, ad.Language, got.Language)
+		assert.Equal(t, ad.Region, got.Region)
+		assert.Equal(t, ad.AppVersionStart, got.AppVersionStart)
+		assert.Equal(t, ad.AppVersionEnd, got.AppVersionEnd)
+		assert.Equal(t, ad.Targeting, got.Targeting)
+		assert.Equal(t, ad.Schedule, got.Schedule)
+		assert.Equal(t, ad.Geo, got.Geo)
+		assert.Equal(t, ad.Tags, got.Tags)
+		assert.Equal(t, ad.OwnerID, got.OwnerID)
+		assert.Equal(t, ad.CampaignID, got.CampaignID)
+		assert.Equal(t, ad.CampaignPaused, got.CampaignPaused)
+		assert.Equal(t, ad.Bid, got.Bid)
+		assert.Equal(t, ad.Rank, got.Rank)
+		assert.Equal(t, ad.MaxImpressionsPerUserPerDay, got.MaxImpressionsPerUserPerDay)
+		assert.Equal(t, ad.DailyBudget, got.DailyBudget)
+		assert.Equal(t, ad.LifetimeBudget, got.LifetimeBudget)
+		assert.Equal(t, ad.Version, got.Version)
+		assert.True(t, got.IsActive)
+	}
+
+	empty, err := Encode(&model.Snapshot{Version: 0})
+	assert.Nil(t, err)
+	decoded, err = Decode(empty)
+	assert.Nil(t, err)
+	assert.Empty(t, decoded.Ads)
+}
+
+func TestCodecCorrupted(t *testing.T) {
+	data, err := Encode(newSnapshot(1, 2))
+	assert.Nil(t, err)
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "bad magic", data: append([]byte("XXXX"), data[4:]...)},
+		{name: "truncated", data: data[:len(data)-10]},
+		{name: "flipped byte", data: flipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			assert.ErrorIs(t, err, ErrCorrupted)
+		})
+	}
+}
+
+func TestFileSnapshotter(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileSnapshotter(dir, 2)
+	assert.Nil(t, err)
+
+	_, err = s.Load()
+	assert.ErrorIs(t, err, model.ErrNoSnapshot)
+
+	for _, version := range []int64{1, 5, 10} {
+		assert.Nil(t, s.Save(newSnapshot(version, int(version))))
+	}
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	snapshot, err := s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), snapshot.Version)
+	assert.Len(t, snapshot.Ads, 10)
+
+	// the newest snapshot is corrupted, the previous one is loaded
+	newest := filepath.Join(dir, files[len(files)-1].Name())
+	assert.Nil(t, os.WriteFile(newest, []byte("broken"), 0o644))
+	snapshot, err = s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), snapshot.Version)
+}
@@ -0,0 +1,321 @@
+package targeting
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type evalFunc func(req *model.GetAdRequest) truth
+
+// field is a field of the request the expressions can compare
+type field struct {
+	// number returns the numeric value of the field and whether the request has it, nil if the field is not numeric
+	number func(req *model.GetAdRequest) (int64, bool)
+	// text returns the value of the field and whether the request has it, nil if the field is numeric
+	text func(req *model.GetAdRequest) (string, bool)
+	// valid reports whether the value can be compared with the field
+	valid func(v string) bool
+}
+
+var fields = map[string]field{
+	"age": {
+		number: func(req *model.GetAdRequest) (int64, bool) { return int64(req.Age), req.Age != 0 },
+		valid:  func(v string) bool { n, err := strconv.ParseUint(v, 10, 8); return err == nil && n > 0 },
+	},
+	"country": {
+		text:  func(req *model.GetAdRequest) (string, bool) { return req.Country, req.Country != "" },
+		valid: isCountryCode,
+	},
+	"platform": {
+		text:  func(req *model.GetAdRequest) (string, bool) { return req.Platform, req.Platform != "" },
+		valid: oneOf("android", "ios", "web"),
+	},
+	"gender": {
+		text:  func(req *model.GetAdRequest) (string, bool) { return req.Gender, req.Gender != "" },
+		valid: oneOf("M", "F"),
+	},
+}
+
+// parser is a recursive descent parser compiling the expression into closures
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("%w: expected %s, got %s", ErrInvalidExpression, what, t)
+	}
+	return t, nil
+}
+
+func (p *parser) expr() (evalFunc, error) {
+	operands, err := p.list(p.and, "OR")
+	if err != nil || len(operands) == 1 {
+		return first(operands), err
+	}
+	return func(req *model.GetAdRequest) truth {
+		ret := falsy
+		for _, operand := range operands {
+			ret = max(ret, operand(req))
+			if ret == truthy {
+				break
+			}
+		}
+		return ret
+	}, nil
+}
+
+func (p *parser) and() (evalFunc, error) {
+	operands, err := p.list(p.unary, "AND")
+	if err != nil || len(operands) == 1 {
+		return first(operands), err
+	}
+	return func(req *model.GetAdRequest) truth {
+		ret := truthy
+		for _, operand := range operands {
+			ret = min(ret, operand(req))
+			if ret == falsy {
+				break
+			}
+		}
+		return ret
+	}, nil
+}
+
+// list parses the operands separated by the keyword
+func (p *parser) list(operand func() (evalFunc, error), keyword string) ([]evalFunc, error) {
+	operands := make([]evalFunc, 0, 1)
+	for {
+		eval, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, eval)
+		if !p.peek().keyword(keyword) {
+			return operands, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) unary() (evalFunc, error) {
+	t := p.peek()
+	switch {
+	case t.keyword("NOT"):
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(req *model.GetAdRequest) truth { return operand(req).not() }, nil
+	case t.kind == tokenLParen:
+		p.next()
+		eval, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return eval, nil
+	default:
+		return p.comparison()
+	}
+}
+
+func (p *parser) comparison() (evalFunc, error) {
+	name, err := p.expect(tokenIdent, "field")
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fields[strings.ToLower(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown field %s", ErrInvalidExpression, name)
+	}
+
+	negated := false
+	if p.peek().keyword("NOT") {
+		p.next()
+		negated = true
+		if !p.peek().keyword("IN") {
+			return nil, fmt.Errorf("%w: expected IN, got %s", ErrInvalidExpression, p.peek())
+		}
+	}
+	if p.peek().keyword("IN") {
+		p.next()
+		values, err := p.values(f)
+		if err != nil {
+			return nil, err
+		}
+		eval := compileIn(f, values)
+		if negated {
+			return func(req *model.GetAdRequest) truth { return eval(req).not() }, nil
+		}
+		return eval, nil
+	}
+
+	op, err := p.expect(tokenOp, "operator")
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.value(f)
+	if err != nil {
+		return nil, err
+	}
+	if f.number == nil && op.text != "=" && op.text != "!=" {
+		return nil, fmt.Errorf("%w: operator %s does not apply to %s", ErrInvalidExpression, op, name.text)
+	}
+	return compileComparison(f, op.text, value), nil
+}
+
+// values parses the parenthesized list of the values of IN
+func (p *parser) values(f field) ([]string, error) {
+	if _, err := p.expect(tokenLParen, "'('"); err != nil {
+		return nil, err
+	}
+	values := make([]string, 0)
+	for {
+		value, err := p.value(f)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		t := p.next()
+		if t.kind == tokenRParen {
+			return values, nil
+		}
+		if t.kind != tokenComma {
+			return nil, fmt.Errorf("%w: expected ',' or ')', got %s", ErrInvalidExpression, t)
+		}
+	}
+}
+
+func (p *parser) value(f field) (string, error) {
+	t := p.next()
+	if t.kind != tokenIdent && t.kind != tokenString {
+		return "", fmt.Errorf("%w: expected value, got %s", ErrInvalidExpression, t)
+	}
+	if !f.valid(t.text) {
+		return "", fmt.Errorf("%w: invalid value %s", ErrInvalidExpression, t)
+	}
+	return t.text, nil
+}
+
+func compileIn(f field, values []string) evalFunc {
+	if f.number != nil {
+		set := make(map[int64]struct{}, len(values))
+		for _, v := range values {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			set[n] = struct{}{}
+		}
+		return func(req *model.GetAdRequest) truth {
+			n, ok := f.number(req)
+			if !ok {
+				return unknown
+			}
+			_, in := set[n]
+			return toTruth(in)
+		}
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return func(req *model.GetAdRequest) truth {
+		s, ok := f.text(req)
+		if !ok {
+			return unknown
+		}
+		_, in := set[s]
+		return toTruth(in)
+	}
+}
+
+func compileComparison(f field, op string, value string) evalFunc {
+	if f.number == nil {
+		equal := op == "="
+		return func(req *model.GetAdRequest) truth {
+			s, ok := f.text(req)
+			if !ok {
+				return unknown
+			}
+			return toTruth((s == value) == equal)
+		}
+	}
+	want, _ := strconv.ParseInt(value, 10, 64)
+	var cmp func(n int64) bool
+	switch op {
+	case "=":
+		cmp = func(n int64) bool { return n == want }
+	case "!=":
+		cmp = func(n int64) bool { return n != want }
+	case "<":
+		cmp = func(n int64) bool { return n < want }
+	case "<=":
+		cmp = func(n int64) bool { return n <= want }
+	case ">":
+		cmp = func(n int64) bool { return n > want }
+	default:
+		cmp = func(n int64) bool { return n >= want }
+	}
+	return func(req *model.GetAdRequest) truth {
+		n, ok := f.number(req)
+		if !ok {
+			return unknown
+		}
+		return toTruth(cmp(n))
+	}
+}
+
+func toTruth(b bool) truth {
+	if b {
+		return truthy
+	}
+	return falsy
+}
+
+func first(evals []evalFunc) evalFunc {
+	if len(evals) == 0 {
+		return nil
+	}
+	return evals[0]
+}
+
+func oneOf(values ...string) func(v string) bool {
+	return func(v string) bool {
+		for _, value := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func isCountryCode(v string) bool {
+	if len(v) != 2 {
+		return false
+	}
+	for _, c := range v {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+// Package targeting parses and evaluates the boolean targeting expressions of the ads, e.g.
+//
+//	country IN (TW, JP) AND (platform = ios OR age >= 30) AND NOT gender = M
+//
+// The grammar, the keywords and the field names are case-insensitive:
+//
+//	expr       = and { "OR" and }
+//	and        = unary { "AND" unary }
+//	unary      = "NOT" unary | "(" expr ")" | comparison
+//	comparison = field op value | field [ "NOT" ] "IN" "(" value { "," value } ")"
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">="
+//
+// The values are unquoted words or quoted strings, the order operators only apply to the numeric fields.
+package targeting
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidExpression is returned when the expression can not be parsed, 400
+	ErrInvalidExpression = fmt.Errorf("invalid targeting expression")
+)
+
+// truth is the result of the three-valued logic of the expressions.
+// A comparison on a field the request does not have is unknown,
+// so the request without the field is not constrained by it, the same as the index fields.
+type truth int8
+
+const (
+	falsy truth = iota
+	unknown
+	truthy
+)
+
+func (t truth) not() truth {
+	return truthy - t
+}
+
+// Expr is a compiled targeting expression
+type Expr struct {
+	source string
+	eval   func(req *model.GetAdRequest) truth
+}
+
+// Parse parses and compiles the expression
+func Parse(s string) (*Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	eval, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidExpression, t)
+	}
+	return &Expr{source: s, eval: eval}, nil
+}
+
+// Validate returns the parse error of the expression, the empty expression is valid
+func Validate(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	_, err := Parse(s)
+	return err
+}
+
+// Match reports whether the ad of the expression can be served to the request,
+// the ad is only rejected if the expression is false, not if it is unknown
+func (e *Expr) Match(req *model.GetAdRequest) bool {
+	return e.eval(req) != falsy
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
@@ -0,0 +1,95 @@
+package targeting
+
+import (
+	"dcard-backend-2024/pkg/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "comparison", expr: "country = TW"},
+		{name: "in", expr: "country IN (TW, JP)"},
+		{name: "not in", expr: "platform NOT IN ('ios', \"web\")"},
+		{name: "nested", expr: "country IN (TW,JP) AND (platform = ios OR age >= 30) AND NOT gender = M"},
+		{name: "case-insensitive keywords", expr: "Country in (TW) and not (age < 18 or age > 65)"},
+		{name: "unknown field", expr: "city = Taipei", wantErr: true},
+		{name: "invalid value", expr: "gender = X", wantErr: true},
+		{name: "invalid country", expr: "country = tw", wantErr: true},
+		{name: "invalid age", expr: "age > 300", wantErr: true},
+		{name: "order operator on text", expr: "country > TW", wantErr: true},
+		{name: "missing operand", expr: "country = TW AND", wantErr: true},
+		{name: "unbalanced parentheses", expr: "(country = TW", wantErr: true},
+		{name: "trailing token", expr: "country = TW JP", wantErr: true},
+		{name: "unterminated string", expr: "country = 'TW", wantErr: true},
+		{name: "empty list", expr: "country IN ()", wantErr: true},
+		{name: "bang", expr: "country ! TW", wantErr: true},
+		{name: "empty", expr: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := Parse(tt.expr)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidExpression)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expr, expr.String())
+		})
+	}
+	assert.Nil(t, Validate(" "))
+}
+
+func TestExpr_Match(t *testing.T) {
+	expr, err := Parse("country IN (TW,JP) AND (platform = ios OR age >= 30) AND NOT gender = M")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		req  model.GetAdRequest
+		want bool
+	}{
+		{name: "ios", req: model.GetAdRequest{Country: "TW", Platform: "ios", Age: 20, Gender: "F"}, want: true},
+		{name: "age", req: model.GetAdRequest{Country: "JP", Platform: "web", Age: 30, Gender: "F"}, want: true},
+		{name: "other country", req: model.GetAdRequest{Country: "US", Platform: "ios", Age: 20, Gender: "F"}, want: false},
+		{name: "too young on the web", req: model.GetAdRequest{Country: "TW", Platform: "web", Age: 29, Gender: "F"}, want: false},
+		{name: "excluded gender", req: model.GetAdRequest{Country: "TW", Platform: "ios", Age: 20, Gender: "M"}, want: false},
+		// the missing fields do not constrain the request
+		{name: "no gender", req: model.GetAdRequest{Country: "TW", Platform: "ios"}, want: true},
+		{name: "no age on the web", req: model.GetAdRequest{Country: "TW", Platform: "web"}, want: true},
+		{name: "no fields", req: model.GetAdRequest{}, want: true},
+		{name: "known false beats unknown", req: model.GetAdRequest{Country: "US"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, expr.Match(&tt.req))
+		})
+	}
+}
+
+func TestExpr_MatchOperators(t *testing.T) {
+	req := &model.GetAdRequest{Age: 30, Country: "TW"}
+	tests := map[string]bool{
+		"age = 30":                 true,
+		"age != 30":                false,
+		"age < 30":                 false,
+		"age <= 30":                true,
+		"age > 29":                 true,
+		"age >= 31":                false,
+		"age IN (18, 30)":          true,
+		"age NOT IN (18, 30)":      false,
+		"country != JP":            true,
+		"NOT NOT country = TW":     true,
+		"country = JP OR age = 30": true,
+	}
+	for expr, want := range tests {
+		e, err := Parse(expr)
+		assert.Nil(t, err, expr)
+		assert.Equal(t, want, e.Match(req), expr)
+	}
+}
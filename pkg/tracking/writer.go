@@ -0,0 +1,164 @@
+package tracking
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/metrics"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrBufferFull is returned when the event is dropped because the buffer is full
+	ErrBufferFull = fmt.Errorf("tracking buffer is full")
+	// ErrWriterClosed is returned when the event is written after Close
+	ErrWriterClosed = fmt.Errorf("tracking writer is closed")
+)
+
+// hourKey identifies a row of ad_stats_hourly
+type hourKey struct {
+	adID uuid.UUID
+	hour int64
+}
+
+// BatchWriter aggregates the events per ad per hour in memory,
+// and upserts the counts into ad_stats_hourly every flushInterval or once batchSize rows are pending.
+// The counts of a failed flush are kept and retried by the next tick, not by the next event,
+// so a database outage is not hit with a flush per event.
+type BatchWriter struct {
+	db            *gorm.DB
+	events        chan *model.TrackingEvent
+	batchSize     int
+	flushInterval time.Duration
+	// pending is only accessed by Run
+	pending map[hourKey]*model.AdStatsHourly
+	// failed is set by a failed flush until a flush succeeds, only accessed by Run
+	failed  bool
+	closed  atomic.Bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func NewBatchWriter(db *gorm.DB, bufferSize int, batchSize int, flushInterval time.Duration) *BatchWriter {
+	return &BatchWriter{
+		db:            db,
+		events:        make(chan *model.TrackingEvent, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		pending:       make(map[hourKey]*model.AdStatsHourly),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// Write implements model.EventWriter.
+func (w *BatchWriter) Write(event *model.TrackingEvent) error {
+	if w.closed.Load() {
+		return ErrWriterClosed
+	}
+	select {
+	case w.events <- event:
+		metrics.TrackingEvents.WithLabelValues(string(event.Type), "accepted").Inc()
+		return nil
+	default:
+		metrics.TrackingEvents.WithLabelValues(string(event.Type), "dropped").Inc()
+		return ErrBufferFull
+	}
+}
+
+// Run implements model.EventWriter.
+func (w *BatchWriter) Run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-w.events:
+			w.add(event)
+			if w.full() {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		case <-w.done:
+			// drain the events written before Close
+			for {
+				select {
+				case event := <-w.events:
+					w.add(event)
+				default:
+					w.flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close implements model.EventWriter.
+func (w *BatchWriter) Close(ctx context.Context) error {
+	if w.closed.CompareAndSwap(false, true) {
+		close(w.done)
+	}
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// full reports whether the pending counts are flushed on an event, they are not while the last flush failed
+func (w *BatchWriter) full() bool {
+	return !w.failed && len(w.pending) >= w.batchSize
+}
+
+func (w *BatchWriter) add(event *model.TrackingEvent) {
+	hour := event.At.Truncate(time.Hour)
+	key := hourKey{adID: event.AdID, hour: hour.Unix()}
+	row, ok := w.pending[key]
+	if !ok {
+		row = &model.AdStatsHourly{AdID: event.AdID, Hour: model.CustomTime(hour)}
+		w.pending[key] = row
+	}
+	switch event.Type {
+	case model.EventTypeImpression:
+		row.Impressions++
+	case model.EventTypeClick:
+		row.Clicks++
+	}
+}
+
+// flush upserts the pending counts, the counts are added to the existing rows
+func (w *BatchWriter) flush() {
+	if len(w.pending) == 0 {
+		return
+	}
+	rows := make([]*model.AdStatsHourly, 0, len(w.pending))
+	for _, row := range w.pending {
+		rows = append(rows, row)
+	}
+	start := time.Now()
+	err := w.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "ad_id"}, {Name: "hour"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"impressions": gorm.Expr("ad_stats_hourly.impressions + excluded.impressions"),
+			"clicks":      gorm.Expr("ad_stats_hourly.clicks + excluded.clicks"),
+		}),
+	}).Create(&rows).Error
+	if err != nil {
+		metrics.TrackingFlushDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+		log.Printf("error flushing %d tracking rows: %v", len(rows), err)
+		w.failed = true
+		return
+	}
+	w.failed = false
+	metrics.TrackingFlushDuration.WithLabelValues("ok").Observe(time.Since(start).Seconds())
+	w.pending = make(map[hourKey]*model.AdStatsHourly)
+}
@@ -0,0 +1,95 @@
+package tracking
+
+import (
+	"context"
+	"dcard-backend-2024/pkg/model"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db, DriverName: "postgres"}), &gorm.Config{})
+	assert.Nil(t, err)
+	return gdb, mock
+}
+
+func TestBatchWriter_add(t *testing.T) {
+	w := NewBatchWriter(nil, 10, 10, time.Hour)
+	adID := uuid.New()
+	hour := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, event := range []*model.TrackingEvent{
+		{AdID: adID, Type: model.EventTypeImpression, At: hour.Add(1 * time.Minute)},
+		{AdID: adID, Type: model.EventTypeImpression, At: hour.Add(59 * time.Minute)},
+		{AdID: adID, Type: model.EventTypeClick, At: hour.Add(30 * time.Minute)},
+		{AdID: adID, Type: model.EventTypeImpression, At: hour.Add(61 * time.Minute)},
+	} {
+		w.add(event)
+	}
+	assert.Len(t, w.pending, 2)
+	row := w.pending[hourKey{adID: adID, hour: hour.Unix()}]
+	assert.Equal(t, int64(2), row.Impressions)
+	assert.Equal(t, int64(1), row.Clicks)
+	assert.True(t, hour.Equal(row.Hour.T()))
+	row = w.pending[hourKey{adID: adID, hour: hour.Add(time.Hour).Unix()}]
+	assert.Equal(t, int64(1), row.Impressions)
+	assert.Equal(t, int64(0), row.Clicks)
+}
+
+func TestBatchWriter_Run(t *testing.T) {
+	db, mock := newMockDB(t)
+	w := NewBatchWriter(db, 10, 10, time.Hour)
+	go w.Run()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"ad_stats_hourly\" .+ ON CONFLICT \\(\"ad_id\",\"hour\"\\) DO UPDATE SET .+$").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, w.Write(&model.TrackingEvent{AdID: uuid.New(), Type: model.EventTypeImpression, At: time.Now()}))
+	}
+	// Close flushes the buffered events
+	assert.Nil(t, w.Close(context.Background()))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.ErrorIs(t, w.Write(&model.TrackingEvent{AdID: uuid.New(), Type: model.EventTypeClick, At: time.Now()}), ErrWriterClosed)
+}
+
+func TestBatchWriter_flushRetry(t *testing.T) {
+	db, mock := newMockDB(t)
+	w := NewBatchWriter(db, 10, 1, time.Hour)
+	w.add(&model.TrackingEvent{AdID: uuid.New(), Type: model.EventTypeClick, At: time.Now()})
+	assert.True(t, w.full())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"ad_stats_hourly\"").WillReturnError(fmt.Errorf("connection refused"))
+	mock.ExpectRollback()
+	w.flush()
+	// the counts of the failed flush are kept, and retried by the ticker instead of the next event
+	assert.Len(t, w.pending, 1)
+	assert.False(t, w.full())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"ad_stats_hourly\"").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	w.flush()
+	assert.Empty(t, w.pending)
+	assert.False(t, w.failed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestBatchWriter_Write_bufferFull(t *testing.T) {
+	w := NewBatchWriter(nil, 1, 10, time.Hour)
+	event := &model.TrackingEvent{AdID: uuid.New(), Type: model.EventTypeImpression, At: time.Now()}
+	assert.Nil(t, w.Write(event))
+	// nothing consumes the buffer
+	assert.ErrorIs(t, w.Write(event), ErrBufferFull)
+}